@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"github.com/bastienvty/netsecfs/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+// escrowCmd groups the commands about the escrow key of a volume
+var escrowCmd = &cobra.Command{
+	Use:   "escrow",
+	Short: "Recover the users of the filesystem with the escrow key.",
+}
+
+var escrowRecoverCmd = &cobra.Command{
+	Use:   "recover [flags] NAME",
+	Short: "Set a new password for a user with the shares of the escrow key.",
+	Long: `Set a new password for a user, given as many shares of the
+escrow key created by init --escrow-shares as its threshold.
+The shares, one per administrator, and the new password are
+read from the standard input.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "netsecfs escrow recover --meta /path/to/meta.db alice",
+	Run: func(cmd *cobra.Command, args []string) {
+		addr, _ := cmd.Flags().GetString("meta")
+		if err := cli.EscrowRecover(addr, args[0]); err != nil {
+			logger.Fatalf("Failed to recover %s: %s", args[0], err)
+		}
+	},
+}
+
+func init() {
+	escrowCmd.PersistentFlags().StringP("meta", "m", "", "Path to the meta database.")
+	escrowCmd.MarkPersistentFlagRequired("meta")
+	escrowCmd.AddCommand(escrowRecoverCmd)
+}
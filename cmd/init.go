@@ -1,9 +1,13 @@
 package cmd
 
 import (
+	"fmt"
 	"path/filepath"
 	"regexp"
 
+	"github.com/bastienvty/netsecfs/internal/cli"
+	"github.com/bastienvty/netsecfs/internal/compress"
+	"github.com/bastienvty/netsecfs/internal/crypto"
 	"github.com/bastienvty/netsecfs/internal/db/meta"
 	"github.com/bastienvty/netsecfs/internal/db/object"
 	"github.com/bastienvty/netsecfs/utils"
@@ -37,6 +41,35 @@ func initialize(cmd *cobra.Command, args []string) {
 		logger.Fatalf("invalid name: %s, only alphabet, number and - are allowed, and the length should be 3 to 63 characters.", name)
 	}
 
+	cipher, _ := cmd.Flags().GetString("cipher")
+	if _, err := crypto.ParseCipher(cipher); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	compression, _ := cmd.Flags().GetString("compression")
+	if _, err := compress.Parse(compression); err != nil {
+		logger.Fatalf("%s", err)
+	}
+
+	kdf := cli.DefaultKdf()
+	memory, _ := cmd.Flags().GetUint32("kdf-memory")
+	kdf.Memory = memory * 1024
+	kdf.Iterations, _ = cmd.Flags().GetUint32("kdf-iterations")
+	kdf.Parallelism, _ = cmd.Flags().GetUint8("kdf-parallelism")
+	if memory < 8 || kdf.Iterations < 1 || kdf.Parallelism < 1 {
+		logger.Fatalf("invalid KDF parameters, the memory must be at least 8 MiB and the iterations and parallelism at least 1.")
+	}
+
+	var shares []string
+	escrowShares, _ := cmd.Flags().GetInt("escrow-shares")
+	threshold, _ := cmd.Flags().GetInt("escrow-threshold")
+	var escrow *meta.Escrow
+	if escrowShares > 0 {
+		var err error
+		if escrow, shares, err = cli.CreateEscrow(escrowShares, threshold); err != nil {
+			logger.Fatalf("Failed to create the escrow key: %s", err)
+		}
+	}
+
 	m := meta.RegisterMeta(addr)
 
 	format := &meta.Format{
@@ -45,7 +78,17 @@ func initialize(cmd *cobra.Command, args []string) {
 		Storage: storage,
 		// Capacity:  utils.ParseBytes(c, "capacity", 'G'),
 		BlockSize: BlockSize,
+		Cipher:    cipher,
+		Kdf:       &kdf,
+		Escrow:    escrow,
+		// set even to none, so that chunks start with a header
+		Compression: compression,
 	}
+	format.PadSizes, _ = cmd.Flags().GetBool("pad-sizes")
+	format.EncryptAttrs, _ = cmd.Flags().GetBool("encrypt-attrs")
+	// the sizes of the chunks would give away the ones encrypted
+	format.PadSizes = format.PadSizes || format.EncryptAttrs
+	format.Dedup, _ = cmd.Flags().GetBool("dedup")
 	p, err := filepath.Abs(format.Storage)
 	if err != nil {
 		logger.Fatalf("Failed to get absolute path of %s: %s", format.Storage, err)
@@ -62,11 +105,27 @@ func initialize(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 	logger.Infof("Volume is formatted as %s", format)
+	for i, share := range shares {
+		fmt.Printf("Escrow share %d of %d: %s\n", i+1, len(shares), share)
+	}
+	if shares != nil {
+		fmt.Printf("Hand out one share per administrator, %d of them are needed to recover a user.\n", threshold)
+	}
 }
 
 func init() {
 	initCmd.Flags().StringP("storage", "s", "", "Path to the storage database.")
 	initCmd.Flags().StringP("meta", "m", "", "Path to the meta database.")
+	initCmd.Flags().String("cipher", "aes-gcm", "Cipher to encrypt with: aes-gcm or xchacha20-poly1305.")
+	initCmd.Flags().Uint32("kdf-memory", cli.DefaultMemory/1024, "Memory of Argon2id for new passwords, in MiB.")
+	initCmd.Flags().Uint32("kdf-iterations", cli.DefaultIterations, "Iterations of Argon2id for new passwords.")
+	initCmd.Flags().Uint8("kdf-parallelism", cli.DefaultParallelism, "Parallelism of Argon2id for new passwords.")
+	initCmd.Flags().Int("escrow-shares", 0, "Number of administrators the escrow key is split among, no escrow if 0.")
+	initCmd.Flags().Int("escrow-threshold", 2, "Number of administrators needed to recover a user with the escrow key.")
+	initCmd.Flags().Bool("pad-sizes", false, "Pad the content of files so that the storage only learns their size roughly.")
+	initCmd.Flags().String("compression", "none", "Compression of the chunks before encryption: zstd, lz4 or none.")
+	initCmd.Flags().Bool("encrypt-attrs", false, "Encrypt the sizes, modes, times and owners of files and directories in the meta database, padding sizes too.")
+	initCmd.Flags().Bool("dedup", false, "Store the chunks that are equal within the tree of a user or a group once.")
 	initCmd.MarkFlagRequired("storage")
 	initCmd.MarkFlagRequired("meta")
 }
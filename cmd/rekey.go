@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"github.com/bastienvty/netsecfs/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey [flags] NAME",
+	Short: "Replace the keys of a user after a suspected compromise.",
+	Long: `Replace the root key of a user and the keys of every file and
+directory below it, or only below --path. Names are encrypted
+again and children keys, content keys and shares are wrapped by
+the new keys. The filesystem must not be mounted meanwhile. An
+interrupted rekey resumes where it stopped when run again. The
+password of the user is read from the standard input.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "netsecfs rekey --meta /path/to/meta.db --path docs alice",
+	Run: func(cmd *cobra.Command, args []string) {
+		addr, _ := cmd.Flags().GetString("meta")
+		path, _ := cmd.Flags().GetString("path")
+		keyfile, _ := cmd.Flags().GetString("keyfile")
+		if err := cli.Rekey(addr, args[0], path, keyfile); err != nil {
+			logger.Fatalf("Failed to rekey %s: %s", args[0], err)
+		}
+	},
+}
+
+func init() {
+	rekeyCmd.Flags().StringP("meta", "m", "", "Path to the meta database.")
+	rekeyCmd.Flags().StringP("path", "p", "", "Directory to rekey, relative to the root of the user.")
+	rekeyCmd.Flags().String("keyfile", "", "Key file of the user, if it has one.")
+	rekeyCmd.MarkFlagRequired("meta")
+}
@@ -45,7 +45,14 @@ func init() {
 	rootCmd.Flags().BoolP("version", "v", false, "Print the version number of netsecfs")
 
 	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(userCmd)
+	rootCmd.AddCommand(escrowCmd)
+	rootCmd.AddCommand(rekeyCmd)
 
 	rootCmd.Flags().StringP("meta", "m", "", "Path to the meta database.")
 	rootCmd.MarkFlagRequired("meta")
+	rootCmd.Flags().Int64("cache-mem", 64, "Memory of the cache of decrypted chunks, in MiB, none if 0.")
+	rootCmd.Flags().Int("read-ahead", 4, "Chunks of 64 KiB read in advance when a file is read sequentially.")
+	rootCmd.Flags().String("cache-dir", "", "Directory to cache the encrypted chunks of the storage in, none if empty.")
+	rootCmd.Flags().Int64("cache-size", 1024, "Size of the cache directory, in MiB.")
 }
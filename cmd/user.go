@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"github.com/bastienvty/netsecfs/internal/cli"
+	"github.com/spf13/cobra"
+)
+
+// userCmd groups the commands about the users of a volume
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage the users of the filesystem.",
+}
+
+var fingerprintCmd = &cobra.Command{
+	Use:   "fingerprint [flags] NAME",
+	Short: "Print the fingerprint of the public key of a user.",
+	Long: `Print the fingerprint of the public key of a user, so that it
+can be compared out of band with the one the user sees. The
+fingerprint is pinned the first time a directory is shared
+with the user and sharing is refused if it changes.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "netsecfs user fingerprint --meta /path/to/meta.db bob",
+	Run: func(cmd *cobra.Command, args []string) {
+		addr, _ := cmd.Flags().GetString("meta")
+		if err := cli.Fingerprint(addr, args[0]); err != nil {
+			logger.Fatalf("Failed to get the fingerprint of %s: %s", args[0], err)
+		}
+	},
+}
+
+var recoverCmd = &cobra.Command{
+	Use:   "recover [flags] NAME",
+	Short: "Set a new password with the recovery key of a user.",
+	Long: `Set a new password for a user who forgot it, given the
+recovery key printed when it was created with signup --recovery
+or the recovery console command. The recovery key and the new
+password are read from the standard input.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "netsecfs user recover --meta /path/to/meta.db alice",
+	Run: func(cmd *cobra.Command, args []string) {
+		addr, _ := cmd.Flags().GetString("meta")
+		if err := cli.Recover(addr, args[0]); err != nil {
+			logger.Fatalf("Failed to recover %s: %s", args[0], err)
+		}
+	},
+}
+
+func init() {
+	userCmd.PersistentFlags().StringP("meta", "m", "", "Path to the meta database.")
+	userCmd.MarkPersistentFlagRequired("meta")
+	userCmd.AddCommand(fingerprintCmd, recoverCmd)
+}
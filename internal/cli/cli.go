@@ -4,11 +4,17 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bastienvty/netsecfs/internal/crypto"
 	"github.com/bastienvty/netsecfs/internal/db/meta"
 	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/bastienvty/netsecfs/internal/fs"
+	"github.com/bastienvty/netsecfs/utils"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/spf13/cobra"
 )
@@ -17,6 +23,8 @@ const (
 	input = "netsecfs> "
 )
 
+var logger = utils.GetLogger("netsecfs")
+
 var (
 	isMounted bool
 	isLogged  bool
@@ -29,6 +37,9 @@ func Initialize(cmd *cobra.Command, args []string) {
 	}
 	addr, _ := cmd.Flags().GetString("meta")
 	mp := args[0]
+	cacheMem, _ := cmd.Flags().GetInt64("cache-mem")
+	readAhead, _ := cmd.Flags().GetInt("read-ahead")
+	tuning := fs.Options{CacheSize: cacheMem << 20, ReadAhead: readAhead}
 
 	m := meta.RegisterMeta(addr)
 	format, err := m.Load()
@@ -41,6 +52,14 @@ func Initialize(cmd *cobra.Command, args []string) {
 		fmt.Println("CreateStorage fail: ", err)
 		return
 	}
+	if cacheDir, _ := cmd.Flags().GetString("cache-dir"); cacheDir != "" {
+		cacheSize, _ := cmd.Flags().GetInt64("cache-size")
+		// a directory per volume, so that several can share the cache directory
+		if blob, err = object.NewDiskCache(blob, filepath.Join(cacheDir, format.UUID), cacheSize<<20); err != nil {
+			fmt.Println("Cache fail: ", err)
+			return
+		}
+	}
 	if m != nil {
 		defer m.Shutdown()
 	}
@@ -48,14 +67,26 @@ func Initialize(cmd *cobra.Command, args []string) {
 		defer object.Shutdown(blob)
 	}
 
-	startConsole(m, blob, mp)
+	algo, err := crypto.ParseCipher(format.Cipher)
+	if err != nil {
+		fmt.Println("Load fail: ", err)
+		return
+	}
+	enc := &crypto.CryptoHelper{Cipher: algo}
+	kdf := DefaultKdf()
+	if format.Kdf != nil {
+		kdf = *format.Kdf
+	}
+
+	startConsole(m, blob, mp, enc, newKnownKeys(format.UUID), kdf, format, tuning)
 }
 
-func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
+func startConsole(m meta.Meta, blob object.ObjectStorage, mp string, enc crypto.Crypto, known *knownKeys, kdf meta.Kdf, format *meta.Format, tuning fs.Options) {
 	scanner := bufio.NewScanner(os.Stdin)
 	var server *fuse.Server
 	var err error
 	var user User
+	var stopSweeper func()
 	for {
 		fmt.Print(input)
 		scanned := scanner.Scan()
@@ -72,27 +103,41 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 			if isMounted {
 				fmt.Println("It may be still mounted. Please unmount it.")
 			}
+			user.wipe()
 			return
 		case "help":
-			fmt.Println("Commands: signup, login, logout, passwd, mount, umount, share, unshare and exit")
+			fmt.Println("Commands: signup, login, logout, passwd, recovery, mount, umount, stats, share, unshare, shares, group, fingerprint, trust, migrate, seal and exit")
 		case "signup":
 			if isLogged {
 				fmt.Println("User already logged in.")
 				continue
 			}
-			if len(fields) != 3 {
-				fmt.Println("Usage: signup <username> <password>")
+			opts, ok := parseLoginOpts(fields, 3, "--recovery", "--keyfile")
+			if !ok {
+				fmt.Println("Usage: signup <username> <password> [--recovery] [--keyfile <path>]")
 				continue
 			}
 			user = User{
 				username: fields[1],
 				password: fields[2],
 				m:        m,
-				enc:      &crypto.CryptoHelper{},
+				obj:      blob,
+				enc:      enc,
+				known:    known,
+				kdf:      kdf,
+				escrow:   format.Escrow,
+				format:   format,
+			}
+			if opts.keyfile != "" {
+				if user.keyfile, err = readKeyfile(opts.keyfile); err != nil {
+					fmt.Println("Cannot read the key file:", err)
+					continue
+				}
 			}
 			// startTime := time.Now()
 			create := user.createUser()
 			if !create {
+				user.wipe()
 				fmt.Println("User creation failed. Please try again.")
 				continue
 			}
@@ -100,28 +145,47 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 			// fmt.Printf("The signup took %s to complete.\n", duration)
 			fmt.Printf("User %s created.\n", user.username)
 			isLogged = true
+			if opts.recovery && !user.createRecovery() {
+				fmt.Println("Recovery key creation failed, run `recovery` to try again.")
+			}
 		case "login":
 			if isLogged {
 				fmt.Println("User already logged in.")
 				continue
 			}
-			if len(fields) != 3 {
-				fmt.Println("Usage: login <username> <password>")
+			opts, ok := parseLoginOpts(fields, 3, "--keyfile")
+			if !ok {
+				fmt.Println("Usage: login <username> <password> [--keyfile <path>]")
 				continue
 			}
 			user = User{
 				username: fields[1],
 				password: fields[2],
 				m:        m,
-				enc:      &crypto.CryptoHelper{},
+				obj:      blob,
+				enc:      enc,
+				known:    known,
+				kdf:      kdf,
+				escrow:   format.Escrow,
+				format:   format,
+			}
+			if opts.keyfile != "" {
+				if user.keyfile, err = readKeyfile(opts.keyfile); err != nil {
+					fmt.Println("Cannot read the key file:", err)
+					continue
+				}
 			}
 			verify := user.verifyUser()
 			if !verify {
+				user.wipe()
 				fmt.Println("User verification failed. Please try again.")
 				continue
 			}
 			isLogged = true
 			fmt.Printf("User %s logged in.\n", user.username)
+			if !user.sealed {
+				fmt.Println("Your tree predates MACs, run `seal` once so that missing ones are detected.")
+			}
 		case "passwd":
 			if !isLogged {
 				fmt.Println("User not logged in.")
@@ -131,16 +195,48 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 				fmt.Println("Unmount before changing password.")
 				continue
 			}
-			if len(fields) != 2 {
-				fmt.Println("Usage: passwd <new_password>")
+			opts, ok := parseLoginOpts(fields, 2, "--keyfile", "--no-keyfile")
+			if !ok {
+				fmt.Println("Usage: passwd <new_password> [--keyfile <path> | --no-keyfile]")
 				continue
 			}
+			// the key file is kept unless another one is given or it is removed
+			keyfile := user.keyfile
+			if opts.noKeyfile {
+				keyfile = nil
+			} else if opts.keyfile != "" {
+				if keyfile, err = readKeyfile(opts.keyfile); err != nil {
+					fmt.Println("Cannot read the key file:", err)
+					continue
+				}
+			}
+			previous := user.keyfile
+			user.keyfile = keyfile
 			changed := user.changePassword(fields[1])
 			if !changed {
+				user.keyfile = previous
+				if keyfile != previous {
+					keyfile.Wipe()
+				}
 				fmt.Println("Password change failed. Please try again.")
 				continue
 			}
+			if keyfile != previous {
+				previous.Wipe()
+			}
 			fmt.Println("Password changed successfully.")
+		case "recovery":
+			if !isLogged {
+				fmt.Println("User not logged in.")
+				continue
+			}
+			if len(fields) != 1 {
+				fmt.Println("Usage: recovery")
+				continue
+			}
+			if !user.createRecovery() {
+				fmt.Println("Recovery key creation failed. Please try again.")
+			}
 		case "mount":
 			if isMounted {
 				fmt.Println("Already mounted.")
@@ -150,12 +246,28 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 				fmt.Println("User not logged in.")
 				continue
 			}
-			server, err = mount(user, blob, mp)
+			rotateExpired := len(fields) == 2 && fields[1] == "--rotate-expired"
+			if len(fields) != 1 && !rotateExpired {
+				fmt.Println("Usage: mount [--rotate-expired]")
+				continue
+			}
+			if pending, err := user.rekeyPending(); err != nil || pending {
+				fmt.Println("A rekey or a key rotation was interrupted, run `netsecfs rekey` to finish it before mounting.")
+				continue
+			}
+			opts, err := mountOptions(format, tuning)
+			if err != nil {
+				fmt.Println("Mount fail: ", err)
+				continue
+			}
+			opts.Sealed = user.sealed
+			server, user.root, err = mount(user, blob, mp, opts)
 			if err != nil || server == nil {
 				fmt.Println("Mount fail: ", err)
 				return
 			}
 			isMounted = true
+			stopSweeper = user.startSweeper(rotateExpired)
 		case "umount":
 			if server == nil {
 				fmt.Println("Server is nil.")
@@ -168,6 +280,19 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 			}
 			fmt.Println("Umount successfull.")
 			isMounted = false
+			server = nil
+			if stopSweeper != nil {
+				stopSweeper()
+				stopSweeper = nil
+			}
+			user.root.WipeKeys()
+			user.root = nil
+		case "stats":
+			if !isMounted {
+				fmt.Println("Mount before asking for stats.")
+				continue
+			}
+			printStats(format, user.root.Stats())
 		case "share":
 			if !isMounted {
 				fmt.Println("Mount before sharing.")
@@ -177,12 +302,16 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 				fmt.Println("User not logged in.")
 				continue
 			}
-			if len(fields) != 3 {
-				fmt.Println("Usage: share <folder_path> <user>")
+			if len(fields) < 3 {
+				fmt.Println("Usage: share <folder_path> <user|@group> [--ro] [--reshare] [--expire <duration>]")
 				continue
 			}
-			dir := mp + "/" + fields[1]
-			shared := user.shareDir(dir, fields[2])
+			perm, expires, ok := parseShareOpts(fields[3:])
+			if !ok {
+				fmt.Println("Usage: share <folder_path> <user|@group> [--ro] [--reshare] [--expire <duration>]")
+				continue
+			}
+			shared := user.shareDir(mp, fields[1], fields[2], perm, expires)
 			if !shared {
 				fmt.Println("Share failed. Please try again.")
 				continue
@@ -197,17 +326,139 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 				fmt.Println("User not logged in.")
 				continue
 			}
-			if len(fields) != 3 {
-				fmt.Println("Usage: unshare <folder_path> <user>")
+			rotate := len(fields) == 4 && fields[3] == "--rotate"
+			if len(fields) != 3 && !rotate {
+				fmt.Println("Usage: unshare <folder_path> <user|@group> [--rotate]")
 				continue
 			}
-			dir := mp + "/" + fields[1]
-			unshared := user.unshareDir(dir, fields[2])
+			unshared := user.unshareDir(mp, fields[1], fields[2], rotate)
 			if !unshared {
 				fmt.Println("Unshare failed. Please try again.")
 				continue
 			}
 			fmt.Println("Unshare successfull.")
+		case "shares":
+			if !isLogged {
+				fmt.Println("User not logged in.")
+				continue
+			}
+			if len(fields) >= 2 && fields[1] == "prune" {
+				rotate := len(fields) == 3 && fields[2] == "--rotate"
+				if len(fields) != 2 && !rotate {
+					fmt.Println("Usage: shares prune [--rotate]")
+					continue
+				}
+				n, err := user.pruneShares(rotate)
+				if err != nil {
+					fmt.Println("Pruning shares failed:", err)
+					continue
+				}
+				fmt.Printf("%d expired shares pruned.\n", n)
+				continue
+			}
+			asJSON := len(fields) == 3 && fields[2] == "--json"
+			if len(fields) != 2 && !asJSON {
+				fmt.Println("Usage: shares <out|in|prune> [--json]")
+				continue
+			}
+			var infos []shareInfo
+			switch fields[1] {
+			case "out":
+				infos, err = user.sharesOut()
+			case "in":
+				infos, err = user.sharesIn()
+			default:
+				fmt.Println("Usage: shares <out|in|prune> [--json]")
+				continue
+			}
+			if err != nil {
+				fmt.Println("Listing shares failed:", err)
+				continue
+			}
+			printShares(infos, asJSON)
+		case "group":
+			if !isLogged {
+				fmt.Println("User not logged in.")
+				continue
+			}
+			var done bool
+			switch {
+			case len(fields) == 3 && fields[1] == "create":
+				done = user.createGroup(fields[2])
+			case len(fields) == 4 && fields[1] == "add":
+				done = user.addMember(fields[2], fields[3])
+			case len(fields) == 4 && fields[1] == "remove":
+				done = user.removeMember(fields[2], fields[3])
+			case len(fields) == 2 && fields[1] == "list":
+				user.listGroups()
+				continue
+			default:
+				fmt.Println("Usage: group create <name> | group add <name> <user> | group remove <name> <user> | group list")
+				continue
+			}
+			if !done {
+				fmt.Println("Group operation failed. Please try again.")
+				continue
+			}
+			fmt.Println("Group updated.")
+		case "fingerprint":
+			if !isLogged {
+				fmt.Println("User not logged in.")
+				continue
+			}
+			if len(fields) > 2 {
+				fmt.Println("Usage: fingerprint [<user>]")
+				continue
+			}
+			name := user.username
+			if len(fields) == 2 {
+				name = fields[1]
+			}
+			_, fingerprint, err := user.verifiedPublicKey(name)
+			if err != nil {
+				fmt.Printf("Cannot get the key of %s: %s\n", name, err)
+				continue
+			}
+			fmt.Printf("%s %s\n", name, fingerprint)
+		case "migrate":
+			if !isLogged {
+				fmt.Println("User not logged in.")
+				continue
+			}
+			if isMounted {
+				fmt.Println("Unmount before migrating your keys.")
+				continue
+			}
+			if !user.migrateKey() {
+				fmt.Println("Key migration failed. Please try again.")
+			}
+		case "seal":
+			if !isLogged {
+				fmt.Println("User not logged in.")
+				continue
+			}
+			if isMounted {
+				fmt.Println("Unmount before sealing your tree.")
+				continue
+			}
+			opts, err := mountOptions(format, tuning)
+			if err != nil {
+				fmt.Println("Sealing fail: ", err)
+				continue
+			}
+			if !user.sealTree(opts) {
+				fmt.Println("Sealing failed. Please try again.")
+			}
+		case "trust":
+			if !isLogged {
+				fmt.Println("User not logged in.")
+				continue
+			}
+			if len(fields) != 2 {
+				fmt.Println("Usage: trust <user>")
+				continue
+			}
+			user.trust(fields[1])
 		case "logout":
 			if !isLogged {
 				fmt.Println("User not logged in.")
@@ -219,7 +470,80 @@ func startConsole(m meta.Meta, blob object.ObjectStorage, mp string) {
 			}
 			fmt.Printf("User %s logged out.\n", user.username)
 			isLogged = false
+			user.wipe()
 			user = User{}
 		}
 	}
 }
+
+// loginOpts are the options of signup, login and passwd.
+type loginOpts struct {
+	recovery  bool
+	keyfile   string
+	noKeyfile bool
+}
+
+// parseLoginOpts parses the options of a command following its args fields,
+// among the allowed ones.
+func parseLoginOpts(fields []string, args int, allowed ...string) (loginOpts, bool) {
+	var opts loginOpts
+	if len(fields) < args {
+		return opts, false
+	}
+	rest := fields[args:]
+	for i := 0; i < len(rest); i++ {
+		if !slices.Contains(allowed, rest[i]) {
+			return opts, false
+		}
+		switch rest[i] {
+		case "--recovery":
+			opts.recovery = true
+		case "--no-keyfile":
+			opts.noKeyfile = true
+		case "--keyfile":
+			if i+1 == len(rest) {
+				return opts, false
+			}
+			i++
+			opts.keyfile = rest[i]
+		}
+	}
+	return opts, !(opts.noKeyfile && opts.keyfile != "")
+}
+
+// parseShareOpts returns the permissions granted by the options of share and
+// the unix time it expires at, if any. A share is read-write by default.
+func parseShareOpts(opts []string) (uint8, int64, bool) {
+	var perm uint8 = meta.PermRead | meta.PermWrite
+	var expires int64
+	for i := 0; i < len(opts); i++ {
+		switch opts[i] {
+		case "--ro":
+			perm &^= meta.PermWrite
+		case "--reshare":
+			perm |= meta.PermReshare
+		case "--expire":
+			if i+1 == len(opts) {
+				return 0, 0, false
+			}
+			i++
+			d, err := parseDuration(opts[i])
+			if err != nil || d <= 0 {
+				return 0, 0, false
+			}
+			expires = time.Now().Add(d).Unix()
+		default:
+			return 0, 0, false
+		}
+	}
+	return perm, expires, true
+}
+
+// parseDuration is time.ParseDuration with support for days, e.g. 7d.
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+// escrowKeyLength is the number of random bytes of the escrow key. A share
+// adds its x coordinate and is printed as 40 base32 characters.
+const escrowKeyLength = 24
+
+var errWrongShares = errors.New("wrong escrow shares")
+
+// CreateEscrow generates an escrow key split into shares, any threshold of
+// which recover it. The shares are returned printable, to hand them out to
+// the administrators, and are not stored.
+func CreateEscrow(shares, threshold int) (*meta.Escrow, []string, error) {
+	secret := make([]byte, escrowKeyLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	key, err := crypto.DeriveKey(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer key.Wipe()
+	split, err := crypto.SplitSecret(secret, shares, threshold)
+	if err != nil {
+		return nil, nil, err
+	}
+	printed := make([]string, len(split))
+	for i, s := range split {
+		printed[i] = encodeKey(s)
+	}
+	return &meta.Escrow{PubKey: key.Public().Bytes(), Shares: shares, Threshold: threshold}, printed, nil
+}
+
+// updateEscrow wraps the keys of the user for the escrow key of the volume,
+// if it has one. Unless force is set, it is only done when they are not
+// wrapped for the current escrow key yet.
+func (u *User) updateEscrow(force bool) error {
+	if u.escrow == nil {
+		return nil
+	}
+	if !force {
+		var r meta.Recovery
+		if err := u.m.GetEscrow(u.username, &r); err != nil {
+			return err
+		}
+		if bytes.Equal(r.PubKey, u.escrow.PubKey) {
+			return nil
+		}
+	}
+	pubKey, err := crypto.ParsePublicKey(crypto.KeyX25519, u.escrow.PubKey)
+	if err != nil {
+		return err
+	}
+	r, err := u.wrapFor(pubKey, "escrow")
+	if err != nil {
+		return err
+	}
+	return u.m.SetEscrow(u.username, r)
+}
+
+// EscrowRecover sets a new password for a user from the shares of the escrow
+// key given by the administrators. The shares and the new password are read
+// from the standard input.
+func EscrowRecover(addr, username string) error {
+	m, format, enc, kdf, err := loadVolume(addr)
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+	if format.Escrow == nil {
+		return errors.New("the volume has no escrow key")
+	}
+	var r meta.Recovery
+	if err = m.GetEscrow(username, &r); err == syscall.ENOENT {
+		return fmt.Errorf("no such user: %s", username)
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(r.PubKey, format.Escrow.PubKey) {
+		return fmt.Errorf("the keys of %s are not escrowed, they are once the user logs in", username)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	shares := make([][]byte, 0, format.Escrow.Threshold)
+	for len(shares) < format.Escrow.Threshold {
+		fmt.Printf("Share %d of %d: ", len(shares)+1, format.Escrow.Threshold)
+		if !scanner.Scan() {
+			return errWrongShares
+		}
+		share, ok := decodeKey(scanner.Text(), escrowKeyLength+1)
+		if !ok {
+			fmt.Println("Invalid share, please try again.")
+			continue
+		}
+		shares = append(shares, share)
+	}
+	secret, err := crypto.CombineShares(shares)
+	if err != nil {
+		return errWrongShares
+	}
+	key, err := crypto.DeriveKey(secret)
+	if err != nil {
+		return err
+	}
+	defer key.Wipe()
+	if !bytes.Equal(key.Public().Bytes(), format.Escrow.PubKey) {
+		return errWrongShares
+	}
+	u := User{username: username, m: m, enc: enc, kdf: kdf, escrow: format.Escrow}
+	return u.resetPassword(scanner, key, &r, "escrow")
+}
@@ -0,0 +1,266 @@
+package cli
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+var validGroup = regexp.MustCompile(`^[a-z0-9][a-z0-9\-_]{0,62}$`)
+
+// loadGroups unwraps the private keys of the groups the user is a member of.
+// The map is updated in place so that a mounted file system sees the changes.
+func (u *User) loadGroups() error {
+	var members []meta.Member
+	if err := u.m.GetMemberships(u.id, &members); err != nil {
+		return err
+	}
+	if u.groups == nil {
+		u.groups = make(map[uint32]crypto.PrivateKey)
+	}
+	for id, key := range u.groups {
+		key.Wipe()
+		delete(u.groups, id)
+	}
+	for _, mb := range members {
+		var g meta.Group
+		if err := u.m.GetGroupById(mb.Group, &g); err != nil {
+			return err
+		}
+		keyBytes, err := u.enc.Unwrap(u.privateKey, mb.Key, crypto.MemberKeyAD(mb.Group, u.id))
+		if err != nil {
+			return err
+		}
+		privKey, err := crypto.ParsePrivateKey(crypto.KeyType(g.KeyType), keyBytes)
+		if err != nil {
+			return err
+		}
+		u.groups[mb.Group] = privKey
+	}
+	return nil
+}
+
+// userPublicKey returns the public key of a user given its id.
+func (u *User) userPublicKey(userId uint32) (crypto.PublicKey, error) {
+	var username string
+	if err := u.m.GetUserName(userId, &username); err != nil {
+		return nil, err
+	}
+	return u.trustedPublicKey(username)
+}
+
+func (u *User) createGroup(name string) bool {
+	if !validGroup.MatchString(name) {
+		fmt.Println("Invalid group name, only lowercase letters, numbers, - and _ are allowed.")
+		return false
+	}
+	privKey, err := crypto.GenerateKey(crypto.DefaultKeyType)
+	if err != nil {
+		return false
+	}
+	g := meta.Group{Name: name, Owner: u.id, PubKey: privKey.Public().Bytes(), KeyType: uint8(privKey.Type())}
+	privKeyBytes := privKey.Bytes()
+	defer clear(privKeyBytes)
+	err = u.m.CreateGroup(&g, func(id uint32) ([]byte, error) {
+		return u.enc.Wrap(u.privateKey.Public(), privKeyBytes, crypto.MemberKeyAD(id, u.id))
+	})
+	if err != nil {
+		privKey.Wipe()
+		if err == syscall.EEXIST {
+			fmt.Printf("Group %s already exists.\n", name)
+		}
+		return false
+	}
+	u.groups[g.Id] = privKey
+	return true
+}
+
+// group returns the group with the given name and its private key, which the
+// user must hold as a member.
+func (u *User) group(name string) (*meta.Group, crypto.PrivateKey, bool) {
+	var g meta.Group
+	if err := u.m.GetGroup(name, &g); err != nil {
+		fmt.Printf("No such group found: %s\n", name)
+		return nil, nil, false
+	}
+	privKey := u.groups[g.Id]
+	if privKey == nil {
+		fmt.Printf("You are not a member of %s.\n", name)
+		return nil, nil, false
+	}
+	return &g, privKey, true
+}
+
+func (u *User) addMember(name, username string) bool {
+	g, privKey, ok := u.group(name)
+	if !ok {
+		return false
+	}
+	mb := meta.Member{Group: g.Id}
+	if err := u.m.GetUserId(username, &mb.User); err != nil {
+		fmt.Printf("No such user found: %s\n", username)
+		return false
+	}
+	pubKey, err := u.userPublicKey(mb.User)
+	if err != nil {
+		return false
+	}
+	privKeyBytes := privKey.Bytes()
+	defer clear(privKeyBytes)
+	mb.Key, err = u.enc.Wrap(pubKey, privKeyBytes, crypto.MemberKeyAD(g.Id, mb.User))
+	if err != nil {
+		return false
+	}
+	err = u.m.AddMember(u.id, &mb)
+	if err == syscall.EACCES {
+		fmt.Println("Only the owner of the group can change its members.")
+	} else if err == syscall.EEXIST {
+		fmt.Printf("%s is already a member of %s.\n", username, name)
+	}
+	return err == nil
+}
+
+// removeMember removes a user from a group and rotates the key pair of the
+// group, so that the former member cannot unwrap the keys shared later on.
+// The keys of the directories shared with the group are rotated as well, as
+// the former member may have kept them, and wrapped for the new key pair.
+func (u *User) removeMember(name, username string) bool {
+	g, oldKey, ok := u.group(name)
+	if !ok {
+		return false
+	}
+	var userId uint32
+	if err := u.m.GetUserId(username, &userId); err != nil {
+		fmt.Printf("No such user found: %s\n", username)
+		return false
+	}
+	if userId == g.Owner {
+		fmt.Println("The owner of a group cannot be removed from it.")
+		return false
+	}
+	var members []meta.Member
+	if err := u.m.GetMembers(g.Id, &members); err != nil {
+		return false
+	}
+	var shares []meta.Share
+	if err := u.m.GetGroupShares(g.Id, &shares); err != nil {
+		return false
+	}
+
+	// the new key pair is of the default type, which migrates older groups
+	privKey, err := crypto.GenerateKey(crypto.DefaultKeyType)
+	if err != nil {
+		return false
+	}
+	rotated := false
+	defer func() {
+		if !rotated {
+			privKey.Wipe()
+		}
+	}()
+	privKeyBytes := privKey.Bytes()
+	defer clear(privKeyBytes)
+	remaining := make([]meta.Member, 0, len(members))
+	for _, mb := range members {
+		if mb.User == userId {
+			continue
+		}
+		pubKey, err := u.userPublicKey(mb.User)
+		if err != nil {
+			return false
+		}
+		mb.Key, err = u.enc.Wrap(pubKey, privKeyBytes, crypto.MemberKeyAD(g.Id, mb.User))
+		if err != nil {
+			return false
+		}
+		remaining = append(remaining, mb)
+	}
+	if len(remaining) == len(members) {
+		fmt.Printf("%s is not a member of %s.\n", username, name)
+		return false
+	}
+	for i, sh := range shares {
+		ad := crypto.ShareKeyAD(uint64(sh.Inode), 0, g.Id)
+		key, err := u.enc.Unwrap(oldKey, sh.Key, ad)
+		if err != nil {
+			return false
+		}
+		shares[i].Key, err = u.enc.Wrap(privKey.Public(), key, ad)
+		if err != nil {
+			return false
+		}
+	}
+
+	g.PubKey, g.KeyType = privKey.Public().Bytes(), uint8(privKey.Type())
+	err = u.m.RotateGroup(u.id, g, remaining, shares)
+	if err == syscall.EACCES {
+		fmt.Println("Only the owner of the group can change its members.")
+	}
+	if err != nil {
+		return false
+	}
+	u.groups[g.Id], rotated = privKey, true
+	oldKey.Wipe()
+	return u.rotateGroupDirs(shares)
+}
+
+// rotateGroupDirs rotates the keys of the directories shared with a group.
+// The directories of other users can only be rotated by their owners, the
+// user is told to ask them.
+func (u *User) rotateGroupDirs(shares []meta.Share) bool {
+	ok := true
+	rotated := make(map[meta.Ino]bool)
+	for _, sh := range shares {
+		if rotated[sh.Inode] {
+			continue
+		}
+		rotated[sh.Inode] = true
+		err := u.rotateDir(sh.Inode)
+		if err == errNotOwner {
+			var owner string
+			if u.m.GetUserName(sh.Owner, &owner) != nil {
+				owner = "its owner"
+			}
+			fmt.Printf("The keys of directory %d can only be rotated by %s.\n", sh.Inode, owner)
+		} else if err != nil {
+			fmt.Printf("Key rotation of directory %d failed: %s\n", sh.Inode, err)
+		}
+		ok = ok && err == nil
+	}
+	return ok
+}
+
+func (u *User) listGroups() bool {
+	var memberships []meta.Member
+	if err := u.m.GetMemberships(u.id, &memberships); err != nil {
+		return false
+	}
+	if len(memberships) == 0 {
+		fmt.Println("No groups.")
+		return true
+	}
+	for _, ms := range memberships {
+		var g meta.Group
+		var members []meta.Member
+		if err := u.m.GetGroupById(ms.Group, &g); err != nil {
+			return false
+		}
+		if err := u.m.GetMembers(g.Id, &members); err != nil {
+			return false
+		}
+		names := make([]string, 0, len(members))
+		for _, mb := range members {
+			var username string
+			if err := u.m.GetUserName(mb.User, &username); err != nil {
+				return false
+			}
+			names = append(names, username)
+		}
+		fmt.Printf("%-20s %s\n", g.Name, strings.Join(names, ", "))
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+)
+
+func TestRemoveMember(t *testing.T) {
+	v := newTestVolume(t)
+	bob, carol := v.newUser(t, "bob"), v.newUser(t, "carol")
+	alice := v.newUser(t, "alice")
+	if !alice.createGroup("team") || !alice.addMember("team", "bob") || !alice.addMember("team", "carol") {
+		t.Fatal("cannot set the group up")
+	}
+	var g meta.Group
+	if err := v.m.GetGroup("team", &g); err != nil {
+		t.Fatalf("GetGroup: %s", err)
+	}
+	root := newTestTree(t, alice)
+	proj := mkdir(t, root, "proj")
+	data := []byte("team secret")
+	file, _ := create(t, proj, "file", data)
+	share(t, alice, ino(proj), "proj", "@team")
+	oldKey, _ := pathKey(t, alice, ino(proj))
+	oldKey = bytes.Clone(oldKey)
+	var old object.Info
+	if err := v.obj.Stat(uint64(ino(file)), &old); err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+
+	// the key pair of the group bob kept
+	if err := bob.loadGroups(); err != nil {
+		t.Fatalf("loadGroups: %s", err)
+	}
+	kept, err := crypto.ParsePrivateKey(crypto.KeyType(g.KeyType), bytes.Clone(bob.groups[g.Id].Bytes()))
+	if err != nil {
+		t.Fatalf("ParsePrivateKey: %s", err)
+	}
+	defer kept.Wipe()
+	var sh meta.Share
+	if st := v.m.GetShare(context.Background(), bob.id, ino(proj), &sh); st != 0 {
+		t.Fatalf("GetShare: %s", st)
+	}
+	if _, err = bob.unwrapShareKey(sh); err != nil {
+		t.Fatalf("bob cannot unwrap the share as a member: %s", err)
+	}
+
+	if !alice.removeMember("team", "bob") {
+		t.Fatal("removeMember failed")
+	}
+	newKey, _ := pathKey(t, alice, ino(proj))
+	if bytes.Equal(newKey, oldKey) {
+		t.Fatal("the key of the shared directory was kept")
+	}
+	var info object.Info
+	if err = v.obj.Stat(uint64(ino(file)), &info); err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	if info.Version != old.Version+1 || bytes.Equal(info.Key, old.Key) {
+		t.Fatalf("the content was not encrypted again: version %d, was %d", info.Version, old.Version)
+	}
+
+	var shares []meta.Share
+	if err = v.m.GetGroupShares(g.Id, &shares); err != nil || len(shares) != 1 {
+		t.Fatalf("GetGroupShares = %d shares, %v", len(shares), err)
+	}
+	if err = carol.loadGroups(); err != nil {
+		t.Fatalf("loadGroups: %s", err)
+	}
+	if key, err := carol.unwrapShareKey(shares[0]); err != nil || !bytes.Equal(key, newKey) {
+		t.Fatalf("carol cannot unwrap the new key: %v", err)
+	}
+	if err = bob.loadGroups(); err != nil {
+		t.Fatalf("loadGroups: %s", err)
+	}
+	if _, ok := bob.groups[g.Id]; ok {
+		t.Fatal("bob still holds the key pair of the group")
+	}
+	ad := crypto.ShareKeyAD(uint64(ino(proj)), 0, g.Id)
+	if _, err = bob.enc.Unwrap(kept, shares[0].Key, ad); err == nil {
+		t.Fatal("the former key pair of the group still unwraps the share")
+	}
+}
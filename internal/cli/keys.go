@@ -0,0 +1,301 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+var (
+	errUnsigned    = errors.New("the user record is not signed")
+	errBadSign     = errors.New("the signature of the user record is invalid")
+	errKeyMismatch = errors.New("the public key does not match the pinned fingerprint")
+)
+
+// knownKeys pins the fingerprints of the public keys of the users a client
+// shared with, the first time it does, like the known_hosts of OpenSSH. Keys
+// are pinned per volume, as user names are only unique within a volume.
+type knownKeys struct {
+	path   string
+	volume string
+}
+
+func newKnownKeys(volume string) *knownKeys {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return &knownKeys{path: filepath.Join(dir, "netsecfs", "known_keys"), volume: volume}
+}
+
+// lookup returns the fingerprint pinned for a user, if any.
+func (k *knownKeys) lookup(username string) (string, bool, error) {
+	f, err := os.Open(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == k.volume && fields[1] == username {
+			return fields[2], true, nil
+		}
+	}
+	return "", false, scanner.Err()
+}
+
+// pin records the fingerprint of a user, replacing the one pinned before.
+func (k *knownKeys) pin(username, fingerprint string) error {
+	var lines []string
+	data, err := os.ReadFile(k.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || (len(fields) == 3 && fields[0] == k.volume && fields[1] == username) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, strings.Join([]string{k.volume, username, fingerprint}, " "))
+	if err = os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(k.path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// userRecord is the content of a user record that its owner signs, binding
+// the name of the user to its public key.
+func userRecord(username string, pubKey []byte) []byte {
+	record := []byte("netsecfs user\x00" + username + "\x00")
+	return append(record, pubKey...)
+}
+
+// signRecord signs the record of the logged in user, so that others can make
+// sure its public key has not been replaced in the database.
+func (u *User) signRecord(pubKey []byte) error {
+	sign, err := u.enc.Sign(u.privateKey, userRecord(u.username, pubKey))
+	if err != nil {
+		return err
+	}
+	return u.m.SetUserSignature(u.username, sign)
+}
+
+// checkRecord makes sure the public key stored for the logged in user is the
+// one of its private key and that its record is signed.
+func (u *User) checkRecord() error {
+	var keyType uint8
+	var pubKey, sign []byte
+	if err := u.m.GetUserPublicKey(u.username, &keyType, &pubKey); err != nil {
+		return err
+	}
+	own := u.privateKey.Public().Bytes()
+	ownType := uint8(u.privateKey.Type())
+	if string(pubKey) != string(own) || keyType != ownType {
+		fmt.Println("WARNING: your public key has been replaced in the database, restoring it.")
+		if err := u.m.SetUserPublicKey(u.username, ownType, own); err != nil {
+			return err
+		}
+		sign = nil
+	} else if err := u.m.GetUserSignature(u.username, &sign); err != nil {
+		return err
+	}
+	if u.enc.Verify(u.privateKey.Public(), userRecord(u.username, own), sign) == nil {
+		return nil
+	}
+	return u.signRecord(own)
+}
+
+// verifiedPublicKey returns the public key of a user after checking the
+// signature of its record. The fingerprint of the key is also returned.
+func (u *User) verifiedPublicKey(username string) (crypto.PublicKey, string, error) {
+	var keyType uint8
+	var pubKeyBytes, sign []byte
+	if err := u.m.GetUserPublicKey(username, &keyType, &pubKeyBytes); err != nil {
+		return nil, "", err
+	}
+	if err := u.m.GetUserSignature(username, &sign); err != nil {
+		return nil, "", err
+	}
+	pubKey, err := crypto.ParsePublicKey(crypto.KeyType(keyType), pubKeyBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(sign) == 0 {
+		return nil, "", errUnsigned
+	}
+	if u.enc.Verify(pubKey, userRecord(username, pubKeyBytes), sign) != nil {
+		return nil, "", errBadSign
+	}
+	return pubKey, crypto.Fingerprint(pubKeyBytes), nil
+}
+
+// trustedPublicKey returns the public key of a user to wrap keys for. The
+// fingerprint of the key is pinned the first time, and the key is refused if
+// it changed since.
+func (u *User) trustedPublicKey(username string) (crypto.PublicKey, error) {
+	pubKey, fingerprint, err := u.verifiedPublicKey(username)
+	if err == errUnsigned {
+		fmt.Printf("The key of %s is not signed yet, %s has to log in once first.\n", username, username)
+		return nil, err
+	} else if err == errBadSign {
+		fmt.Printf("WARNING: the record of %s has an invalid signature, its key may have been replaced.\n", username)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	if u.known == nil || username == u.username {
+		return pubKey, nil
+	}
+	pinned, ok, err := u.known.lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		fmt.Printf("Pinning the key of %s on first use: %s\n", username, fingerprint)
+		return pubKey, u.known.pin(username, fingerprint)
+	}
+	if pinned != fingerprint {
+		fmt.Printf("WARNING: the key of %s changed!\nPinned:  %s\nCurrent: %s\n", username, pinned, fingerprint)
+		fmt.Printf("If %s confirms the new fingerprint, run: trust %s\n", username, username)
+		return nil, errKeyMismatch
+	}
+	return pubKey, nil
+}
+
+// trust pins the current key of a user, after a change it has confirmed.
+func (u *User) trust(username string) bool {
+	_, fingerprint, err := u.verifiedPublicKey(username)
+	if err != nil {
+		fmt.Printf("Cannot trust the key of %s: %s\n", username, err)
+		return false
+	}
+	if err = u.known.pin(username, fingerprint); err != nil {
+		return false
+	}
+	fmt.Printf("Pinned the key of %s: %s\n", username, fingerprint)
+	return true
+}
+
+// Fingerprint prints the fingerprint of the key of a user, whether its record
+// is properly signed and the fingerprint pinned on this client, if any.
+func Fingerprint(addr, username string) error {
+	m := meta.RegisterMeta(addr)
+	format, err := m.Load()
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+	u := User{m: m, enc: &crypto.CryptoHelper{}, known: newKnownKeys(format.UUID)}
+	var keyType uint8
+	var pubKey []byte
+	if err = m.GetUserPublicKey(username, &keyType, &pubKey); err != nil {
+		return err
+	}
+	fingerprint := crypto.Fingerprint(pubKey)
+	switch _, _, err = u.verifiedPublicKey(username); err {
+	case nil:
+		fmt.Printf("%s %s %s (signed)\n", username, crypto.KeyType(keyType), fingerprint)
+	case errUnsigned, errBadSign:
+		fmt.Printf("%s %s %s (%s)\n", username, crypto.KeyType(keyType), fingerprint, err)
+	default:
+		return err
+	}
+	if pinned, ok, err := u.known.lookup(username); err != nil {
+		return err
+	} else if ok && pinned != fingerprint {
+		fmt.Printf("WARNING: the fingerprint pinned on this client differs: %s\n", pinned)
+	} else if ok {
+		fmt.Println("The fingerprint matches the one pinned on this client.")
+	}
+	return nil
+}
+
+// migrateKey replaces the key pair of the user by one of the default type.
+// The keys of the directories shared with the user and of its groups are
+// wrapped again for the new public key.
+func (u *User) migrateKey() bool {
+	if u.privateKey.Type() == crypto.DefaultKeyType {
+		fmt.Printf("Your key pair is already of type %s.\n", crypto.DefaultKeyType)
+		return true
+	}
+	privKey, err := crypto.GenerateKey(crypto.DefaultKeyType)
+	if err != nil {
+		return false
+	}
+	migrated := false
+	defer func() {
+		if !migrated {
+			privKey.Wipe()
+		}
+	}()
+	pubKey := privKey.Public()
+
+	var shares []meta.Share
+	if err = u.m.GetSharesIn(u.id, &shares); err != nil {
+		return false
+	}
+	direct := shares[:0]
+	for _, sh := range shares {
+		if sh.Group != 0 {
+			continue
+		}
+		ad := crypto.ShareKeyAD(uint64(sh.Inode), u.id, 0)
+		key, err := u.enc.Unwrap(u.privateKey, sh.Key, ad)
+		if err != nil {
+			return false
+		}
+		if sh.Key, err = u.enc.Wrap(pubKey, key, ad); err != nil {
+			return false
+		}
+		direct = append(direct, sh)
+	}
+	var members []meta.Member
+	if err = u.m.GetMemberships(u.id, &members); err != nil {
+		return false
+	}
+	for i, mb := range members {
+		groupKey := u.groups[mb.Group].Bytes()
+		members[i].Key, err = u.enc.Wrap(pubKey, groupKey, crypto.MemberKeyAD(mb.Group, u.id))
+		clear(groupKey)
+		if err != nil {
+			return false
+		}
+	}
+
+	sign, err := u.enc.Sign(privKey, userRecord(u.username, pubKey.Bytes()))
+	if err != nil {
+		return false
+	}
+	privKeyBytes := privKey.Bytes()
+	defer clear(privKeyBytes)
+	privCipher, err := u.enc.Encrypt(u.masterKey.Bytes(), privKeyBytes, crypto.UserKeyAD("private key", u.username))
+	if err != nil {
+		return false
+	}
+	err = u.m.MigrateUserKey(u.id, uint8(privKey.Type()), privCipher, pubKey.Bytes(), sign, direct, members)
+	if err != nil {
+		return false
+	}
+	u.privateKey.Wipe()
+	u.privateKey, migrated = privKey, true
+	if err = u.updateRecovery(); err != nil {
+		fmt.Println("Your recovery key could not be updated, create a new one with `recovery`:", err)
+	}
+	if err = u.updateEscrow(true); err != nil {
+		fmt.Println("Your keys could not be escrowed, they will be on your next login:", err)
+	}
+	fmt.Printf("Your key pair is now of type %s, fingerprint %s\n", privKey.Type(), crypto.Fingerprint(pubKey.Bytes()))
+	fmt.Println("Users who pinned your previous key have to run `trust` after checking the new fingerprint.")
+	return true
+}
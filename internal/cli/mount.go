@@ -7,6 +7,8 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/bastienvty/netsecfs/internal/compress"
+	"github.com/bastienvty/netsecfs/internal/crypto"
 	"github.com/bastienvty/netsecfs/internal/db/meta"
 	"github.com/bastienvty/netsecfs/internal/db/object"
 	"github.com/bastienvty/netsecfs/internal/fs"
@@ -14,7 +16,42 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
-func mount(user User, blob object.ObjectStorage, mp string) (*fuse.Server, error) {
+// mountOptions returns the settings of the volume the file system needs,
+// along the ones of the mount given in tuning.
+func mountOptions(format *meta.Format, tuning fs.Options) (fs.Options, error) {
+	opts := tuning
+	opts.PadSizes, opts.EncryptAttrs, opts.Dedup = format.PadSizes, format.EncryptAttrs, format.Dedup
+	if format.Compression != "" {
+		algo, err := compress.Parse(format.Compression)
+		if err != nil {
+			return opts, err
+		}
+		opts.Compress, opts.Compression = true, algo
+	}
+	return opts, nil
+}
+
+// printStats prints how well the chunks compressed since the mount and how
+// often they were found in the cache.
+func printStats(format *meta.Format, stats *fs.Stats) {
+	if format.Compression == "" {
+		fmt.Println("The volume does not compress its chunks.")
+	} else {
+		fmt.Println("Compression:", format.Compression)
+		fmt.Printf("Written: %d bytes stored in %d, ratio %s\n", stats.Written.Load(), stats.WrittenStored.Load(), ratio(stats.Written.Load(), stats.WrittenStored.Load()))
+		fmt.Printf("Read: %d bytes stored in %d, ratio %s\n", stats.Read.Load(), stats.ReadStored.Load(), ratio(stats.Read.Load(), stats.ReadStored.Load()))
+	}
+	fmt.Printf("Cache: %d hits, %d misses\n", stats.CacheHits.Load(), stats.CacheMisses.Load())
+}
+
+func ratio(plain, stored int64) string {
+	if stored == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", float64(plain)/float64(stored))
+}
+
+func mount(user User, blob object.ObjectStorage, mp string, opts fs.Options) (*fuse.Server, *fs.Node, error) {
 	var fuseOpts *gofs.Options
 	sec := time.Second
 	fuseOpts = &gofs.Options{
@@ -35,11 +72,11 @@ func mount(user User, blob object.ObjectStorage, mp string) (*fuse.Server, error
 	// fuseOpts.MountOptions.Options = append(fuseOpts.MountOptions.Options, "noapplexattr", "noappledouble") // macOS (optional)
 
 	syscall.Umask(0000)
-	root := fs.NewRootNode(user.m, blob, user.privateKey, user.rootKey, user.username)
+	root := fs.NewRootNode(user.m, blob, user.enc, user.privateKey, user.groups, crypto.NewKeyring(), user.rootKey, user.username, opts)
 	server, err := gofs.Mount(mp, root, fuseOpts)
 	if err != nil {
 		fmt.Println("Mount fail: ", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	fmt.Println("Unmount to stop the server.")
@@ -50,5 +87,5 @@ func mount(user User, blob object.ObjectStorage, mp string) (*fuse.Server, error
 		<-c
 		server.Unmount()
 	}()
-	return server, nil
+	return server, root, nil
 }
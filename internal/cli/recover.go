@@ -0,0 +1,211 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+// recoveryKeyLength is the number of random bytes of a recovery key, printed
+// as 32 base32 characters.
+const recoveryKeyLength = 20
+
+var (
+	errNoRecovery    = errors.New("no recovery key is set for this user")
+	errWrongRecovery = errors.New("wrong recovery key")
+)
+
+// encodeKey prints a secret in base32, in groups of 4 characters.
+func encodeKey(secret []byte) string {
+	s := base32.StdEncoding.EncodeToString(secret)
+	groups := make([]string, 0, len(s)/4)
+	for i := 0; i < len(s); i += 4 {
+		groups = append(groups, s[i:min(i+4, len(s))])
+	}
+	return strings.Join(groups, "-")
+}
+
+// decodeKey parses a secret of the given length printed by encodeKey, with
+// or without its dashes and in any case.
+func decodeKey(s string, length int) ([]byte, bool) {
+	s = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+	secret, err := base32.StdEncoding.DecodeString(s)
+	return secret, err == nil && len(secret) == length
+}
+
+// createRecovery generates a recovery key for the logged in user and prints it
+// once. The root key and the private key of the user are wrapped for the key
+// pair derived from it, so that a new password can be set without the old one.
+func (u *User) createRecovery() bool {
+	secret := make([]byte, recoveryKeyLength)
+	if _, err := rand.Read(secret); err != nil {
+		return false
+	}
+	recKey, err := crypto.DeriveKey(secret)
+	if err != nil {
+		return false
+	}
+	defer recKey.Wipe()
+	r, err := u.wrapFor(recKey.Public(), "recovery")
+	if err != nil {
+		return false
+	}
+	if err = u.m.SetRecovery(u.username, r); err != nil {
+		return false
+	}
+	fmt.Println("Your recovery key, write it down as it will not be shown again:")
+	fmt.Println(encodeKey(secret))
+	return true
+}
+
+// wrapFor wraps the keys of the user for the public key of its recovery key or
+// of the escrow key, depending on what.
+func (u *User) wrapFor(pubKey crypto.PublicKey, what string) (*meta.Recovery, error) {
+	rootKey, err := u.enc.Wrap(pubKey, u.rootKey.Bytes(), u.rootKeyAD(what, u.sealed))
+	if err != nil {
+		return nil, err
+	}
+	privKeyBytes := u.privateKey.Bytes()
+	defer clear(privKeyBytes)
+	privKey, err := u.enc.Wrap(pubKey, privKeyBytes, crypto.UserKeyAD(what+" private key", u.username))
+	if err != nil {
+		return nil, err
+	}
+	return &meta.Recovery{PubKey: pubKey.Bytes(), RootKey: rootKey, PrivKey: privKey}, nil
+}
+
+// updateRecovery wraps the keys of the user again for its recovery key, if it
+// has one, after its key pair changed.
+func (u *User) updateRecovery() error {
+	var r meta.Recovery
+	if err := u.m.GetRecovery(u.username, &r); err != nil {
+		return err
+	}
+	if len(r.PubKey) == 0 {
+		return nil
+	}
+	pubKey, err := crypto.ParsePublicKey(crypto.KeyX25519, r.PubKey)
+	if err != nil {
+		return err
+	}
+	wrapped, err := u.wrapFor(pubKey, "recovery")
+	if err != nil {
+		return err
+	}
+	return u.m.SetRecovery(u.username, wrapped)
+}
+
+// loadVolume opens the meta database of a volume for the commands that do
+// not mount it.
+func loadVolume(addr string) (meta.Meta, *meta.Format, *crypto.CryptoHelper, meta.Kdf, error) {
+	kdf := DefaultKdf()
+	m := meta.RegisterMeta(addr)
+	format, err := m.Load()
+	if err != nil {
+		return nil, nil, nil, kdf, err
+	}
+	algo, err := crypto.ParseCipher(format.Cipher)
+	if err != nil {
+		m.Shutdown()
+		return nil, nil, nil, kdf, err
+	}
+	if format.Kdf != nil {
+		kdf = *format.Kdf
+	}
+	return m, format, &crypto.CryptoHelper{Cipher: algo}, kdf, nil
+}
+
+// Recover sets a new password for a user who forgot it, given its recovery
+// key. Both are read from the standard input.
+func Recover(addr, username string) error {
+	m, _, enc, kdf, err := loadVolume(addr)
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+	var r meta.Recovery
+	if err = m.GetRecovery(username, &r); err == syscall.ENOENT {
+		return fmt.Errorf("no such user: %s", username)
+	} else if err != nil {
+		return err
+	}
+	if len(r.PubKey) == 0 {
+		return errNoRecovery
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Print("Recovery key: ")
+	if !scanner.Scan() {
+		return errWrongRecovery
+	}
+	secret, ok := decodeKey(scanner.Text(), recoveryKeyLength)
+	if !ok {
+		return errWrongRecovery
+	}
+	recKey, err := crypto.DeriveKey(secret)
+	if err != nil {
+		return err
+	}
+	defer recKey.Wipe()
+	if !bytes.Equal(recKey.Public().Bytes(), r.PubKey) {
+		return errWrongRecovery
+	}
+	u := User{username: username, m: m, enc: enc, kdf: kdf}
+	return u.resetPassword(scanner, recKey, &r, "recovery")
+}
+
+// resetPassword unwraps the keys of the user from r with key and sets the
+// new password read from scanner.
+func (u *User) resetPassword(scanner *bufio.Scanner, key crypto.PrivateKey, r *meta.Recovery, what string) error {
+	fmt.Print("New password: ")
+	if !scanner.Scan() || scanner.Text() == "" {
+		return errors.New("the password is empty")
+	}
+	password := scanner.Text()
+
+	rootKey, err := u.openRootKey(what, func(ad []byte) ([]byte, error) {
+		return u.enc.Unwrap(key, r.RootKey, ad)
+	})
+	if err != nil {
+		return err
+	}
+	defer u.wipe()
+	if u.rootKey, err = u.lock(rootKey); err != nil {
+		return err
+	}
+	privKeyBytes, err := u.enc.Unwrap(key, r.PrivKey, crypto.UserKeyAD(what+" private key", u.username))
+	if err != nil {
+		return err
+	}
+	var keyType uint8
+	var pubKey []byte
+	if err = u.m.GetUserPublicKey(u.username, &keyType, &pubKey); err != nil {
+		return err
+	}
+	if u.privateKey, err = crypto.ParsePrivateKey(crypto.KeyType(keyType), privKeyBytes); err != nil {
+		return err
+	}
+	// the key file may be lost as well, it is dropped along the password
+	var salt []byte
+	var kdf meta.Kdf
+	if err = u.m.GetSalt(u.username, &salt, &kdf); err != nil {
+		return err
+	}
+	if !u.changePassword(password) {
+		return errors.New("the password could not be changed")
+	}
+	fmt.Printf("The password of %s has been changed.\n", u.username)
+	if kdf.Keyfile {
+		fmt.Println("The key file is no longer needed, set a new one with passwd --keyfile.")
+	}
+	return nil
+}
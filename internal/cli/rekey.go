@@ -0,0 +1,346 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/bastienvty/netsecfs/internal/fs"
+)
+
+var errRekeyShared = errors.New("only the directories of the user can be rekeyed")
+
+// Rekey replaces the keys of a user after a suspected compromise: its root
+// key and the keys of every node below it, or only below path when given.
+// Names are encrypted again, children keys are wrapped by the new keys, the
+// content of files is encrypted again under fresh content keys and shares are
+// wrapped for their recipients. The rekey goes one directory at a time and
+// resumes where it stopped if interrupted. The password of the user is read
+// from the standard input.
+func Rekey(addr, username, path, keyfile string) error {
+	m, format, enc, kdf, err := loadVolume(addr)
+	if err != nil {
+		return err
+	}
+	defer m.Shutdown()
+	blob, err := object.CreateStorage(format.Storage)
+	if err != nil {
+		return err
+	}
+	defer object.Shutdown(blob)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Print("Password: ")
+	if !scanner.Scan() {
+		return errors.New("the password is empty")
+	}
+	u := User{
+		username: username,
+		password: scanner.Text(),
+		m:        m,
+		obj:      blob,
+		enc:      enc,
+		known:    newKnownKeys(format.UUID),
+		kdf:      kdf,
+		escrow:   format.Escrow,
+		format:   format,
+	}
+	if keyfile != "" {
+		if u.keyfile, err = readKeyfile(keyfile); err != nil {
+			return err
+		}
+	}
+	if !u.verifyUser() {
+		return errors.New("user verification failed")
+	}
+	defer u.wipe()
+
+	var pending []meta.Rekey
+	if err = m.GetRekeys(u.id, &pending); err != nil {
+		return err
+	}
+	switch {
+	case len(pending) > 0:
+		fmt.Println("Resuming the interrupted rekey.")
+	case path == "":
+		err = u.startRekey()
+	default:
+		err = u.startRekeyPath(path)
+	}
+	if err != nil {
+		return err
+	}
+	root, done, err := u.contentRoot()
+	if err != nil {
+		return err
+	}
+	defer done()
+	n, err := u.finishRekey(root)
+	if err != nil {
+		return fmt.Errorf("%s, run rekey again to resume after %d nodes", err, n)
+	}
+	// the root key may have changed
+	if err = u.updateRecovery(); err != nil {
+		fmt.Println("Your recovery key could not be updated, create a new one with `recovery`:", err)
+	}
+	if err = u.updateEscrow(true); err != nil {
+		fmt.Println("Your keys could not be escrowed, they will be on your next login:", err)
+	}
+	fmt.Printf("%d nodes rekeyed.\n", n)
+	return nil
+}
+
+// startRekey replaces the root key of the user, leaving the root pending.
+func (u *User) startRekey() error {
+	rootKey := make([]byte, len(u.rootKey.Bytes()))
+	if _, err := rand.Read(rootKey); err != nil {
+		return err
+	}
+	rootCipher, err := u.enc.Encrypt(u.masterKey.Bytes(), rootKey, u.rootKeyAD("", u.sealed))
+	if err != nil {
+		return err
+	}
+	oldKey, err := u.enc.Encrypt(rootKey, u.rootKey.Bytes(), crypto.RekeyAD(uint64(meta.RootInode)))
+	if err != nil {
+		return err
+	}
+	locked, err := u.lock(rootKey)
+	if err != nil {
+		return err
+	}
+	step := &meta.RekeyStep{RootKey: rootCipher, Pending: []meta.Rekey{{Inode: meta.RootInode, OldKey: oldKey}}}
+	if err = u.m.Rekey(u.id, step, nil); err != nil {
+		locked.Wipe()
+		return err
+	}
+	u.rootKey.Wipe()
+	u.rootKey = locked
+	return nil
+}
+
+// startRekeyPath replaces the key of the node at path, relative to the root
+// of the user, leaving it pending.
+func (u *User) startRekeyPath(path string) error {
+	parent, parentKey := meta.RootInode, u.rootKey.Bytes()
+	keys := map[meta.Ino][]byte{parent: parentKey}
+	var entry *meta.Entry
+	var key, name []byte
+	for _, part := range splitPath(path) {
+		if entry != nil {
+			if entry.Attr.Typ != meta.TypeDirectory {
+				return syscall.ENOTDIR
+			}
+			parent, parentKey = entry.Inode, key
+			keys[parent] = key
+		}
+		var entries []*meta.Entry
+		if st := u.m.Readdir(context.Background(), parent, u.id, &entries); st != 0 {
+			return st
+		}
+		entry = nil
+		for _, e := range entries {
+			if e.Inode == meta.SharedInode {
+				if part == "shared" {
+					return errRekeyShared
+				}
+				continue
+			}
+			k, err := u.enc.Decrypt(parentKey, e.Key, crypto.KeyAD(uint64(e.Inode)))
+			if err != nil {
+				return err
+			}
+			n, err := crypto.UnpadName(u.enc.Decrypt(k, e.Name, crypto.NameAD(uint64(parent), uint64(e.Inode))))
+			if err != nil {
+				return err
+			}
+			if string(n) == part {
+				entry, key, name = e, k, n
+				break
+			}
+		}
+		if entry == nil {
+			return syscall.ENOENT
+		}
+	}
+	if entry == nil {
+		return u.startRekey()
+	}
+	step := &meta.RekeyStep{Sealed: parent}
+	if _, err := u.rekeyEntry(step, parent, entry.Inode, entry.Attr, name, key, parentKey); err != nil {
+		return err
+	}
+	return u.m.Rekey(u.id, step, sealer(keys))
+}
+
+// rekeyEntry adds to step a new key for an entry, its name and attributes
+// encrypted again, its shares wrapped again and its old key to finish it
+// later. The new key is returned.
+func (u *User) rekeyEntry(step *meta.RekeyStep, parent, inode meta.Ino, attr *meta.Attr, name, key, parentKey []byte) ([]byte, error) {
+	newKey := make([]byte, len(key))
+	if _, err := rand.Read(newKey); err != nil {
+		return nil, err
+	}
+	nameCipher, err := u.enc.Encrypt(newKey, crypto.PadName(name), crypto.NameAD(uint64(parent), uint64(inode)))
+	if err != nil {
+		return nil, err
+	}
+	keyCipher, err := u.enc.Encrypt(parentKey, newKey, crypto.KeyAD(uint64(inode)))
+	if err != nil {
+		return nil, err
+	}
+	oldKey, err := u.enc.Encrypt(newKey, key, crypto.RekeyAD(uint64(inode)))
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := u.resealAttr(inode, attr, key, newKey)
+	if err != nil {
+		return nil, err
+	}
+	step.Entries = append(step.Entries, meta.KeyUpdate{Inode: inode, Name: nameCipher, Key: keyCipher, Attrs: attrs})
+	step.Pending = append(step.Pending, meta.Rekey{Inode: inode, OldKey: oldKey})
+	if attr.Typ == meta.TypeDirectory {
+		shares, err := u.rewrapShares(inode, name, newKey)
+		if err != nil {
+			return nil, err
+		}
+		step.Shares = append(step.Shares, shares...)
+	}
+	return newKey, nil
+}
+
+// finishRekey rekeys the children and the content of the pending nodes until
+// none is left and returns how many were done. The content is rekeyed through
+// root, whose nodes take the new keys of the children when mounted.
+func (u *User) finishRekey(root *fs.Node) (int, error) {
+	var n int
+	for {
+		var pending []meta.Rekey
+		if err := u.m.GetRekeys(u.id, &pending); err != nil {
+			return n, err
+		}
+		if len(pending) == 0 {
+			return n, nil
+		}
+		for _, r := range pending {
+			if err := u.rekeyNode(root, r); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+}
+
+// maxListChanges bounds the reads of a pending directory whose list keeps
+// changing before its children are rekeyed, as when other clients write in it
+// without a pause.
+const maxListChanges = 10
+
+// rekeyNode wraps the children keys of a pending directory by its new key, or
+// encrypts the content of a pending file again, and marks it done.
+func (u *User) rekeyNode(root *fs.Node, r meta.Rekey) error {
+	done := &meta.RekeyStep{Done: r.Inode}
+	key := u.rootKey.Bytes()
+	keys := map[meta.Ino][]byte{meta.RootInode: key}
+	typ := uint8(meta.TypeDirectory)
+	if r.Inode != meta.RootInode {
+		var entries []*meta.Entry
+		err := u.m.GetPath(r.Inode, &entries)
+		if errors.Is(err, syscall.ENOENT) {
+			return u.m.Rekey(u.id, done, nil) // removed since
+		} else if err != nil {
+			return err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			key, err = u.enc.Decrypt(key, entries[i].Key, crypto.KeyAD(uint64(entries[i].Inode)))
+			if err != nil {
+				return err
+			}
+			keys[entries[i].Inode] = key
+		}
+		typ = entries[0].Attr.Typ
+	}
+	oldKey, err := u.enc.Decrypt(key, r.OldKey, crypto.RekeyAD(uint64(r.Inode)))
+	if err != nil {
+		return err
+	}
+
+	if typ == meta.TypeFile {
+		if err = root.RekeyContent(r.Inode, oldKey, key, sealer(keys)); err != nil {
+			return err
+		}
+		return u.m.Rekey(u.id, done, nil)
+	}
+	for try := 1; ; try++ {
+		err = u.rekeyChildren(root, r.Inode, oldKey, key, keys)
+		if err != syscall.EAGAIN || try == maxListChanges {
+			return err
+		}
+	}
+}
+
+// rekeyChildren gives new keys to the children of a pending directory and
+// marks it done, once its list is sealed with its new key. It fails with
+// syscall.EAGAIN when another client changed the list since it was read.
+func (u *User) rekeyChildren(root *fs.Node, inode meta.Ino, oldKey, key []byte, keys map[meta.Ino][]byte) error {
+	var entries []*meta.Entry
+	var mac []byte
+	if st := u.m.ReadDirMac(context.Background(), inode, u.id, &entries, &mac); st != 0 {
+		return st
+	}
+	step := &meta.RekeyStep{Done: inode, Sealed: inode, Listed: mac}
+	newKeys := make(map[meta.Ino][]byte, len(entries))
+	for _, e := range entries {
+		if e.Inode == meta.SharedInode {
+			continue
+		}
+		childKey, err := u.enc.Decrypt(oldKey, e.Key, crypto.KeyAD(uint64(e.Inode)))
+		if err != nil {
+			return err
+		}
+		childName, err := crypto.UnpadName(u.enc.Decrypt(childKey, e.Name, crypto.NameAD(uint64(inode), uint64(e.Inode))))
+		if err != nil {
+			return err
+		}
+		if newKeys[e.Inode], err = u.rekeyEntry(step, inode, e.Inode, e.Attr, childName, childKey, key); err != nil {
+			return err
+		}
+	}
+	if err := u.m.Rekey(u.id, step, sealer(keys)); err != nil {
+		return err
+	}
+	root.UpdateKeys(newKeys)
+	return nil
+}
+
+// contentRoot returns the root the content of files is rekeyed through until
+// done is called: the one of the mount, whose operations wait meanwhile, or
+// one opened for the purpose otherwise.
+func (u *User) contentRoot() (root *fs.Node, done func(), err error) {
+	if u.root != nil {
+		return u.root, u.root.PauseKeys(), nil
+	}
+	opts, err := mountOptions(u.format, fs.Options{})
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.Sealed = u.sealed
+	root = fs.NewRootNode(u.m, u.obj, u.enc, u.privateKey, u.groups, crypto.NewKeyring(), u.rootKey, u.username, opts)
+	if root == nil {
+		return nil, nil, errors.New("cannot open the tree of the user")
+	}
+	return root, root.WipeKeys, nil
+}
+
+// rekeyPending tells whether an interrupted rekey of the user has to be finished.
+func (u *User) rekeyPending() (bool, error) {
+	var pending []meta.Rekey
+	err := u.m.GetRekeys(u.id, &pending)
+	return len(pending) > 0, err
+}
@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+)
+
+func TestRekeyResume(t *testing.T) {
+	v := newTestVolume(t)
+	alice := v.newUser(t, "alice")
+	root := newTestTree(t, alice)
+	proj := mkdir(t, root, "proj")
+	sub := mkdir(t, proj, "sub")
+	data := bytes.Repeat([]byte("k"), object.ChunkSize+10)
+	file, _ := create(t, sub, "file", data)
+	var old object.Info
+	if err := v.obj.Stat(uint64(ino(file)), &old); err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	oldRoot := bytes.Clone(alice.rootKey.Bytes())
+
+	// interrupted once the root key and the children of the root are replaced
+	alice.m = &failMeta{Meta: v.m, steps: 2}
+	if err := alice.startRekey(); err != nil {
+		t.Fatalf("startRekey: %s", err)
+	}
+	tree, done, err := alice.contentRoot()
+	if err != nil {
+		t.Fatalf("contentRoot: %s", err)
+	}
+	n, err := alice.finishRekey(tree)
+	done()
+	if err == nil {
+		t.Fatal("finishRekey did not fail")
+	}
+	alice.m = v.m
+	if rekeys := pending(t, alice); n != 1 || len(rekeys) != 1 || rekeys[0].Inode != ino(proj) {
+		t.Fatalf("%d nodes left pending after %d rekeyed, want proj after the root", len(rekeys), n)
+	}
+
+	if tree, done, err = alice.contentRoot(); err != nil {
+		t.Fatalf("contentRoot: %s", err)
+	}
+	_, err = alice.finishRekey(tree)
+	done()
+	if err != nil {
+		t.Fatalf("finishRekey: %s", err)
+	}
+	if rekeys := pending(t, alice); len(rekeys) != 0 {
+		t.Fatalf("%d nodes left pending", len(rekeys))
+	}
+	if bytes.Equal(alice.rootKey.Bytes(), oldRoot) {
+		t.Fatal("the root key was kept")
+	}
+	var info object.Info
+	if err = v.obj.Stat(uint64(ino(file)), &info); err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	if info.Version != old.Version+1 || bytes.Equal(info.Key, old.Key) {
+		t.Fatalf("the content was not encrypted again: version %d, was %d", info.Version, old.Version)
+	}
+
+	// the next login opens the new root key
+	again := &User{username: "alice", password: "password", m: v.m, obj: v.obj, enc: &crypto.CryptoHelper{}, kdf: alice.kdf, format: v.format}
+	if !again.verifyUser() {
+		t.Fatal("verifyUser failed")
+	}
+	defer again.wipe()
+	if !bytes.Equal(again.rootKey.Bytes(), alice.rootKey.Bytes()) {
+		t.Fatal("the login does not open the new root key")
+	}
+	if got := readPath(t, again, len(data)+10, "proj", "sub", "file"); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes once rekeyed, want the %d written", len(got), len(data))
+	}
+}
@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"errors"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+var errNotOwner = errors.New("only the owner of a directory can rotate its keys")
+
+// rotateDir replaces the key of a directory and of everything below it with
+// fresh ones, so that a former recipient cannot use the keys it may have kept.
+// It rekeys the directory as Rekey does: names are encrypted again, children
+// keys are wrapped by the new keys, the content of files is encrypted again
+// under fresh content keys and the shares still in place are wrapped for
+// their recipients. Each directory is rekeyed in a single transaction, and a
+// rotation interrupted is finished by the next one. The operations of the
+// mount wait until the rotation is done.
+func (u *User) rotateDir(inode meta.Ino) error {
+	root, done, err := u.contentRoot()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if _, err = u.finishRekey(root); err != nil {
+		return err
+	}
+	var entries []*meta.Entry
+	if err = u.m.GetPath(inode, &entries); err != nil {
+		return err
+	}
+	parentKey := u.rootKey.Bytes()
+	// the lists of the ancestors chain the MACs below them
+	dirs := map[meta.Ino][]byte{meta.RootInode: parentKey}
+	for i := len(entries) - 1; i > 0; i-- {
+		parentKey, err = u.enc.Decrypt(parentKey, entries[i].Key, crypto.KeyAD(uint64(entries[i].Inode)))
+		if err != nil {
+			return errNotOwner
+		}
+		dirs[entries[i].Inode] = parentKey
+	}
+	key, err := u.enc.Decrypt(parentKey, entries[0].Key, crypto.KeyAD(uint64(inode)))
+	if err != nil {
+		return errNotOwner
+	}
+	parent := entries[0].Attr.Parent
+	name, err := crypto.UnpadName(u.enc.Decrypt(key, entries[0].Name, crypto.NameAD(uint64(parent), uint64(inode))))
+	if err != nil {
+		return err
+	}
+
+	step := &meta.RekeyStep{Sealed: parent}
+	newKey, err := u.rekeyEntry(step, parent, inode, entries[0].Attr, name, key, parentKey)
+	if err != nil {
+		return err
+	}
+	if err = u.m.Rekey(u.id, step, sealer(dirs)); err != nil {
+		return err
+	}
+	root.UpdateKeys(map[meta.Ino][]byte{inode: newKey})
+	_, err = u.finishRekey(root)
+	return err
+}
+
+// resealAttr encrypts the attributes of a node with its new key, nil if the
+// volume does not hide them.
+func (u *User) resealAttr(inode meta.Ino, attr *meta.Attr, oldKey, newKey []byte) ([]byte, error) {
+	if attr.Sealed == nil {
+		return nil, nil
+	}
+	plain, err := u.enc.Decrypt(oldKey, attr.Sealed, crypto.AttrAD(uint64(inode)))
+	if err != nil {
+		return nil, err
+	}
+	return u.enc.Encrypt(newKey, plain, crypto.AttrAD(uint64(inode)))
+}
+
+// rewrapShares wraps the new key of a directory for the users it is still shared with.
+func (u *User) rewrapShares(inode meta.Ino, name, key []byte) ([]meta.Share, error) {
+	var shares []meta.Share
+	if err := u.m.GetShares(inode, &shares); err != nil {
+		return nil, err
+	}
+	for i, sh := range shares {
+		pubKey, err := u.shareRecipientKey(sh)
+		if err != nil {
+			return nil, err
+		}
+		shares[i].Name, err = u.enc.Encrypt(key, crypto.PadName(name), crypto.NameAD(uint64(meta.SharedInode), uint64(inode)))
+		if err != nil {
+			return nil, err
+		}
+		shares[i].Key, err = u.enc.Wrap(pubKey, key, crypto.ShareKeyAD(uint64(inode), sh.User, sh.Group))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shares, nil
+}
+
+// shareRecipientKey returns the public key of the user or group of a share.
+func (u *User) shareRecipientKey(sh meta.Share) (crypto.PublicKey, error) {
+	if sh.Group != 0 {
+		var g meta.Group
+		if err := u.m.GetGroupById(sh.Group, &g); err != nil {
+			return nil, err
+		}
+		return crypto.ParsePublicKey(crypto.KeyType(g.KeyType), g.PubKey)
+	}
+	return u.userPublicKey(sh.User)
+}
+
+// sealer seals the directories whose keys are given, which ends the chain of
+// MACs at the first one missing.
+func sealer(keys map[meta.Ino][]byte) meta.Sealer {
+	return func(inode meta.Ino, list []byte) ([]byte, error) {
+		key, ok := keys[inode]
+		if !ok {
+			return nil, nil
+		}
+		return crypto.MAC(key, list), nil
+	}
+}
@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+)
+
+func TestRotateDir(t *testing.T) {
+	v := newTestVolume(t)
+	alice, bob := v.newUser(t, "alice"), v.newUser(t, "bob")
+	// rotated while mounted
+	alice.root = newTestTree(t, alice)
+	proj := mkdir(t, alice.root, "proj")
+	data := bytes.Repeat([]byte("p"), 2*object.ChunkSize+10)
+	file, f := create(t, proj, "file", data)
+	share(t, alice, ino(proj), "proj", "bob")
+
+	oldKey, _ := pathKey(t, alice, ino(proj))
+	oldKey = bytes.Clone(oldKey)
+	var old object.Info
+	if err := v.obj.Stat(uint64(ino(file)), &old); err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	oldChunks, err := v.obj.Get(uint64(ino(file)), old.Version, 0, int64(len(data)), nil)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	if err = alice.rotateDir(ino(proj)); err != nil {
+		t.Fatalf("rotateDir: %s", err)
+	}
+	if rekeys := pending(t, alice); len(rekeys) != 0 {
+		t.Fatalf("%d nodes left pending", len(rekeys))
+	}
+	newKey, _ := pathKey(t, alice, ino(proj))
+	if bytes.Equal(newKey, oldKey) {
+		t.Fatal("the key of the directory was kept")
+	}
+	var info object.Info
+	if err = v.obj.Stat(uint64(ino(file)), &info); err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	if info.Version != old.Version+1 || bytes.Equal(info.Key, old.Key) {
+		t.Fatalf("the content was not encrypted again: version %d, was %d", info.Version, old.Version)
+	}
+	chunks, err := v.obj.Get(uint64(ino(file)), info.Version, 0, int64(len(data)), nil)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	for i, c := range chunks {
+		if bytes.Equal(c.Data, oldChunks[i].Data) {
+			t.Fatalf("chunk %d was kept", c.Indx)
+		}
+	}
+	if chunks, err = v.obj.Get(uint64(ino(file)), old.Version, 0, int64(len(data)), nil); err != nil || len(chunks) != 0 {
+		t.Fatalf("%d chunks of the previous version still stored: %v", len(chunks), err)
+	}
+
+	// the share of bob is wrapped for the new key
+	var sh meta.Share
+	if st := v.m.GetShare(context.Background(), bob.id, ino(proj), &sh); st != 0 {
+		t.Fatalf("GetShare: %s", st)
+	}
+	key, err := bob.unwrapShareKey(sh)
+	if err != nil || !bytes.Equal(key, newKey) {
+		t.Fatalf("the share of bob does not hold the new key: %v", err)
+	}
+	if _, err = alice.enc.Decrypt(oldKey, sh.Name, crypto.NameAD(uint64(meta.SharedInode), uint64(ino(proj)))); err == nil {
+		t.Fatal("the name of the share is still encrypted with the old key")
+	}
+
+	// the mount reads on, as does a tree opened afresh
+	if got := read(t, f, len(data)+10); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes through the mount, want the %d written", len(got), len(data))
+	}
+	if got := readPath(t, alice, len(data)+10, "proj", "file"); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes afresh, want the %d written", len(got), len(data))
+	}
+}
+
+func TestRotateResume(t *testing.T) {
+	v := newTestVolume(t)
+	alice := v.newUser(t, "alice")
+	root := newTestTree(t, alice)
+	proj := mkdir(t, root, "proj")
+	sub := mkdir(t, proj, "sub")
+	data := []byte("resumed")
+	create(t, sub, "file", data)
+
+	// interrupted once the directory itself is rekeyed, with no mount
+	alice.m = &failMeta{Meta: v.m, steps: 1}
+	if err := alice.rotateDir(ino(proj)); err == nil {
+		t.Fatal("rotateDir did not fail")
+	}
+	alice.m = v.m
+	if rekeys := pending(t, alice); len(rekeys) == 0 {
+		t.Fatal("nothing left pending by the interrupted rotation")
+	}
+
+	if err := alice.rotateDir(ino(proj)); err != nil {
+		t.Fatalf("rotateDir: %s", err)
+	}
+	if rekeys := pending(t, alice); len(rekeys) != 0 {
+		t.Fatalf("%d nodes left pending", len(rekeys))
+	}
+	if got := readPath(t, alice, 64, "proj", "sub", "file"); !bytes.Equal(got, data) {
+		t.Fatalf("read %q once resumed, want %q", got, data)
+	}
+}
@@ -0,0 +1,222 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+// shareInfo describes a share as listed by the shares command.
+type shareInfo struct {
+	Path    string `json:"path"`
+	User    string `json:"user,omitempty"`
+	Owner   string `json:"owner,omitempty"`
+	Perm    string `json:"perm"`
+	Expires string `json:"expires,omitempty"`
+}
+
+const sweepInterval = time.Minute
+
+func expiresString(expires int64) string {
+	if expires == 0 {
+		return ""
+	}
+	return time.Unix(expires, 0).Format(time.RFC3339)
+}
+
+func permString(perm uint8) string {
+	s := []byte("---")
+	if perm&meta.PermRead != 0 {
+		s[0] = 'r'
+	}
+	if perm&meta.PermWrite != 0 {
+		s[1] = 'w'
+	}
+	if perm&meta.PermReshare != 0 {
+		s[2] = 's'
+	}
+	return string(s)
+}
+
+// sharesOut lists the directories the user shared, and with whom.
+func (u *User) sharesOut() ([]shareInfo, error) {
+	var shares []meta.Share
+	if err := u.m.GetSharesOut(u.id, &shares); err != nil {
+		return nil, err
+	}
+	infos := make([]shareInfo, 0, len(shares))
+	for _, sh := range shares {
+		p, err := u.pathOf(sh.Inode)
+		if err != nil {
+			p = fmt.Sprintf("<inode %d>", sh.Inode)
+		}
+		var username string
+		if sh.Group != 0 {
+			var g meta.Group
+			if err = u.m.GetGroupById(sh.Group, &g); err != nil {
+				return nil, err
+			}
+			username = "@" + g.Name
+		} else if err = u.m.GetUserName(sh.User, &username); err != nil {
+			return nil, err
+		}
+		infos = append(infos, shareInfo{Path: p, User: username, Perm: permString(sh.Perm), Expires: expiresString(sh.Expires)})
+	}
+	return infos, nil
+}
+
+// sharesIn lists the directories shared with the user, as seen under /shared.
+func (u *User) sharesIn() ([]shareInfo, error) {
+	var shares []meta.Share
+	if err := u.m.GetSharesIn(u.id, &shares); err != nil {
+		return nil, err
+	}
+	infos := make([]shareInfo, 0, len(shares))
+	for _, sh := range shares {
+		name := fmt.Sprintf("<inode %d>", sh.Inode)
+		if key, err := u.unwrapShareKey(sh); err == nil {
+			if plain, err := crypto.UnpadName(u.enc.Decrypt(key, sh.Name, crypto.NameAD(uint64(meta.SharedInode), uint64(sh.Inode)))); err == nil {
+				name = string(plain)
+			}
+		}
+		var owner string
+		if err := u.m.GetUserName(sh.Owner, &owner); err != nil {
+			return nil, err
+		}
+		infos = append(infos, shareInfo{Path: path.Join("/shared", name), Owner: owner, Perm: permString(sh.Perm), Expires: expiresString(sh.Expires)})
+	}
+	return infos, nil
+}
+
+// pruneShares deletes the expired shares made by the user. If rotate is set,
+// the keys of the directories they gave access to are rotated first, and the
+// shares of a directory are only deleted once its keys are, so that a
+// rotation that failed is tried again by the next prune.
+func (u *User) pruneShares(rotate bool) (int, error) {
+	now := time.Now().Unix()
+	var pruned []meta.Share
+	if !rotate {
+		err := u.m.PruneShares(u.id, now, 0, &pruned)
+		return len(pruned), err
+	}
+	var expired []meta.Share
+	if err := u.m.GetExpiredShares(u.id, now, &expired); err != nil {
+		return 0, err
+	}
+	rotated := make(map[meta.Ino]bool)
+	for _, sh := range expired {
+		if rotated[sh.Inode] {
+			continue
+		}
+		rotated[sh.Inode] = true
+		if err := u.rotateDir(sh.Inode); err != nil {
+			return len(pruned), err
+		}
+		if err := u.m.PruneShares(u.id, now, sh.Inode, &pruned); err != nil {
+			return len(pruned), err
+		}
+	}
+	return len(pruned), nil
+}
+
+// startSweeper prunes the expired shares of the user in the background until
+// the returned function is called.
+func (u *User) startSweeper(rotate bool) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				n, err := u.pruneShares(rotate)
+				if err != nil {
+					logger.Errorf("prune expired shares: %s", err)
+				} else if n > 0 {
+					logger.Infof("pruned %d expired shares", n)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// pathOf returns the path of an inode as seen by the user: in its own tree
+// when the root key unwraps it, below /shared when one of its ancestors is
+// shared with the user.
+func (u *User) pathOf(inode meta.Ino) (string, error) {
+	var entries []*meta.Entry
+	if err := u.m.GetPath(inode, &entries); err != nil {
+		return "", err
+	}
+	if p, err := u.decryptPath(entries, u.rootKey.Bytes(), "/"); err == nil {
+		return p, nil
+	}
+	for i, e := range entries {
+		var share meta.Share
+		if u.m.GetShare(context.Background(), u.id, e.Inode, &share) != 0 {
+			continue
+		}
+		key, err := u.unwrapShareKey(share)
+		if err != nil {
+			return "", err
+		}
+		name, err := crypto.UnpadName(u.enc.Decrypt(key, e.Name, crypto.NameAD(uint64(e.Attr.Parent), uint64(e.Inode))))
+		if err != nil {
+			return "", err
+		}
+		return u.decryptPath(entries[:i], key, path.Join("/shared", string(name)))
+	}
+	return "", syscall.EACCES
+}
+
+// decryptPath decrypts the names of entries (ordered from the leaf) below dir
+// whose key is given.
+func (u *User) decryptPath(entries []*meta.Entry, key []byte, dir string) (string, error) {
+	p := dir
+	for i := len(entries) - 1; i >= 0; i-- {
+		var err error
+		e := entries[i]
+		key, err = u.enc.Decrypt(key, e.Key, crypto.KeyAD(uint64(e.Inode)))
+		if err != nil {
+			return "", err
+		}
+		name, err := crypto.UnpadName(u.enc.Decrypt(key, e.Name, crypto.NameAD(uint64(e.Attr.Parent), uint64(e.Inode))))
+		if err != nil {
+			return "", err
+		}
+		p = path.Join(p, string(name))
+	}
+	return p, nil
+}
+
+func printShares(infos []shareInfo, asJSON bool) {
+	if asJSON {
+		out, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			fmt.Println("json:", err)
+			return
+		}
+		fmt.Println(string(out))
+		return
+	}
+	if len(infos) == 0 {
+		fmt.Println("No shares.")
+		return
+	}
+	for _, i := range infos {
+		who := i.User
+		if who == "" {
+			who = i.Owner
+		}
+		fmt.Printf("%-40s %-16s %s %s\n", i.Path, who, i.Perm, i.Expires)
+	}
+}
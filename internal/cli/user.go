@@ -1,17 +1,23 @@
 package cli
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/sha512"
-	"crypto/x509"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/bastienvty/netsecfs/internal/crypto"
 	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/bastienvty/netsecfs/internal/fs"
 	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
 )
 
 type params struct {
@@ -40,15 +46,122 @@ func defaultParams() *params {
 	}
 }
 
+// DefaultKdf is the KDF of volumes that do not set their own.
+func DefaultKdf() meta.Kdf {
+	return meta.Kdf{Algo: meta.KdfArgon2id, Memory: DefaultMemory, Iterations: DefaultIterations, Parallelism: DefaultParallelism}
+}
+
+// kdfParams returns the parameters to derive a master key with the given KDF.
+func kdfParams(kdf meta.Kdf) (*params, error) {
+	if kdf.Algo != meta.KdfArgon2id {
+		return nil, fmt.Errorf("unsupported KDF %q", kdf.Algo)
+	}
+	p := defaultParams()
+	p.memory, p.iterations, p.parallelism = kdf.Memory, kdf.Iterations, kdf.Parallelism
+	return p, nil
+}
+
+// minKeyfileSize is the size a key file must have at least.
+const minKeyfileSize = 32
+
+// readKeyfile returns the hash of a key file, which may hold anything as long
+// as it is secret and large enough.
+func readKeyfile(path string) (*crypto.Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(data)
+	if len(data) < minKeyfileSize {
+		return nil, fmt.Errorf("the key file must be at least %d bytes", minKeyfileSize)
+	}
+	hash := sha256.Sum256(data)
+	return crypto.NewKey(hash[:])
+}
+
+// deriveMasterKey derives the master key of a user from its password and, if
+// given, the hash of its key file, so that both are needed to log in.
+func deriveMasterKey(password string, salt []byte, p *params, keyfile *crypto.Key) ([]byte, error) {
+	masterKey := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
+	if keyfile == nil {
+		return masterKey, nil
+	}
+	defer clear(masterKey)
+	combined := make([]byte, p.keyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, keyfile.Bytes(), []byte("netsecfs key file")), combined); err != nil {
+		return nil, err
+	}
+	return combined, nil
+}
+
 type User struct {
+	id       uint32
 	username string
 	password string
 
 	m          meta.Meta
+	obj        object.ObjectStorage
 	enc        crypto.Crypto
-	privateKey *rsa.PrivateKey
-	masterKey  []byte
-	rootKey    []byte
+	root       *fs.Node // root of the mounted file system, if any
+	privateKey crypto.PrivateKey
+	groups     map[uint32]crypto.PrivateKey
+	known      *knownKeys  // fingerprints pinned on this client
+	kdf        meta.Kdf    // KDF of the volume for new master keys
+	keyfile    *crypto.Key // hash of the key file of the user, if it has one
+	escrow     *meta.Escrow
+	format     *meta.Format    // of the volume, for the trees opened without a mount
+	keys       *crypto.Keyring // keys of the user, wiped on logout
+	masterKey  *crypto.Key
+	rootKey    *crypto.Key
+	sealed     bool // the tree of the user is sealed entirely, as bound to its root key
+}
+
+// lock moves a key of the user into locked memory.
+func (u *User) lock(b []byte) (*crypto.Key, error) {
+	if u.keys == nil {
+		u.keys = crypto.NewKeyring()
+	}
+	return u.keys.Key(b)
+}
+
+// rootKeyAD is the associated data of the root key of the user, encrypted with
+// its master key or wrapped for the key told by what. It binds whether the
+// tree of the user is sealed entirely to the root key, so that the databases
+// cannot pretend it is not to have MACs dropped.
+func (u *User) rootKeyAD(what string, sealed bool) []byte {
+	label := "root key"
+	if sealed {
+		label = "sealed root key"
+	}
+	if what != "" {
+		label = what + " " + label
+	}
+	return crypto.UserKeyAD(label, u.username)
+}
+
+// openRootKey decrypts the root key of the user with open, given the
+// associated data, and learns whether its tree is sealed.
+func (u *User) openRootKey(what string, open func(ad []byte) ([]byte, error)) ([]byte, error) {
+	if rootKey, err := open(u.rootKeyAD(what, true)); err == nil {
+		u.sealed = true
+		return rootKey, nil
+	}
+	u.sealed = false
+	return open(u.rootKeyAD(what, false))
+}
+
+// wipe zeroes the keys of the user, once logged out.
+func (u *User) wipe() {
+	u.keys.Wipe()
+	u.keyfile.Wipe()
+	if u.privateKey != nil {
+		u.privateKey.Wipe()
+	}
+	for _, key := range u.groups {
+		key.Wipe()
+	}
+	u.masterKey, u.rootKey, u.keyfile = nil, nil, nil
+	u.privateKey, u.groups = nil, nil
 }
 
 func (u *User) createUser() bool {
@@ -60,13 +173,20 @@ func (u *User) createUser() bool {
 		fmt.Printf("User %s already exists.\n", u.username)
 		return false
 	}
-	p := defaultParams()
+	p, err := kdfParams(u.kdf)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
 	salt := make([]byte, p.saltLength)
-	_, err := rand.Read(salt)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return false
+	}
+	masterKey, err := deriveMasterKey(u.password, salt, p, u.keyfile)
 	if err != nil {
 		return false
 	}
-	masterKey := argon2.IDKey([]byte(u.password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
 
 	hashMaster := sha512.New()
 	_, err = hashMaster.Write(masterKey)
@@ -74,13 +194,15 @@ func (u *User) createUser() bool {
 		return false
 	}
 	hashMasterKey := hashMaster.Sum(nil)
-	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privKey, err := crypto.GenerateKey(crypto.DefaultKeyType)
 	if err != nil {
 		return false
 	}
-	pubKey := &privKey.PublicKey
-	privKeyBytes := x509.MarshalPKCS1PrivateKey(privKey)
-	pubKeyBytes := x509.MarshalPKCS1PublicKey(pubKey)
+	// wiped along the user if the creation fails
+	u.privateKey = privKey
+	privKeyBytes := privKey.Bytes()
+	defer clear(privKeyBytes)
+	pubKeyBytes := privKey.Public().Bytes()
 
 	rootKey := make([]byte, p.keyLength)
 	_, err = rand.Read(rootKey)
@@ -88,24 +210,41 @@ func (u *User) createUser() bool {
 		return false
 	}
 
-	rootCipher, ok := u.enc.Encrypt(masterKey, rootKey)
+	// the tree of a new user is sealed from the start
+	u.sealed = true
+	rootCipher, ok := u.enc.Encrypt(masterKey, rootKey, u.rootKeyAD("", true))
 	if ok != nil {
 		return false
 	}
-	privCipher, ok := u.enc.Encrypt(masterKey, privKeyBytes)
+	privCipher, ok := u.enc.Encrypt(masterKey, privKeyBytes, crypto.UserKeyAD("private key", u.username))
 	if ok != nil {
 		return false
 	}
 
-	err = u.m.CreateUser(u.username, hashMasterKey, salt, rootCipher, privCipher, pubKeyBytes)
+	kdf := u.kdf
+	kdf.Keyfile = u.keyfile != nil
+	err = u.m.CreateUser(u.username, hashMasterKey, salt, rootCipher, privCipher, pubKeyBytes, uint8(privKey.Type()), kdf, sealer(map[meta.Ino][]byte{meta.RootInode: rootKey}))
+	if err != nil {
+		return false
+	}
+	err = u.m.GetUserId(u.username, &u.id)
 	if err != nil {
 		return false
 	}
 
-	u.masterKey = masterKey
-	u.rootKey = rootKey
-	u.privateKey = privKey
-	return true
+	if u.masterKey, err = u.lock(masterKey); err != nil {
+		return false
+	}
+	if u.rootKey, err = u.lock(rootKey); err != nil {
+		return false
+	}
+	if u.signRecord(pubKeyBytes) != nil {
+		return false
+	}
+	if u.updateEscrow(true) != nil {
+		return false
+	}
+	return u.loadGroups() == nil
 }
 
 func (u *User) verifyUser() bool {
@@ -113,13 +252,29 @@ func (u *User) verifyUser() bool {
 		fmt.Println("Username or password is empty.")
 		return false
 	}
-	p := defaultParams()
 	var salt []byte
-	err := u.m.GetSalt(u.username, &salt)
+	var kdf meta.Kdf
+	err := u.m.GetSalt(u.username, &salt, &kdf)
+	if err != nil {
+		return false
+	}
+	if kdf.Keyfile && u.keyfile == nil {
+		fmt.Println("A key file is needed to log in, use --keyfile <path>.")
+		return false
+	}
+	if !kdf.Keyfile && u.keyfile != nil {
+		fmt.Println("No key file is set for this user.")
+		return false
+	}
+	p, err := kdfParams(kdf)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	masterKey, err := deriveMasterKey(u.password, salt, p, u.keyfile)
 	if err != nil {
 		return false
 	}
-	masterKey := argon2.IDKey([]byte(u.password), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
 
 	hashMaster := sha512.New()
 	_, err = hashMaster.Write(masterKey)
@@ -128,43 +283,76 @@ func (u *User) verifyUser() bool {
 	}
 	hashMasterKey := hashMaster.Sum(nil)
 	var rootCipher, privCipher []byte
-	err = u.m.VerifyUser(u.username, hashMasterKey, &rootCipher, &privCipher)
+	var keyType uint8
+	err = u.m.VerifyUser(u.username, hashMasterKey, &rootCipher, &privCipher, &keyType)
 	if err != nil {
 		return false
 	}
 
-	rootKey, ok := u.enc.Decrypt(masterKey, rootCipher)
+	rootKey, ok := u.openRootKey("", func(ad []byte) ([]byte, error) {
+		return u.enc.Decrypt(masterKey, rootCipher, ad)
+	})
 	if ok != nil {
 		return false
 	}
-	privKeyBytes, ok := u.enc.Decrypt(masterKey, privCipher)
+	privKeyBytes, ok := u.enc.Decrypt(masterKey, privCipher, crypto.UserKeyAD("private key", u.username))
 	if ok != nil {
 		return false
 	}
 
-	privKey, err := x509.ParsePKCS1PrivateKey(privKeyBytes)
+	if u.privateKey, err = crypto.ParsePrivateKey(crypto.KeyType(keyType), privKeyBytes); err != nil {
+		return false
+	}
+	err = u.m.GetUserId(u.username, &u.id)
 	if err != nil {
 		return false
 	}
 
-	u.masterKey = masterKey
-	u.rootKey = rootKey
-	u.privateKey = privKey
-	return true
+	if u.masterKey, err = u.lock(masterKey); err != nil {
+		return false
+	}
+	if u.rootKey, err = u.lock(rootKey); err != nil {
+		return false
+	}
+	if err = u.checkRecord(); err != nil {
+		fmt.Println("Checking your user record failed:", err)
+		return false
+	}
+	if err = u.updateEscrow(false); err != nil {
+		fmt.Println("Escrowing your keys failed:", err)
+		return false
+	}
+	return u.loadGroups() == nil
 }
 
 func (u *User) changePassword(newPassword string) bool {
-	if u.username == "" || u.password == "" || newPassword == "" {
+	if u.username == "" || newPassword == "" {
 		fmt.Println("Username or password is empty.")
 		return false
 	}
-	p := defaultParams()
-	salt := make([]byte, p.saltLength)
-	_, err := rand.Read(salt)
+	// the master key is derived again with the parameters of the volume
+	// when they are stronger than the ones of the user
+	var salt []byte
+	var kdf meta.Kdf
+	if err := u.m.GetSalt(u.username, &salt, &kdf); err != nil {
+		return false
+	}
+	kdf = kdf.Stronger(u.kdf)
+	kdf.Keyfile = u.keyfile != nil
+	p, err := kdfParams(kdf)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	salt = make([]byte, p.saltLength)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return false
+	}
+	newMasterKey, err := deriveMasterKey(newPassword, salt, p, u.keyfile)
 	if err != nil {
 		return false
 	}
-	newMasterKey := argon2.IDKey([]byte(newPassword), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
 	hashMaster := sha512.New()
 	_, err = hashMaster.Write(newMasterKey)
 	if err != nil {
@@ -172,125 +360,229 @@ func (u *User) changePassword(newPassword string) bool {
 	}
 	hashMasterKey := hashMaster.Sum(nil)
 
-	privKeyBytes := x509.MarshalPKCS1PrivateKey(u.privateKey)
+	privKeyBytes := u.privateKey.Bytes()
+	defer clear(privKeyBytes)
 
-	rootCipher, ok := u.enc.Encrypt(newMasterKey, u.rootKey)
+	rootCipher, ok := u.enc.Encrypt(newMasterKey, u.rootKey.Bytes(), u.rootKeyAD("", u.sealed))
 	if ok != nil {
 		return false
 	}
-	privCipher, ok := u.enc.Encrypt(newMasterKey, privKeyBytes)
+	privCipher, ok := u.enc.Encrypt(newMasterKey, privKeyBytes, crypto.UserKeyAD("private key", u.username))
 	if ok != nil {
 		return false
 	}
 
-	err = u.m.ChangePassword(u.username, hashMasterKey, salt, rootCipher, privCipher)
+	err = u.m.ChangePassword(u.username, hashMasterKey, salt, rootCipher, privCipher, kdf)
 	if err != nil {
 		return false
 	}
 
+	locked, err := u.lock(newMasterKey)
+	if err != nil {
+		return false
+	}
+	u.masterKey.Wipe()
 	u.password = newPassword
-	u.masterKey = newMasterKey
+	u.masterKey = locked
 	return true
 }
 
-func (u *User) shareDir(dir, username string) bool {
+// sealTree seals the tree of a user created before MACs were required, then
+// binds its root key to it, so that any directory or file without a MAC is
+// taken as tampering from then on. The tree is sealed as it is, which is
+// only safe while the databases have not been tampered with.
+func (u *User) sealTree(opts fs.Options) bool {
+	if u.sealed {
+		fmt.Println("Your tree is already sealed.")
+		return true
+	}
+	root := fs.NewRootNode(u.m, u.obj, u.enc, u.privateKey, u.groups, crypto.NewKeyring(), u.rootKey, u.username, opts)
+	if root == nil {
+		return false
+	}
+	defer root.WipeKeys()
+	if err := root.SealTree(context.Background()); err != nil {
+		fmt.Println("Sealing your tree failed:", err)
+		return false
+	}
+	rootCipher, err := u.enc.Encrypt(u.masterKey.Bytes(), u.rootKey.Bytes(), u.rootKeyAD("", true))
+	if err != nil {
+		return false
+	}
+	if err = u.m.Rekey(u.id, &meta.RekeyStep{RootKey: rootCipher}, nil); err != nil {
+		return false
+	}
+	u.sealed = true
+	if err = u.updateRecovery(); err != nil {
+		fmt.Println("Your recovery key could not be updated, create a new one with `recovery`:", err)
+	}
+	if err = u.updateEscrow(true); err != nil {
+		fmt.Println("Your keys could not be escrowed, they will be on your next login:", err)
+	}
+	fmt.Println("Your tree is sealed, directories and files without a MAC are refused from now on.")
+	return true
+}
+
+// statDir returns the file info and the inode of a directory of the mount point.
+func statDir(dir string) (os.FileInfo, meta.Ino, bool) {
 	info, err := os.Stat(dir)
 	if err != nil {
 		fmt.Println("Error getting file info:", err)
-		return false
+		return nil, 0, false
 	}
 
 	stat, ok := info.Sys().(*syscall.Stat_t)
 	if !ok {
-		return false
+		return nil, 0, false
 	}
 
 	if stat == nil {
-		return false
+		return nil, 0, false
 	}
 
 	if !info.IsDir() {
 		fmt.Printf("%s is not a directory.\n", dir)
-		return false
+		return nil, 0, false
 	}
-	inode := stat.Ino
+	return info, meta.Ino(stat.Ino), true
+}
 
-	var userId uint32
-	err = u.m.GetUserId(username, &userId)
-	if err != nil {
-		fmt.Printf("No such user found: %s\n", username)
-		return false
-	}
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(filepath.Clean(path), "/"), "/")
+}
 
-	var keys [][]byte
-	err = u.m.GetPathKey(meta.Ino(inode), &keys)
+// inShared tells whether a path is reached through the /shared directory.
+func inShared(parts []string) bool {
+	return parts[0] == "shared" && len(parts) > 1
+}
+
+// dirKey returns the key of the directory at path (relative to the mount
+// point mp). The key chain is unwrapped from the root key, or from the key of
+// the share when the directory is reached through /shared. The keys met on
+// the way are returned too, by inode.
+func (u *User) dirKey(mp, path string, inode meta.Ino) ([]byte, map[meta.Ino][]byte, error) {
+	var entries []*meta.Entry
+	err := u.m.GetPath(inode, &entries)
 	if err != nil {
-		return false
+		return nil, nil, err
 	}
 
 	// start at the root of the path
-	key := u.rootKey
-	for i := len(keys) - 1; i >= 0; i-- {
-		key, err = u.enc.Decrypt(key, keys[i])
+	key := u.rootKey.Bytes()
+	keys := map[meta.Ino][]byte{meta.RootInode: key}
+	parts := splitPath(path)
+	if inShared(parts) {
+		_, shareIno, ok := statDir(filepath.Join(mp, "shared", parts[1]))
+		if !ok {
+			return nil, nil, syscall.ENOENT
+		}
+		var share meta.Share
+		if st := u.m.GetShare(context.Background(), u.id, shareIno, &share); st != 0 {
+			return nil, nil, st
+		}
+		key, err = u.unwrapShareKey(share)
 		if err != nil {
-			return false
+			return nil, nil, err
 		}
+		keys = map[meta.Ino][]byte{shareIno: key}
+		// only the keys below the shared directory are needed
+		entries = entries[:len(parts)-2]
 	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		key, err = u.enc.Decrypt(key, entries[i].Key, crypto.KeyAD(uint64(entries[i].Inode)))
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[entries[i].Inode] = key
+	}
+	return key, keys, nil
+}
 
-	name := []byte(info.Name())
-	nameCipher, err := u.enc.Encrypt(key, name)
-	if err != nil {
+// recipient resolves the user, or the group when prefixed with @, to share a
+// directory with and returns the public key to wrap the directory key for.
+func (u *User) recipient(target string, share *meta.Share) (crypto.PublicKey, error) {
+	if name, ok := strings.CutPrefix(target, "@"); ok {
+		var g meta.Group
+		if err := u.m.GetGroup(name, &g); err != nil {
+			fmt.Printf("No such group found: %s\n", name)
+			return nil, err
+		}
+		share.Group = g.Id
+		return crypto.ParsePublicKey(crypto.KeyType(g.KeyType), g.PubKey)
+	}
+	if err := u.m.GetUserId(target, &share.User); err != nil {
+		fmt.Printf("No such user found: %s\n", target)
+		return nil, err
+	}
+	return u.trustedPublicKey(target)
+}
+
+// unwrapShareKey decrypts the key of a share with the private key of the user,
+// or of the group it has been shared with.
+func (u *User) unwrapShareKey(share meta.Share) ([]byte, error) {
+	privKey := u.privateKey
+	if share.Group != 0 {
+		privKey = u.groups[share.Group]
+		if privKey == nil {
+			return nil, syscall.EACCES
+		}
+	}
+	return u.enc.Unwrap(privKey, share.Key, crypto.ShareKeyAD(uint64(share.Inode), share.User, share.Group))
+}
+
+func (u *User) shareDir(mp, path, target string, perm uint8, expires int64) bool {
+	info, inode, ok := statDir(filepath.Join(mp, path))
+	if !ok {
 		return false
 	}
 
-	var pubKeyBytes []byte
-	err = u.m.GetUserPublicKey(username, &pubKeyBytes)
+	share := meta.Share{Inode: inode, Perm: perm, Expires: expires}
+	pubKey, err := u.recipient(target, &share)
 	if err != nil {
 		return false
 	}
 
-	pubKey, err := x509.ParsePKCS1PublicKey(pubKeyBytes)
+	key, keys, err := u.dirKey(mp, path, inode)
 	if err != nil {
 		return false
 	}
-	key, err = u.enc.EncryptRSA(pubKey, key)
+
+	name := []byte(info.Name())
+	share.Name, err = u.enc.Encrypt(key, crypto.PadName(name), crypto.NameAD(uint64(meta.SharedInode), uint64(inode)))
 	if err != nil {
 		return false
 	}
 
-	err = u.m.ShareDir(userId, meta.Ino(inode), nameCipher, key)
-	return err == nil
-}
-
-func (u *User) unshareDir(dir, username string) bool {
-	info, err := os.Stat(dir)
+	share.Key, err = u.enc.Wrap(pubKey, key, crypto.ShareKeyAD(uint64(inode), share.User, share.Group))
 	if err != nil {
-		fmt.Println("Error getting file info:", err)
 		return false
 	}
 
-	stat, ok := info.Sys().(*syscall.Stat_t)
-	if !ok {
-		return false
+	err = u.m.ShareDir(u.id, &share, sealer(keys))
+	if err == syscall.EACCES {
+		fmt.Println("You are not allowed to share this directory with these permissions.")
 	}
+	return err == nil
+}
 
-	if stat == nil {
+func (u *User) unshareDir(mp, path, target string, rotate bool) bool {
+	_, inode, ok := statDir(filepath.Join(mp, path))
+	if !ok {
 		return false
 	}
 
-	if !info.IsDir() {
-		fmt.Printf("%s is not a directory.\n", dir)
+	var share meta.Share
+	if _, err := u.recipient(target, &share); err != nil {
 		return false
 	}
-	inode := stat.Ino
 
-	var userId uint32
-	err = u.m.GetUserId(username, &userId)
-	if err != nil {
-		fmt.Printf("No such user found: %s\n", username)
+	err := u.m.UnshareDir(inode, share.User, share.Group)
+	if err != nil || !rotate {
+		return err == nil
+	}
+	if err = u.rotateDir(inode); err != nil {
+		fmt.Println("Key rotation failed:", err)
 		return false
 	}
-
-	err = u.m.UnshareDir(userId, meta.Ino(inode))
-	return err == nil
+	return true
 }
@@ -0,0 +1,213 @@
+package cli
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/bastienvty/netsecfs/internal/fs"
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// testVolume is a volume the users of a test share.
+type testVolume struct {
+	m      meta.Meta
+	obj    object.ObjectStorage
+	format *meta.Format
+}
+
+func newTestVolume(t *testing.T) *testVolume {
+	t.Helper()
+	dir := t.TempDir()
+	v := &testVolume{m: meta.RegisterMeta(filepath.Join(dir, "meta.db")), format: &meta.Format{Name: "test"}}
+	if err := v.m.Init(v.format); err != nil {
+		t.Fatalf("Init: %s", err)
+	}
+	obj, err := object.CreateStorage(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatalf("CreateStorage: %s", err)
+	}
+	v.obj = obj
+	t.Cleanup(func() {
+		object.Shutdown(obj)
+		v.m.Shutdown()
+	})
+	return v
+}
+
+// newUser signs a user up, with a KDF cheap enough for tests.
+func (v *testVolume) newUser(t *testing.T, username string) *User {
+	t.Helper()
+	u := &User{
+		username: username,
+		password: "password",
+		m:        v.m,
+		obj:      v.obj,
+		enc:      &crypto.CryptoHelper{},
+		kdf:      meta.Kdf{Algo: meta.KdfArgon2id, Memory: 64, Iterations: 1, Parallelism: 1},
+		format:   v.format,
+	}
+	if !u.createUser() {
+		t.Fatalf("cannot create %s", username)
+	}
+	t.Cleanup(u.wipe)
+	return u
+}
+
+// newTestTree opens the tree of a user as a mount would.
+func newTestTree(t *testing.T, u *User) *fs.Node {
+	t.Helper()
+	opts, err := mountOptions(u.format, fs.Options{})
+	if err != nil {
+		t.Fatalf("mountOptions: %s", err)
+	}
+	opts.Sealed = u.sealed
+	root := fs.NewRootNode(u.m, u.obj, u.enc, u.privateKey, u.groups, crypto.NewKeyring(), u.rootKey, u.username, opts)
+	if root == nil {
+		t.Fatal("NewRootNode failed")
+	}
+	t.Cleanup(root.WipeKeys)
+	// lets the tree grow without a mount
+	gofs.NewNodeFS(root, &gofs.Options{RootStableAttr: &gofs.StableAttr{Ino: uint64(meta.RootInode)}})
+	return root
+}
+
+func ino(n *fs.Node) meta.Ino {
+	return meta.Ino(n.StableAttr().Ino)
+}
+
+// mkdir creates a directory in dir, as the kernel does.
+func mkdir(t *testing.T, dir *fs.Node, name string) *fs.Node {
+	t.Helper()
+	var out fuse.EntryOut
+	inode, errno := dir.Mkdir(context.Background(), name, 0755, &out)
+	if errno != 0 {
+		t.Fatalf("Mkdir(%s): %s", name, errno)
+	}
+	dir.AddChild(name, inode, true)
+	return inode.Operations().(*fs.Node)
+}
+
+// create creates a file in dir holding data, as the kernel does.
+func create(t *testing.T, dir *fs.Node, name string, data []byte) (*fs.Node, *fs.File) {
+	t.Helper()
+	ctx := context.Background()
+	var out fuse.EntryOut
+	inode, fh, _, errno := dir.Create(ctx, name, 0, 0644, &out)
+	if errno != 0 {
+		t.Fatalf("Create(%s): %s", name, errno)
+	}
+	dir.AddChild(name, inode, true)
+	f := fh.(*fs.File)
+	if _, errno = f.Write(ctx, data, 0); errno != 0 {
+		t.Fatalf("Write: %s", errno)
+	}
+	if errno = f.Flush(ctx); errno != 0 {
+		t.Fatalf("Flush: %s", errno)
+	}
+	return inode.Operations().(*fs.Node), f
+}
+
+// read reads size bytes from the start of a file.
+func read(t *testing.T, f *fs.File, size int) []byte {
+	t.Helper()
+	res, errno := f.Read(context.Background(), make([]byte, size), 0)
+	if errno != 0 {
+		t.Fatalf("Read: %s", errno)
+	}
+	data, _ := res.Bytes(nil)
+	return data
+}
+
+// readPath reads a file of the user through a tree opened afresh.
+func readPath(t *testing.T, u *User, size int, names ...string) []byte {
+	t.Helper()
+	ctx := context.Background()
+	n := newTestTree(t, u)
+	for _, name := range names {
+		var out fuse.EntryOut
+		inode, errno := n.Lookup(ctx, name, &out)
+		if errno != 0 {
+			t.Fatalf("Lookup(%s): %s", name, errno)
+		}
+		n.AddChild(name, inode, true)
+		n = inode.Operations().(*fs.Node)
+	}
+	fh, _, errno := n.Open(ctx, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open: %s", errno)
+	}
+	f := fh.(*fs.File)
+	defer f.Release(ctx)
+	return read(t, f, size)
+}
+
+// pathKey returns the key of a directory of the user, unwrapped from its root
+// key, along the keys of its ancestors.
+func pathKey(t *testing.T, u *User, inode meta.Ino) ([]byte, map[meta.Ino][]byte) {
+	t.Helper()
+	var entries []*meta.Entry
+	if err := u.m.GetPath(inode, &entries); err != nil {
+		t.Fatalf("GetPath: %s", err)
+	}
+	key := u.rootKey.Bytes()
+	keys := map[meta.Ino][]byte{meta.RootInode: key}
+	for i := len(entries) - 1; i >= 0; i-- {
+		var err error
+		if key, err = u.enc.Decrypt(key, entries[i].Key, crypto.KeyAD(uint64(entries[i].Inode))); err != nil {
+			t.Fatalf("Decrypt: %s", err)
+		}
+		keys[entries[i].Inode] = key
+	}
+	return key, keys
+}
+
+// share shares a directory of the user with target, as shareDir does.
+func share(t *testing.T, u *User, inode meta.Ino, name, target string) {
+	t.Helper()
+	sh := meta.Share{Inode: inode, Perm: meta.PermAll}
+	pubKey, err := u.recipient(target, &sh)
+	if err != nil {
+		t.Fatalf("recipient(%s): %s", target, err)
+	}
+	key, keys := pathKey(t, u, inode)
+	if sh.Name, err = u.enc.Encrypt(key, crypto.PadName([]byte(name)), crypto.NameAD(uint64(meta.SharedInode), uint64(inode))); err != nil {
+		t.Fatalf("Encrypt: %s", err)
+	}
+	if sh.Key, err = u.enc.Wrap(pubKey, key, crypto.ShareKeyAD(uint64(inode), sh.User, sh.Group)); err != nil {
+		t.Fatalf("Wrap: %s", err)
+	}
+	if err = u.m.ShareDir(u.id, &sh, sealer(keys)); err != nil {
+		t.Fatalf("ShareDir: %s", err)
+	}
+}
+
+// pending returns the nodes left pending by an interrupted rekey of the user.
+func pending(t *testing.T, u *User) []meta.Rekey {
+	t.Helper()
+	var rekeys []meta.Rekey
+	if err := u.m.GetRekeys(u.id, &rekeys); err != nil {
+		t.Fatalf("GetRekeys: %s", err)
+	}
+	return rekeys
+}
+
+// failMeta fails the rekey steps past the first ones, as a client interrupted
+// in the middle of a rekey.
+type failMeta struct {
+	meta.Meta
+	steps int
+}
+
+func (m *failMeta) Rekey(userId uint32, step *meta.RekeyStep, seal meta.Sealer) error {
+	if m.steps == 0 {
+		return syscall.EIO
+	}
+	m.steps--
+	return m.Meta.Rekey(userId, step, seal)
+}
@@ -0,0 +1,132 @@
+// Package compress compresses the chunks of files before they are encrypted.
+// A compressed chunk starts with a header telling its algorithm and the
+// length of its payload, so that chunks of any algorithm can be read back and
+// anything after the payload, such as padding, is ignored.
+package compress
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+type Algo uint8
+
+const (
+	None Algo = iota
+	Zstd
+	Lz4
+)
+
+// HeaderSize is the length of the header of a chunk: its algorithm and the
+// length of its payload.
+const HeaderSize = 1 + 4
+
+var errCorrupt = errors.New("corrupt compressed chunk")
+
+func (a Algo) String() string {
+	switch a {
+	case None:
+		return "none"
+	case Zstd:
+		return "zstd"
+	case Lz4:
+		return "lz4"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(a))
+}
+
+// Parse returns the algorithm with the given name.
+func Parse(name string) (Algo, error) {
+	switch name {
+	case "none":
+		return None, nil
+	case "zstd":
+		return Zstd, nil
+	case "lz4":
+		return Lz4, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q, use zstd, lz4 or none", name)
+}
+
+// the encoder and the decoder of zstd can be used by several goroutines at once
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(1<<26))
+	})
+)
+
+// Encode compresses data with a and prepends the header. Data that does not
+// shrink is kept as is, with a header telling so.
+func Encode(a Algo, data []byte) ([]byte, error) {
+	out := make([]byte, HeaderSize, HeaderSize+len(data))
+	switch a {
+	case Zstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		out = enc.EncodeAll(data, out)
+	case Lz4:
+		buf := make([]byte, HeaderSize+lz4.CompressBlockBound(len(data)))
+		n, err := lz4.CompressBlock(data, buf[HeaderSize:], nil)
+		if err != nil {
+			return nil, err
+		}
+		out = buf[:HeaderSize+n] // n is 0 when data is incompressible
+	case None:
+	default:
+		return nil, fmt.Errorf("unknown compression %d", uint8(a))
+	}
+	if a == None || len(out) == HeaderSize || len(out) >= HeaderSize+len(data) {
+		a, out = None, append(out[:HeaderSize], data...)
+	}
+	out[0] = byte(a)
+	binary.BigEndian.PutUint32(out[1:], uint32(len(out)-HeaderSize))
+	return out, nil
+}
+
+// Decode returns the data of a chunk encoded by Encode, at most maxSize bytes.
+func Decode(chunk []byte, maxSize int) ([]byte, error) {
+	if len(chunk) < HeaderSize {
+		return nil, errCorrupt
+	}
+	n := binary.BigEndian.Uint32(chunk[1:])
+	if uint64(n) > uint64(len(chunk)-HeaderSize) {
+		return nil, errCorrupt
+	}
+	payload := chunk[HeaderSize : HeaderSize+int(n)]
+	var data []byte
+	switch Algo(chunk[0]) {
+	case None:
+		data = payload
+	case Zstd:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		if data, err = dec.DecodeAll(payload, make([]byte, 0, maxSize)); err != nil {
+			return nil, err
+		}
+	case Lz4:
+		data = make([]byte, maxSize)
+		m, err := lz4.UncompressBlock(payload, data)
+		if err != nil {
+			return nil, err
+		}
+		data = data[:m]
+	default:
+		return nil, fmt.Errorf("unknown compression %d", chunk[0])
+	}
+	if len(data) > maxSize {
+		return nil, errCorrupt
+	}
+	return data, nil
+}
@@ -0,0 +1,104 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+const maxSize = 1 << 16
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, maxSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{1}},
+		{"repeated", bytes.Repeat([]byte("netsecfs "), maxSize/16)},
+		{"zeros", make([]byte, maxSize)},
+		{"incompressible", random},
+	}
+	for _, a := range []Algo{None, Zstd, Lz4} {
+		for _, tt := range tests {
+			t.Run(a.String()+"/"+tt.name, func(t *testing.T) {
+				chunk, err := Encode(a, tt.data)
+				if err != nil {
+					t.Fatalf("Encode: %s", err)
+				}
+				if len(chunk) > HeaderSize+len(tt.data) {
+					t.Fatalf("encoded %d bytes into %d", len(tt.data), len(chunk))
+				}
+				if (a == None || tt.name == "incompressible") && Algo(chunk[0]) != None {
+					t.Fatalf("stored as %s, want none", Algo(chunk[0]))
+				}
+				// padding after the payload is ignored
+				got, err := Decode(append(chunk, make([]byte, 7)...), maxSize)
+				if err != nil {
+					t.Fatalf("Decode: %s", err)
+				}
+				if !bytes.Equal(got, tt.data) {
+					t.Fatalf("decoded %d bytes, want %d", len(got), len(tt.data))
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	large := bytes.Repeat([]byte{'a'}, 2*maxSize)
+	tests := []struct {
+		name  string
+		chunk func() []byte
+	}{
+		{"empty", func() []byte { return nil }},
+		{"truncated header", func() []byte { return []byte{byte(None), 0, 0, 0} }},
+		{"length past the end", func() []byte {
+			chunk, _ := Encode(None, []byte("data"))
+			return chunk[:len(chunk)-1]
+		}},
+		{"huge length", func() []byte {
+			chunk := make([]byte, HeaderSize+4)
+			binary.BigEndian.PutUint32(chunk[1:], 1<<31)
+			return chunk
+		}},
+		{"unknown algorithm", func() []byte {
+			chunk, _ := Encode(None, []byte("data"))
+			chunk[0] = 9
+			return chunk
+		}},
+		{"none oversized", func() []byte {
+			chunk, _ := Encode(None, large)
+			return chunk
+		}},
+		{"zstd oversized", func() []byte {
+			chunk, _ := Encode(Zstd, large)
+			return chunk
+		}},
+		{"lz4 oversized", func() []byte {
+			chunk, _ := Encode(Lz4, large)
+			return chunk
+		}},
+		{"zstd garbage", func() []byte {
+			return append([]byte{byte(Zstd), 0, 0, 0, 4}, "junk"...)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.chunk(), maxSize); err == nil {
+				t.Fatal("Decode succeeded")
+			}
+		})
+	}
+}
+
+func TestEncodeUnknown(t *testing.T) {
+	if _, err := Encode(Algo(9), []byte("data")); err == nil {
+		t.Fatal("Encode succeeded")
+	}
+}
@@ -0,0 +1,84 @@
+package crypto
+
+import "encoding/binary"
+
+// The associated data below binds a ciphertext to the place it is stored at,
+// so that it fails to decrypt once swapped with another one or moved
+// elsewhere in the databases.
+
+func bind(label string, ids ...uint64) []byte {
+	ad := append([]byte("netsecfs "+label), 0)
+	for _, id := range ids {
+		ad = binary.BigEndian.AppendUint64(ad, id)
+	}
+	return ad
+}
+
+// NameAD binds the name of an entry to its parent and its inode.
+func NameAD(parent, inode uint64) []byte {
+	return bind("name", parent, inode)
+}
+
+// KeyAD binds the key of a node, wrapped under the key of its parent, to the node.
+func KeyAD(inode uint64) []byte {
+	return bind("key", inode)
+}
+
+// RekeyAD binds the old key of a node, kept under its new key until a rekey
+// is done with it, to the node.
+func RekeyAD(inode uint64) []byte {
+	return bind("old key", inode)
+}
+
+// ContentKeyAD binds the content key of a file, wrapped under the key of the file.
+func ContentKeyAD(inode uint64) []byte {
+	return bind("content key", inode)
+}
+
+// ChunkAD binds a chunk of the content of a file to its index and to the
+// version of the file it was written at.
+func ChunkAD(inode uint64, indx uint32, version uint64) []byte {
+	return bind("chunk", inode, uint64(indx), version)
+}
+
+// ObjectAD is the associated data of the chunks stored by their hash, which
+// are shared by files and so bound to no place. Their place is authenticated
+// by the hashes of the file instead.
+func ObjectAD() []byte {
+	return bind("object")
+}
+
+// ChunkKeysAD binds the keys of the chunks of a file stored by their hash,
+// encrypted with its content key, to the file and the version they are of.
+func ChunkKeysAD(inode, version uint64) []byte {
+	return bind("chunk keys", inode, version)
+}
+
+// SizeAD binds the exact size of the content of a file, kept encrypted when
+// sizes are padded, to the file and the version it was written at.
+func SizeAD(inode, version uint64) []byte {
+	return bind("size", inode, version)
+}
+
+// AttrAD binds the attributes of a node, encrypted with its key when the
+// volume hides them, to the node.
+func AttrAD(inode uint64) []byte {
+	return bind("attributes", inode)
+}
+
+// ShareKeyAD binds the key of a shared directory to the user or the group it
+// is shared with.
+func ShareKeyAD(inode uint64, user, group uint32) []byte {
+	return bind("share key", inode, uint64(user), uint64(group))
+}
+
+// MemberKeyAD binds the private key of a group to the member it is wrapped for.
+func MemberKeyAD(group, user uint32) []byte {
+	return bind("member key", uint64(group), uint64(user))
+}
+
+// UserKeyAD binds a key of a user, encrypted under its master key, to the
+// column it is stored in.
+func UserKeyAD(column, username string) []byte {
+	return bind("user " + column + "\x00" + username)
+}
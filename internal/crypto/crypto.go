@@ -1,108 +1,323 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
+// Crypto encrypts and wraps keys. The associated data ad is authenticated
+// along the ciphertext, which cannot be decrypted with a different one.
 type Crypto interface {
-	Encrypt(key, plaintext []byte) ([]byte, error)
-	Decrypt(key, ciphertext []byte) ([]byte, error)
-	EncryptRSA(pubKey *rsa.PublicKey, plaintext []byte) ([]byte, error)
-	DecryptRSA(privKey *rsa.PrivateKey, ciphertext []byte) ([]byte, error)
+	Encrypt(key, plaintext, ad []byte) ([]byte, error)
+	Decrypt(key, ciphertext, ad []byte) ([]byte, error)
+	// EncryptConvergent encrypts deterministically with a key derived from
+	// the plaintext, see ChunkKey. It decrypts with Decrypt.
+	EncryptConvergent(key, plaintext, ad []byte) ([]byte, error)
+	// Wrap encrypts a small secret, like the key of a directory, for the
+	// owner of pubKey.
+	Wrap(pubKey PublicKey, plaintext, ad []byte) ([]byte, error)
+	Unwrap(privKey PrivateKey, ciphertext, ad []byte) ([]byte, error)
+	Sign(privKey PrivateKey, data []byte) ([]byte, error)
+	Verify(pubKey PublicKey, data, signature []byte) error
+}
+
+// Fingerprint returns a short printable digest of a marshalled public key, in
+// the same form as the ones of OpenSSH.
+func Fingerprint(pubKey []byte) string {
+	sum := sha256.Sum256(pubKey)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
 }
 
+// Cipher is the AEAD a ciphertext is encrypted with. Its value is the header
+// byte prepended to every ciphertext, so that algorithms can be changed
+// without breaking existing data.
+type Cipher uint8
+
+const (
+	CipherAESGCM    Cipher = iota + 1 // AES-256-GCM with a random 12-byte nonce
+	CipherXChaCha20                   // XChaCha20-Poly1305 with a random 24-byte nonce
+)
+
+// bound is set in the header of ciphertexts encrypted with associated data.
+// Ciphertexts without it were written before associated data was used and
+// are decrypted without.
+const bound = 0x80
+
+var errCiphertext = errors.New("ciphertext too short")
+
+func (c Cipher) String() string {
+	switch c {
+	case CipherAESGCM:
+		return "aes-gcm"
+	case CipherXChaCha20:
+		return "xchacha20-poly1305"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+// ParseCipher returns the cipher with the given name. An empty name is the
+// default AES-GCM, used by volumes created before ciphers were selectable.
+func ParseCipher(name string) (Cipher, error) {
+	switch name {
+	case "", "aes-gcm":
+		return CipherAESGCM, nil
+	case "xchacha20-poly1305":
+		return CipherXChaCha20, nil
+	}
+	return 0, fmt.Errorf("unknown cipher %q, use aes-gcm or xchacha20-poly1305", name)
+}
+
+func (c Cipher) aead(key []byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherXChaCha20:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, fmt.Errorf("unknown cipher %d", uint8(c))
+}
+
+// CryptoHelper encrypts with the cipher of the volume, AES-GCM by default.
 type CryptoHelper struct {
+	Cipher Cipher
+}
+
+func (c *CryptoHelper) Encrypt(key, plaintext, ad []byte) ([]byte, error) {
+	return c.seal(key, plaintext, ad, true)
 }
 
-func (c *CryptoHelper) Encrypt(key, plaintext []byte) ([]byte, error) {
+// EncryptConvergent encrypts with a key derived from the plaintext, so that
+// equal plaintexts give equal ciphertexts. The nonce is fixed, which is safe
+// as such a key only ever encrypts the plaintext it is derived from.
+func (c *CryptoHelper) EncryptConvergent(key, plaintext, ad []byte) ([]byte, error) {
+	return c.seal(key, plaintext, ad, false)
+}
+
+func (c *CryptoHelper) seal(key, plaintext, ad []byte, random bool) ([]byte, error) {
 	if len(key) == 0 {
 		return plaintext, nil
 	}
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		panic(err.Error())
+	algo := c.Cipher
+	if algo == 0 {
+		algo = CipherAESGCM
 	}
-
-	aesgcm, err := cipher.NewGCM(block)
+	aead, err := algo.aead(key)
 	if err != nil {
 		return nil, err
 	}
 
-	// Never use more than 2^32 random nonces with a given key because of the risk of a repeat.
-	nonce := make([]byte, aesgcm.NonceSize()) // 12 bytes by default
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
+	// Never use more than 2^32 random nonces with a given AES-GCM key because of the risk of a repeat.
+	nonce := make([]byte, 1+aead.NonceSize())
+	nonce[0] = byte(algo)
+	if len(ad) > 0 {
+		nonce[0] |= bound
+	}
+	if random {
+		if _, err := io.ReadFull(rand.Reader, nonce[1:]); err != nil {
+			return nil, err
+		}
 	}
 
-	// encrypt an prepend the nonce to the ciphertext before returning it
-	ciphertext := aesgcm.Seal(nonce, nonce, plaintext, nil)
-
-	return ciphertext, nil
+	// encrypt and prepend the header and the nonce to the ciphertext before returning it
+	return aead.Seal(nonce, nonce[1:], plaintext, ad), nil
 }
 
-func (c *CryptoHelper) Decrypt(key, ciphertext []byte) ([]byte, error) {
+func (c *CryptoHelper) Decrypt(key, ciphertext, ad []byte) ([]byte, error) {
 	if len(key) == 0 {
 		return ciphertext, nil
 	}
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+	// entries without a key, like /shared, have an empty one
+	if len(ciphertext) == 0 {
+		return nil, nil
+	}
+	header := ciphertext[0]
+	if algo := Cipher(header &^ bound); algo == CipherAESGCM || algo == CipherXChaCha20 {
+		var data []byte
+		if header&bound != 0 {
+			data = ad
+		}
+		plaintext, err := open(algo, key, ciphertext[1:], data)
+		if err == nil {
+			return plaintext, nil
+		}
 	}
+	// data encrypted before the header was added, whose first byte is part
+	// of the nonce: AES-GCM with the nonce prepended to the ciphertext
+	return open(CipherAESGCM, key, ciphertext, nil)
+}
 
-	aesgcm, err := cipher.NewGCM(block)
+// open decrypts a ciphertext the nonce is prepended to.
+func open(algo Cipher, key, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := algo.aead(key)
 	if err != nil {
 		return nil, err
 	}
-
-	// the nonce is prepended to the cipher text
-	nonceSize := aesgcm.NonceSize()
-	if len(ciphertext) < nonceSize {
-		return nil, err
+	nonceSize := aead.NonceSize()
+	if len(ciphertext) < nonceSize+aead.Overhead() {
+		return nil, errCiphertext
 	}
-
-	// split the nonce from the ciptertext
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-
-	plaintext, err := aesgcm.Open(nil, nonce, ciphertext, nil)
-
-	return plaintext, err
+	return aead.Open(nil, nonce, ciphertext, ad)
 }
 
-func (c *CryptoHelper) EncryptRSA(pubKey *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+func (c *CryptoHelper) Wrap(pubKey PublicKey, plaintext, ad []byte) ([]byte, error) {
 	if len(plaintext) == 0 {
 		return nil, nil
 	}
-	encrypted, err := rsa.EncryptOAEP(
-		sha512.New(),
-		rand.Reader,
-		pubKey,
-		plaintext,
-		nil,
-	)
-	if err != nil {
-		return nil, err
+	switch k := pubKey.(type) {
+	case rsaPublicKey:
+		// the associated data is the label of OAEP
+		if len(plaintext) <= k.Size()-2*sha512.Size-2 {
+			return rsa.EncryptOAEP(sha512.New(), rand.Reader, k.PublicKey, plaintext, ad)
+		}
+		// RSA cannot encrypt more than a few bytes, so a random key that
+		// encrypts the data is wrapped instead
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		wrapped, err := rsa.EncryptOAEP(sha512.New(), rand.Reader, k.PublicKey, key, ad)
+		if err != nil {
+			return nil, err
+		}
+		ciphertext, err := c.Encrypt(key, plaintext, ad)
+		if err != nil {
+			return nil, err
+		}
+		return append(wrapped, ciphertext...), nil
+	case x25519PublicKey:
+		// ECIES: the ephemeral public key is prepended to the ciphertext
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(k.dh)
+		if err != nil {
+			return nil, err
+		}
+		key, err := wrapKey(shared, ephemeral.PublicKey(), k.dh)
+		if err != nil {
+			return nil, err
+		}
+		ciphertext, err := c.Encrypt(key, plaintext, ad)
+		if err != nil {
+			return nil, err
+		}
+		return append(ephemeral.PublicKey().Bytes(), ciphertext...), nil
 	}
-	return encrypted, nil
+	return nil, errKeyType
 }
 
-func (c *CryptoHelper) DecryptRSA(privKey *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
+func (c *CryptoHelper) Unwrap(privKey PrivateKey, ciphertext, ad []byte) ([]byte, error) {
 	if len(ciphertext) == 0 {
 		return nil, nil
 	}
-	decrypted, err := rsa.DecryptOAEP(
-		sha512.New(),
-		rand.Reader,
-		privKey,
-		ciphertext,
-		nil,
-	)
-	if err != nil {
-		return nil, err
+	switch k := privKey.(type) {
+	case rsaPrivateKey:
+		priv, err := k.parse()
+		if err != nil {
+			return nil, err
+		}
+		defer clearRSA(priv)
+		wrapped := ciphertext
+		if len(ciphertext) > priv.Size() {
+			wrapped = ciphertext[:priv.Size()]
+		}
+		key, err := rsa.DecryptOAEP(sha512.New(), rand.Reader, priv, wrapped, ad)
+		if err != nil && len(ad) > 0 {
+			// wrapped before associated data was used
+			key, err = rsa.DecryptOAEP(sha512.New(), rand.Reader, priv, wrapped, nil)
+		}
+		if err != nil || len(ciphertext) == len(wrapped) {
+			return key, err
+		}
+		defer clear(key)
+		return c.Decrypt(key, ciphertext[priv.Size():], ad)
+	case x25519PrivateKey:
+		if len(ciphertext) < 32 {
+			return nil, errors.New("wrapped key too short")
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(ciphertext[:32])
+		if err != nil {
+			return nil, err
+		}
+		dh, err := k.dh()
+		if err != nil {
+			return nil, err
+		}
+		shared, err := dh.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(shared)
+		key, err := wrapKey(shared, ephemeral, k.pub.dh)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(key)
+		return c.Decrypt(key, ciphertext[32:], ad)
+	}
+	return nil, errKeyType
+}
+
+// wrapKey derives the key a secret is wrapped with from an X25519 shared
+// secret, bound to the ephemeral and the recipient public keys.
+func wrapKey(shared []byte, ephemeral, recipient *ecdh.PublicKey) ([]byte, error) {
+	salt := append(ephemeral.Bytes(), recipient.Bytes()...)
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("netsecfs wrap")), key)
+	return key, err
+}
+
+func (c *CryptoHelper) Sign(privKey PrivateKey, data []byte) ([]byte, error) {
+	switch k := privKey.(type) {
+	case rsaPrivateKey:
+		priv, err := k.parse()
+		if err != nil {
+			return nil, err
+		}
+		defer clearRSA(priv)
+		hashed := sha512.Sum512(data)
+		return rsa.SignPSS(rand.Reader, priv, crypto.SHA512, hashed[:], nil)
+	case x25519PrivateKey:
+		sign, err := k.signer()
+		if err != nil {
+			return nil, err
+		}
+		defer clear(sign)
+		return ed25519.Sign(sign, data), nil
+	}
+	return nil, errKeyType
+}
+
+func (c *CryptoHelper) Verify(pubKey PublicKey, data, signature []byte) error {
+	switch k := pubKey.(type) {
+	case rsaPublicKey:
+		hashed := sha512.Sum512(data)
+		return rsa.VerifyPSS(k.PublicKey, crypto.SHA512, hashed[:], signature, nil)
+	case x25519PublicKey:
+		if !ed25519.Verify(k.sign, data, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
 	}
-	return decrypted, nil
+	return errKeyType
 }
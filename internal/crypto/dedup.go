@@ -0,0 +1,30 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// DedupSecret derives the secret the chunk keys of a tree are derived with
+// from a key of the tree: the root key of a user, the private key of a group
+// or the key of a shared directory. Only those who hold it can tell whether
+// a chunk of the tree holds some given data.
+func DedupSecret(key []byte) ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("netsecfs dedup")), secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// ChunkKey derives the key of a chunk from its plain data, keyed with the
+// secret of its tree, so that equal chunks of a tree encrypt the same.
+func ChunkKey(secret, data []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("netsecfs chunk key"))
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,230 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyType tells which algorithms a key pair is used with. It is stored along
+// the public key of users and groups so that older key pairs keep working.
+type KeyType uint8
+
+const (
+	KeyRSA    KeyType = iota // RSA-2048, OAEP to wrap keys and PSS to sign
+	KeyX25519                // X25519 to wrap keys and Ed25519 to sign
+)
+
+// DefaultKeyType is the type of the key pairs of new users and groups.
+const DefaultKeyType = KeyX25519
+
+var errKeyType = errors.New("unsupported key type")
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyRSA:
+		return "rsa2048"
+	case KeyX25519:
+		return "x25519"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// PublicKey is the public part of a key pair, used to wrap keys for its owner
+// and to verify its signatures.
+type PublicKey interface {
+	Type() KeyType
+	Bytes() []byte
+}
+
+// PrivateKey is a key pair, used to unwrap keys and to sign. The private key
+// is kept in locked memory and only parsed while it is used, until it is
+// wiped by its owner.
+type PrivateKey interface {
+	Type() KeyType
+	// Bytes returns a copy of the private key, which the caller clears once
+	// used.
+	Bytes() []byte
+	Public() PublicKey
+	Wipe()
+}
+
+var errWiped = errors.New("private key wiped")
+
+type rsaPublicKey struct{ *rsa.PublicKey }
+
+func (k rsaPublicKey) Type() KeyType { return KeyRSA }
+func (k rsaPublicKey) Bytes() []byte { return x509.MarshalPKCS1PublicKey(k.PublicKey) }
+
+// rsaPrivateKey keeps the PKCS #1 encoding of the key.
+type rsaPrivateKey struct {
+	key *Key
+	pub *rsa.PublicKey
+}
+
+func (k rsaPrivateKey) Type() KeyType     { return KeyRSA }
+func (k rsaPrivateKey) Bytes() []byte     { return bytes.Clone(k.key.Bytes()) }
+func (k rsaPrivateKey) Public() PublicKey { return rsaPublicKey{k.pub} }
+func (k rsaPrivateKey) Wipe()             { k.key.Wipe() }
+
+// parse returns the key to use, which the caller clears with clearRSA.
+func (k rsaPrivateKey) parse() (*rsa.PrivateKey, error) {
+	b := k.key.Bytes()
+	if b == nil {
+		return nil, errWiped
+	}
+	return x509.ParsePKCS1PrivateKey(b)
+}
+
+// clearRSA zeroes the private values of a parsed key. The copies the
+// standard library precomputes cannot be reached, they are left to the
+// garbage collector.
+func clearRSA(k *rsa.PrivateKey) {
+	for _, x := range append([]*big.Int{k.D, k.Precomputed.Dp, k.Precomputed.Dq, k.Precomputed.Qinv}, k.Primes...) {
+		if x != nil {
+			clear(x.Bits())
+			x.SetInt64(0)
+		}
+	}
+}
+
+// x25519PublicKey holds both the X25519 and the Ed25519 public keys, which are
+// marshalled one after the other.
+type x25519PublicKey struct {
+	dh   *ecdh.PublicKey
+	sign ed25519.PublicKey
+}
+
+func (k x25519PublicKey) Type() KeyType { return KeyX25519 }
+func (k x25519PublicKey) Bytes() []byte { return append(k.dh.Bytes(), k.sign...) }
+
+// x25519PrivateKey keeps the X25519 key and the Ed25519 seed, one after the
+// other.
+type x25519PrivateKey struct {
+	key *Key
+	pub x25519PublicKey
+}
+
+func (k x25519PrivateKey) Type() KeyType     { return KeyX25519 }
+func (k x25519PrivateKey) Bytes() []byte     { return bytes.Clone(k.key.Bytes()) }
+func (k x25519PrivateKey) Public() PublicKey { return k.pub }
+func (k x25519PrivateKey) Wipe()             { k.key.Wipe() }
+
+func (k x25519PrivateKey) dh() (*ecdh.PrivateKey, error) {
+	b := k.key.Bytes()
+	if b == nil {
+		return nil, errWiped
+	}
+	return ecdh.X25519().NewPrivateKey(b[:32])
+}
+
+// signer returns the Ed25519 key expanded from the seed, which the caller
+// clears.
+func (k x25519PrivateKey) signer() (ed25519.PrivateKey, error) {
+	b := k.key.Bytes()
+	if b == nil {
+		return nil, errWiped
+	}
+	return ed25519.NewKeyFromSeed(b[32:]), nil
+}
+
+// GenerateKey returns a new key pair of the given type.
+func GenerateKey(t KeyType) (PrivateKey, error) {
+	switch t {
+	case KeyRSA:
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		defer clearRSA(k)
+		return ParsePrivateKey(KeyRSA, x509.MarshalPKCS1PrivateKey(k))
+	case KeyX25519:
+		dh, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		_, sign, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(sign)
+		return ParsePrivateKey(KeyX25519, append(dh.Bytes(), sign.Seed()...))
+	}
+	return nil, errKeyType
+}
+
+// DeriveKey returns the X25519 key pair derived from a secret, so that the
+// key pair can be recovered from the secret alone.
+func DeriveKey(secret []byte) (PrivateKey, error) {
+	seed := make([]byte, 32+ed25519.SeedSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("netsecfs derived key")), seed); err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(KeyX25519, seed)
+}
+
+func ParsePublicKey(t KeyType, data []byte) (PublicKey, error) {
+	switch t {
+	case KeyRSA:
+		k, err := x509.ParsePKCS1PublicKey(data)
+		if err != nil {
+			return nil, err
+		}
+		return rsaPublicKey{k}, nil
+	case KeyX25519:
+		if len(data) != 32+ed25519.PublicKeySize {
+			return nil, errors.New("invalid x25519 public key")
+		}
+		dh, err := ecdh.X25519().NewPublicKey(data[:32])
+		if err != nil {
+			return nil, err
+		}
+		return x25519PublicKey{dh: dh, sign: ed25519.PublicKey(data[32:])}, nil
+	}
+	return nil, errKeyType
+}
+
+// ParsePrivateKey moves a private key into locked memory: data is copied and
+// then zeroed.
+func ParsePrivateKey(t KeyType, data []byte) (PrivateKey, error) {
+	switch t {
+	case KeyRSA:
+		k, err := x509.ParsePKCS1PrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		clearRSA(k)
+		key, err := NewKey(data)
+		if err != nil {
+			return nil, err
+		}
+		return rsaPrivateKey{key: key, pub: &k.PublicKey}, nil
+	case KeyX25519:
+		if len(data) != 32+ed25519.SeedSize {
+			return nil, errors.New("invalid x25519 private key")
+		}
+		dh, err := ecdh.X25519().NewPrivateKey(data[:32])
+		if err != nil {
+			return nil, err
+		}
+		sign := ed25519.NewKeyFromSeed(data[32:])
+		pub := x25519PublicKey{dh: dh.PublicKey(), sign: sign.Public().(ed25519.PublicKey)}
+		clear(sign)
+		key, err := NewKey(data)
+		if err != nil {
+			return nil, err
+		}
+		return x25519PrivateKey{key: key, pub: pub}, nil
+	}
+	return nil, errKeyType
+}
@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrivateKeyWipe(t *testing.T) {
+	c := &CryptoHelper{}
+	for _, typ := range []KeyType{KeyRSA, KeyX25519} {
+		t.Run(typ.String(), func(t *testing.T) {
+			priv, err := GenerateKey(typ)
+			if err != nil {
+				t.Fatalf("GenerateKey: %s", err)
+			}
+			// a parsed copy works the same and leaves the bytes zeroed
+			data := priv.Bytes()
+			parsed, err := ParsePrivateKey(typ, data)
+			if err != nil {
+				t.Fatalf("ParsePrivateKey: %s", err)
+			}
+			if !bytes.Equal(data, make([]byte, len(data))) {
+				t.Fatal("the bytes parsed are left in memory")
+			}
+			if !bytes.Equal(parsed.Public().Bytes(), priv.Public().Bytes()) {
+				t.Fatal("the key parsed has another public key")
+			}
+			wrapped, err := c.Wrap(priv.Public(), []byte("secret"), []byte("ad"))
+			if err != nil {
+				t.Fatalf("Wrap: %s", err)
+			}
+			if plain, err := c.Unwrap(parsed, wrapped, []byte("ad")); err != nil || string(plain) != "secret" {
+				t.Fatalf("Unwrap = %q, %v", plain, err)
+			}
+			sign, err := c.Sign(parsed, []byte("data"))
+			if err != nil {
+				t.Fatalf("Sign: %s", err)
+			}
+			if err = c.Verify(priv.Public(), []byte("data"), sign); err != nil {
+				t.Fatalf("Verify: %s", err)
+			}
+
+			parsed.Wipe()
+			if _, err = c.Unwrap(parsed, wrapped, []byte("ad")); err == nil {
+				t.Fatal("Unwrap succeeded with a key wiped")
+			}
+			if _, err = c.Sign(parsed, []byte("data")); err == nil {
+				t.Fatal("Sign succeeded with a key wiped")
+			}
+			if parsed.Bytes() != nil {
+				t.Fatal("a key wiped still has bytes")
+			}
+			// wiping a copy leaves the key it was parsed from
+			if _, err = c.Unwrap(priv, wrapped, []byte("ad")); err != nil {
+				t.Fatalf("Unwrap: %s", err)
+			}
+			priv.Wipe()
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package crypto
+
+import "golang.org/x/sys/unix"
+
+// lockPages keeps memory out of swap and of core dumps.
+func lockPages(mem []byte) error {
+	if err := unix.Madvise(mem, unix.MADV_DONTDUMP); err != nil {
+		return err
+	}
+	return unix.Mlock(mem)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package crypto
+
+import "golang.org/x/sys/unix"
+
+// lockPages keeps memory out of swap, core dumps cannot be avoided here.
+func lockPages(mem []byte) error {
+	return unix.Mlock(mem)
+}
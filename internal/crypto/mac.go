@@ -0,0 +1,22 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// MAC authenticates data with HMAC-SHA256. The MAC key is derived from key,
+// so that the key of a directory or a file is not used both to encrypt and to
+// authenticate.
+func MAC(key, data []byte) []byte {
+	derive := hmac.New(sha256.New, key)
+	derive.Write([]byte("netsecfs mac"))
+	h := hmac.New(sha256.New, derive.Sum(nil))
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// VerifyMAC tells whether mac authenticates data under key, in constant time.
+func VerifyMAC(key, data, mac []byte) bool {
+	return hmac.Equal(MAC(key, data), mac)
+}
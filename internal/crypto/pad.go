@@ -0,0 +1,33 @@
+package crypto
+
+// nameBuckets are the lengths names are padded to before being encrypted, so
+// that a ciphertext only tells which bucket the length of its name is in.
+var nameBuckets = []int{16, 32, 64, 128, 256}
+
+// PadName pads a name up to the next bucket. A padded name starts with a zero
+// byte, which names never hold, to tell it from the names encrypted before.
+func PadName(name []byte) []byte {
+	size := len(name) + 1
+	for _, b := range nameBuckets {
+		if size <= b {
+			size = b
+			break
+		}
+	}
+	padded := make([]byte, size)
+	copy(padded[1:], name)
+	return padded
+}
+
+// UnpadName removes the padding of a decrypted name. It takes the error of
+// the decryption along, to be called on the result of Decrypt directly.
+func UnpadName(padded []byte, err error) ([]byte, error) {
+	if err != nil || len(padded) == 0 || padded[0] != 0 {
+		return padded, err
+	}
+	end := len(padded)
+	for end > 1 && padded[end-1] == 0 {
+		end--
+	}
+	return padded[1:end], nil
+}
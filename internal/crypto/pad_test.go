@@ -0,0 +1,64 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// maxName is meta.MaxName, which this package cannot import.
+const maxName = 255
+
+func TestPadName(t *testing.T) {
+	tests := []struct {
+		len, padded int
+	}{
+		{1, 16},
+		{15, 16},
+		{16, 32},
+		{31, 32},
+		{32, 64},
+		{63, 64},
+		{64, 128},
+		{127, 128},
+		{128, 256},
+		{maxName, 256},
+		{256, 257}, // longer than any bucket
+	}
+	for _, tt := range tests {
+		name := []byte(strings.Repeat("n", tt.len))
+		padded := PadName(name)
+		if len(padded) != tt.padded {
+			t.Errorf("PadName of %d bytes is %d bytes, want %d", tt.len, len(padded), tt.padded)
+		}
+		got, err := UnpadName(padded, nil)
+		if err != nil || !bytes.Equal(got, name) {
+			t.Errorf("UnpadName of %d bytes = %q, %v", tt.len, got, err)
+		}
+	}
+}
+
+func TestUnpadName(t *testing.T) {
+	failed := errors.New("decryption failed")
+	tests := []struct {
+		name   string
+		padded []byte
+		err    error
+		want   []byte
+	}{
+		{"legacy name", []byte("plain"), nil, []byte("plain")},
+		{"empty", []byte{}, nil, []byte{}},
+		{"padding only", make([]byte, 16), nil, []byte{}},
+		{"unpadded", []byte{0, 'a', 'b'}, nil, []byte("ab")},
+		{"error", []byte{0, 'a', 0}, failed, []byte{0, 'a', 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := UnpadName(tt.padded, tt.err)
+			if err != tt.err || !bytes.Equal(got, tt.want) {
+				t.Fatalf("UnpadName = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
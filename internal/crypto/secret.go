@@ -0,0 +1,193 @@
+package crypto
+
+import (
+	"os"
+	"sync"
+
+	"github.com/bastienvty/netsecfs/utils"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// MaxKeySize is the largest key a slot of an arena holds. Larger keys,
+	// such as RSA private keys, are given locked pages of their own.
+	MaxKeySize = 64
+	// arenaSize is the memory locked at once, split in slots of MaxKeySize.
+	arenaSize = 1 << 16
+)
+
+var logger = utils.GetLogger("netsecfs")
+
+// slot is a piece of locked memory holding a key. Its generation changes
+// whenever it is wiped, so that the keys it held no longer see it.
+type slot struct {
+	mem []byte
+	gen uint64
+}
+
+// vault hands out the slots of arenas of locked memory. The arenas are never
+// unmapped, a wiped slot is zeroed and reused.
+var vault struct {
+	sync.RWMutex
+	free     []*slot
+	large    []*slot // wiped slots larger than MaxKeySize
+	unlocked bool    // memory could not be locked, warned once
+}
+
+// lockedMem maps size bytes and locks them. The vault must be locked.
+func lockedMem(size int) ([]byte, error) {
+	mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockPages(mem); err != nil && !vault.unlocked {
+		vault.unlocked = true
+		logger.Warnf("Keys cannot be locked in memory and may be swapped: %s", err)
+	}
+	return mem, nil
+}
+
+// allocSlot returns a slot of at least size bytes.
+func allocSlot(size int) (*slot, error) {
+	vault.Lock()
+	defer vault.Unlock()
+	if size > MaxKeySize {
+		for i, s := range vault.large {
+			if len(s.mem) >= size {
+				vault.large = append(vault.large[:i], vault.large[i+1:]...)
+				return s, nil
+			}
+		}
+		page := os.Getpagesize()
+		mem, err := lockedMem((size + page - 1) / page * page)
+		if err != nil {
+			return nil, err
+		}
+		return &slot{mem: mem}, nil
+	}
+	if len(vault.free) == 0 {
+		mem, err := lockedMem(arenaSize)
+		if err != nil {
+			return nil, err
+		}
+		for off := 0; off < arenaSize; off += MaxKeySize {
+			vault.free = append(vault.free, &slot{mem: mem[off : off+MaxKeySize : off+MaxKeySize]})
+		}
+	}
+	s := vault.free[len(vault.free)-1]
+	vault.free = vault.free[:len(vault.free)-1]
+	return s, nil
+}
+
+// release zeroes a slot and gives it back. The vault must be locked.
+func (s *slot) release() {
+	clear(s.mem)
+	s.gen++
+	if len(s.mem) > MaxKeySize {
+		vault.large = append(vault.large, s)
+	} else {
+		vault.free = append(vault.free, s)
+	}
+}
+
+// Key is a secret key kept in locked memory, left out of swap and of core
+// dumps. It reads as nil once wiped. Its memory is only given back by Wipe,
+// or by wiping its keyring, never behind the back of its owner.
+type Key struct {
+	slot *slot
+	gen  uint64
+	size int
+	ring *Keyring
+}
+
+// NewKey moves a key into locked memory: b is copied and then zeroed.
+func NewKey(b []byte) (*Key, error) {
+	s, err := allocSlot(len(b))
+	if err != nil {
+		return nil, err
+	}
+	copy(s.mem, b)
+	clear(b)
+	return &Key{slot: s, gen: s.gen, size: len(b)}, nil
+}
+
+// Bytes returns the locked memory of the key, not a copy, so that the key
+// never leaves it. It must not be used once the key is wiped, which the owner
+// of the key only does when nothing uses it anymore.
+func (k *Key) Bytes() []byte {
+	if k == nil {
+		return nil
+	}
+	vault.RLock()
+	defer vault.RUnlock()
+	if k.slot.gen != k.gen {
+		return nil
+	}
+	return k.slot.mem[:k.size]
+}
+
+// Wipe zeroes the key and gives its memory back.
+func (k *Key) Wipe() {
+	if k == nil {
+		return
+	}
+	if k.ring != nil {
+		k.ring.forget(k.slot, k.gen)
+	}
+	vault.Lock()
+	defer vault.Unlock()
+	if k.slot.gen != k.gen {
+		return
+	}
+	k.slot.release()
+}
+
+// Keyring tracks the keys of a session, a logged in user or a mount, so that
+// they are all wiped at once when it ends.
+type Keyring struct {
+	mu   sync.Mutex
+	keys map[*slot]uint64 // generation of the slots of the live keys
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[*slot]uint64)}
+}
+
+// Key moves a key into locked memory, like NewKey, and tracks it.
+func (r *Keyring) Key(b []byte) (*Key, error) {
+	k, err := NewKey(b)
+	if err != nil {
+		return nil, err
+	}
+	k.ring = r
+	r.mu.Lock()
+	r.keys[k.slot] = k.gen
+	r.mu.Unlock()
+	return k, nil
+}
+
+func (r *Keyring) forget(s *slot, gen uint64) {
+	r.mu.Lock()
+	if r.keys[s] == gen {
+		delete(r.keys, s)
+	}
+	r.mu.Unlock()
+}
+
+// Wipe zeroes all the keys of the ring. Keys added afterwards are tracked again.
+func (r *Keyring) Wipe() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	keys := r.keys
+	r.keys = make(map[*slot]uint64)
+	r.mu.Unlock()
+	vault.Lock()
+	defer vault.Unlock()
+	for s, gen := range keys {
+		if s.gen == gen {
+			s.release()
+		}
+	}
+}
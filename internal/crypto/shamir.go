@@ -0,0 +1,96 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Shamir secret sharing over GF(2^8), byte by byte. A share is its x
+// coordinate, from 1 to 255, followed by one y coordinate per byte of the
+// secret.
+
+var errShares = errors.New("invalid shares")
+
+// gfMul multiplies in GF(2^8) with the polynomial of AES.
+func gfMul(a, b byte) byte {
+	var p byte
+	for b != 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the inverse of a non zero element, a^254.
+func gfInv(a byte) byte {
+	r := a
+	for i := 0; i < 6; i++ {
+		r = gfMul(gfMul(r, r), a)
+	}
+	return gfMul(r, r)
+}
+
+// SplitSecret splits a secret into n shares, any k of which recover it.
+func SplitSecret(secret []byte, n, k int) ([][]byte, error) {
+	if k < 1 || k > n || n > 255 {
+		return nil, errors.New("the threshold must be between 1 and the number of shares, at most 255")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, 1, 1+len(secret))
+		shares[i][0] = byte(i + 1)
+	}
+	coeffs := make([]byte, k)
+	for _, b := range secret {
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := shares[i][0]
+			// Horner's method, from the highest degree
+			var y byte
+			for j := k - 1; j >= 0; j-- {
+				y = gfMul(y, x) ^ coeffs[j]
+			}
+			shares[i] = append(shares[i], y)
+		}
+	}
+	return shares, nil
+}
+
+// CombineShares recovers a secret from shares. Given fewer shares than the
+// threshold, it returns a wrong secret rather than an error.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 || len(shares[0]) < 2 {
+		return nil, errShares
+	}
+	seen := make(map[byte]bool, len(shares))
+	for _, s := range shares {
+		if len(s) != len(shares[0]) || s[0] == 0 || seen[s[0]] {
+			return nil, errShares
+		}
+		seen[s[0]] = true
+	}
+	secret := make([]byte, len(shares[0])-1)
+	for i, si := range shares {
+		// Lagrange basis polynomial of share i evaluated at 0
+		basis := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				basis = gfMul(basis, gfMul(sj[0], gfInv(sj[0]^si[0])))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(basis, si[b+1])
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,86 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestShamir(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		name   string
+		n, k   int
+		pick   []int // indexes of the shares combined
+		splits bool
+		ok     bool // the secret is recovered
+		err    bool // combining fails
+	}{
+		{name: "threshold", n: 5, k: 3, pick: []int{0, 2, 4}, splits: true, ok: true},
+		{name: "all shares", n: 5, k: 3, pick: []int{4, 3, 2, 1, 0}, splits: true, ok: true},
+		{name: "one of one", n: 1, k: 1, pick: []int{0}, splits: true, ok: true},
+		{name: "any of n", n: 4, k: 1, pick: []int{3}, splits: true, ok: true},
+		{name: "n of n", n: 255, k: 255, pick: nil, splits: true, ok: true},
+		{name: "below threshold", n: 5, k: 3, pick: []int{1, 3}, splits: true},
+		{name: "duplicate x", n: 5, k: 3, pick: []int{0, 1, 1}, splits: true, err: true},
+		{name: "no shares", n: 5, k: 3, pick: []int{}, splits: true, err: true},
+		{name: "threshold above n", n: 3, k: 4},
+		{name: "zero threshold", n: 3, k: 0},
+		{name: "too many shares", n: 256, k: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares, err := SplitSecret(secret, tt.n, tt.k)
+			if !tt.splits {
+				if err == nil {
+					t.Fatalf("SplitSecret(%d, %d) succeeded", tt.n, tt.k)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SplitSecret(%d, %d): %s", tt.n, tt.k, err)
+			}
+			if len(shares) != tt.n {
+				t.Fatalf("got %d shares, want %d", len(shares), tt.n)
+			}
+			picked := shares
+			if tt.pick != nil {
+				picked = make([][]byte, 0, len(tt.pick))
+				for _, i := range tt.pick {
+					picked = append(picked, shares[i])
+				}
+			}
+			got, err := CombineShares(picked)
+			if tt.err {
+				if err == nil {
+					t.Fatal("CombineShares succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CombineShares: %s", err)
+			}
+			if bytes.Equal(got, secret) != tt.ok {
+				t.Fatalf("recovered %x, want the secret %v", got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCombineSharesMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"empty share", [][]byte{{}}},
+		{"x only", [][]byte{{1}}},
+		{"zero x", [][]byte{{0, 1}, {1, 2}}},
+		{"lengths differ", [][]byte{{1, 1, 2}, {2, 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CombineShares(tt.shares); err == nil {
+				t.Fatal("CombineShares succeeded")
+			}
+		})
+	}
+}
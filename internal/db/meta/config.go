@@ -1,6 +1,8 @@
 package meta
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 )
@@ -10,16 +12,104 @@ type Format struct {
 	UUID      string
 	Storage   string
 	BlockSize int
-	Capacity  uint64 `json:",omitempty"`
+	Capacity  uint64  `json:",omitempty"`
+	Cipher    string  `json:",omitempty"` // AEAD of new ciphertexts, aes-gcm if empty
+	Kdf       *Kdf    `json:",omitempty"` // parameters of new master keys
+	Escrow    *Escrow `json:",omitempty"`
+	PadSizes  bool    `json:",omitempty"` // pad the content of files and hide their exact size
+	// EncryptAttrs keeps the sizes, modes, times and owners of the nodes
+	// encrypted with their keys. It implies PadSizes.
+	EncryptAttrs bool `json:",omitempty"`
+	// Compression is the algorithm chunks are compressed with before being
+	// encrypted. Chunks of volumes created before it have no header.
+	Compression string `json:",omitempty"`
+	// Dedup stores the chunks by their hash, with keys derived from their
+	// content, so that the equal chunks of a tree are stored once
+	Dedup bool `json:",omitempty"`
+}
+
+const KdfArgon2id = "argon2id"
+
+// Kdf is the function a master key is derived from a password with, along its
+// parameters. It is stored per user, so that they can change.
+type Kdf struct {
+	Algo        string
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	// Keyfile tells that the master key is derived from a key file as well,
+	// which is never set for the defaults of a volume.
+	Keyfile bool `json:",omitempty"`
+}
+
+// Stronger returns the parameters that are at least as costly as both k and o,
+// keeping whether k needs a key file.
+func (k Kdf) Stronger(o Kdf) Kdf {
+	return Kdf{
+		Algo:        k.Algo,
+		Keyfile:     k.Keyfile,
+		Memory:      max(k.Memory, o.Memory),
+		Iterations:  max(k.Iterations, o.Iterations),
+		Parallelism: max(k.Parallelism, o.Parallelism),
+	}
+}
+
+// Escrow is the public key the keys of every user are wrapped for, whose
+// private key is split among administrators so that Threshold of the Shares
+// are needed to recover it.
+type Escrow struct {
+	PubKey    []byte
+	Shares    int
+	Threshold int
+}
+
+// equal tells whether e and o are the same escrow key, split the same way.
+func (e *Escrow) equal(o *Escrow) bool {
+	if e == nil || o == nil {
+		return e == o
+	}
+	return bytes.Equal(e.PubKey, o.PubKey) && e.Shares == o.Shares && e.Threshold == o.Threshold
+}
+
+func (e *Escrow) String() string {
+	if e == nil {
+		return "none"
+	}
+	sum := sha256.Sum256(e.PubKey)
+	return fmt.Sprintf("%x split in %d shares, %d needed", sum[:8], e.Shares, e.Threshold)
+}
+
+func (k Kdf) String() string {
+	s := fmt.Sprintf("%s m=%dMiB t=%d p=%d", k.Algo, k.Memory/1024, k.Iterations, k.Parallelism)
+	if k.Keyfile {
+		s += " with key file"
+	}
+	return s
 }
 
 func (f *Format) update(old *Format) error {
+	// volumes formatted before encrypted attributes implied padded sizes
+	// are padded from then on
+	if old.EncryptAttrs {
+		old.PadSizes = true
+	}
 	var args []interface{}
 	switch {
 	case f.Name != old.Name:
 		args = []interface{}{"name", old.Name, f.Name}
 	case f.BlockSize != old.BlockSize:
 		args = []interface{}{"block size", old.BlockSize, f.BlockSize}
+	// the data already stored depends on the ones below
+	case f.PadSizes != old.PadSizes:
+		args = []interface{}{"padded sizes", old.PadSizes, f.PadSizes}
+	case f.EncryptAttrs != old.EncryptAttrs:
+		args = []interface{}{"encrypted attributes", old.EncryptAttrs, f.EncryptAttrs}
+	case f.Compression != old.Compression:
+		args = []interface{}{"compression", old.Compression, f.Compression}
+	case f.Dedup != old.Dedup:
+		args = []interface{}{"deduplication", old.Dedup, f.Dedup}
+	case !f.Escrow.equal(old.Escrow):
+		args = []interface{}{"escrow", old.Escrow, f.Escrow}
 	}
 	if args == nil {
 		f.UUID = old.UUID
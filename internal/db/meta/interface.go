@@ -2,6 +2,9 @@ package meta
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
 	"strconv"
 	"syscall"
 	"time"
@@ -29,6 +32,17 @@ const (
 
 const MaxName = 255
 
+const (
+	// PermRead allows to list and read a shared tree
+	PermRead = 1 << iota
+	// PermWrite allows to create, modify and remove entries of a shared tree
+	PermWrite
+	// PermReshare allows to share the tree with other users
+	PermReshare
+
+	PermAll = PermRead | PermWrite | PermReshare
+)
+
 type Ino uint64
 
 const RootInode Ino = 1
@@ -61,8 +75,13 @@ type Attr struct {
 	Nlink     uint32 // number of links (sub-directories or hardlinks)
 	Length    uint64 // length of regular file
 
-	Parent Ino  // inode of parent; 0 means tracked by parentKey (for hardlinks)
-	Full   bool // the attributes are completed or not
+	Parent Ino    // inode of parent; 0 means tracked by parentKey (for hardlinks)
+	Owner  uint32 // user who created the node
+	Full   bool   // the attributes are completed or not
+	// Sealed holds the attributes serialized by HiddenAttr and encrypted with
+	// the key of the node, when the volume hides them. The fields it hides
+	// are zero until it is opened.
+	Sealed []byte
 }
 
 func typeToStatType(_type uint8) uint32 {
@@ -108,7 +127,177 @@ type Entry struct {
 	Inode Ino
 	Name  []byte
 	Key   []byte
+	Group uint32 // group the key is wrapped for, for the entries of /shared
 	Attr  *Attr
+	// Mac and Version are the MAC of the child list of a directory, or the
+	// MAC and the version of the content of a file, that the list of its
+	// parent authenticates. Detached directories are left out.
+	Mac      []byte
+	Version  uint64
+	Detached bool
+}
+
+// Share is a directory shared with a user, or with a group when Group is set.
+type Share struct {
+	Inode  Ino
+	User   uint32
+	Group  uint32
+	Owner  uint32 // owner of the directory
+	Sharer uint32 // user who shared it, the owner or a recipient resharing it
+	Name   []byte
+	Key    []byte
+	Perm   uint8
+	// Expires is the unix time the share expires at, 0 if it never does.
+	Expires int64
+}
+
+// Group is a set of users sharing a key pair, so that a directory can be
+// shared with all of them at once.
+type Group struct {
+	Id      uint32
+	Name    string
+	Owner   uint32
+	PubKey  []byte
+	KeyType uint8
+}
+
+// Member is a user of a group with the private key of the group wrapped for it.
+type Member struct {
+	Group uint32
+	User  uint32
+	Key   []byte
+}
+
+// Sealer computes the MAC of the child list of a directory, as serialized by
+// ChildList. It returns nil when it does not hold the key of the directory,
+// which ends the chain of MACs there.
+type Sealer func(inode Ino, list []byte) ([]byte, error)
+
+// ChildList serializes the entries of a directory, ordered by inode, so that
+// they can be authenticated: a dropped, added or replaced entry changes it.
+// The MACs of the children, and the versions of the files, are part of it, so
+// that the MAC of the root of a user chains every directory and file below it
+// and none can be rolled back alone. The /shared entry of the root, which is
+// the same for every user, is left out.
+func ChildList(inode Ino, entries []*Entry) []byte {
+	list := binary.BigEndian.AppendUint64([]byte("netsecfs dir\x01"), uint64(inode))
+	for _, e := range sortEntries(entries) {
+		list = appendEntry(list, e)
+		if e.Detached {
+			list = append(list, 1)
+			continue
+		}
+		list = append(list, 0)
+		list = binary.BigEndian.AppendUint64(list, e.Version)
+		list = binary.BigEndian.AppendUint32(list, uint32(len(e.Mac)))
+		list = append(list, e.Mac...)
+	}
+	return list
+}
+
+// LegacyChildList serializes the entries of a directory as they were before
+// the MACs of the children were chained, for the trees not sealed yet.
+func LegacyChildList(inode Ino, entries []*Entry) []byte {
+	list := binary.BigEndian.AppendUint64([]byte("netsecfs dir\x00"), uint64(inode))
+	for _, e := range sortEntries(entries) {
+		list = appendEntry(list, e)
+	}
+	return list
+}
+
+func sortEntries(entries []*Entry) []*Entry {
+	sorted := make([]*Entry, 0, len(entries))
+	for _, e := range entries {
+		if e.Inode != SharedInode {
+			sorted = append(sorted, e)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Inode < sorted[j].Inode })
+	return sorted
+}
+
+func appendEntry(list []byte, e *Entry) []byte {
+	list = binary.BigEndian.AppendUint64(list, uint64(e.Inode))
+	list = append(list, e.Attr.Typ)
+	list = binary.BigEndian.AppendUint32(list, uint32(len(e.Name)))
+	list = append(list, e.Name...)
+	list = binary.BigEndian.AppendUint32(list, uint32(len(e.Key)))
+	return append(list, e.Key...)
+}
+
+// hiddenAttrSize is the length of the attributes serialized by HiddenAttr.
+const hiddenAttrSize = 1 + 2 + 8 + 3*(8+4) + 4
+
+var errHiddenAttr = errors.New("invalid hidden attributes")
+
+// HiddenAttr serializes the attributes a volume with encrypted attributes
+// hides from the meta store: the mode, the length, the times and the owner.
+func HiddenAttr(attr *Attr) []byte {
+	b := make([]byte, 1, hiddenAttrSize)
+	b[0] = 1 // version of the layout
+	b = binary.BigEndian.AppendUint16(b, attr.Mode)
+	b = binary.BigEndian.AppendUint64(b, attr.Length)
+	b = binary.BigEndian.AppendUint64(b, uint64(attr.Atime))
+	b = binary.BigEndian.AppendUint32(b, attr.Atimensec)
+	b = binary.BigEndian.AppendUint64(b, uint64(attr.Mtime))
+	b = binary.BigEndian.AppendUint32(b, attr.Mtimensec)
+	b = binary.BigEndian.AppendUint64(b, uint64(attr.Ctime))
+	b = binary.BigEndian.AppendUint32(b, attr.Ctimensec)
+	return binary.BigEndian.AppendUint32(b, attr.Owner)
+}
+
+// ParseHiddenAttr sets the attributes serialized by HiddenAttr.
+func ParseHiddenAttr(b []byte, attr *Attr) error {
+	if len(b) != hiddenAttrSize || b[0] != 1 {
+		return errHiddenAttr
+	}
+	attr.Mode = binary.BigEndian.Uint16(b[1:])
+	attr.Length = binary.BigEndian.Uint64(b[3:])
+	attr.Atime = int64(binary.BigEndian.Uint64(b[11:]))
+	attr.Atimensec = binary.BigEndian.Uint32(b[19:])
+	attr.Mtime = int64(binary.BigEndian.Uint64(b[23:]))
+	attr.Mtimensec = binary.BigEndian.Uint32(b[31:])
+	attr.Ctime = int64(binary.BigEndian.Uint64(b[35:]))
+	attr.Ctimensec = binary.BigEndian.Uint32(b[43:])
+	attr.Owner = binary.BigEndian.Uint32(b[47:])
+	return nil
+}
+
+// Recovery is the public key of the recovery key of a user, or of the escrow
+// key of the volume, and the root key and the private key of the user wrapped
+// for it.
+type Recovery struct {
+	PubKey  []byte
+	RootKey []byte
+	PrivKey []byte
+}
+
+// Rekey is a node whose key was replaced by a rekey while its children or its
+// content key are still protected by its old key, kept under the new one.
+type Rekey struct {
+	Inode  Ino
+	OldKey []byte
+}
+
+// RekeyStep is a step of a rekey, applied in a single transaction so that the
+// rekey can resume from the nodes left pending.
+type RekeyStep struct {
+	Done    Ino    // node whose children or content key were rekeyed, 0 if none
+	RootKey []byte // new root key of the user encrypted with its master key, nil if kept
+	Entries []KeyUpdate
+	Shares  []Share
+	Pending []Rekey
+	Sealed  Ino    // directory whose MAC is computed again, 0 if none
+	Listed  []byte // MAC of the list of Sealed the entries were read along, nil if not checked
+}
+
+// KeyUpdate is the new encrypted name and wrapped key of an entry, along its
+// attributes sealed with the new key when they are hidden.
+type KeyUpdate struct {
+	Inode Ino
+	Name  []byte
+	Key   []byte
+	Attrs []byte
 }
 
 // Meta is a interface for a meta service for file system.
@@ -122,35 +311,118 @@ type Meta interface {
 	Load() (*Format, error)
 	GetNextInode(ctx context.Context, lastIno *Ino) error
 	GetUserId(username string, uid *uint32) error
-	GetUserPublicKey(username string, pubKey *[]byte) error
+	GetUserName(uid uint32, username *string) error
+	GetUserPublicKey(username string, keyType *uint8, pubKey *[]byte) error
+	SetUserPublicKey(username string, keyType uint8, pubKey []byte) error
+	// GetUserSignature returns the signature of the user record, if it has been signed.
+	GetUserSignature(username string, sign *[]byte) error
+	SetUserSignature(username string, sign []byte) error
 
 	// Lookup returns the inode and attributes for the given entry in a directory.
 	Lookup(ctx context.Context, userId uint32, parent, inode Ino, attr *Attr) syscall.Errno
 	// GetAttr returns the attributes for given node.
 	GetAttr(ctx context.Context, inode Ino, attr *Attr) syscall.Errno
-	// SetAttr updates the attributes for given node.
-	SetAttr(ctx context.Context, inode Ino, in *fuse.SetAttrIn, attr *Attr) syscall.Errno
+	// SetAttr updates the attributes for given node, which the user must be
+	// allowed to write.
+	SetAttr(ctx context.Context, userId uint32, inode Ino, in *fuse.SetAttrIn, attr *Attr) syscall.Errno
 	// Unlink removes a file entry from a directory.
 	// The file will be deleted if it's not linked by any entries and not open by any sessions.
-	Unlink(ctx context.Context, parent, inode Ino) syscall.Errno
+	// The MAC of the parent, and of its ancestors, is computed by seal, unless
+	// nil, in the same transaction.
+	Unlink(ctx context.Context, userId uint32, parent, inode Ino, seal Sealer) syscall.Errno
 	// Rmdir removes an empty sub-directory.
-	Rmdir(ctx context.Context, parent, inode Ino) syscall.Errno
+	Rmdir(ctx context.Context, userId uint32, parent, inode Ino, seal Sealer) syscall.Errno
 	// Readdir returns all entries for given directory, which include attributes if plus is true.
 	Readdir(ctx context.Context, inode Ino, userId uint32, entries *[]*Entry) syscall.Errno
-	Mknod(ctx context.Context, parent Ino, _type uint8, mode, id uint32, inode *Ino, name, key []byte, attr *Attr) syscall.Errno
-	// Write put a slice of data on top of the given chunk.
-	Write(ctx context.Context, inode uint64, data []byte, off int64) syscall.Errno
+	// ReadDirMac is Readdir along the MAC of the directory, read at once so
+	// that a concurrent write never makes them differ. The shared directory
+	// has no MAC.
+	ReadDirMac(ctx context.Context, inode Ino, userId uint32, entries *[]*Entry, mac *[]byte) syscall.Errno
+	// Mknod creates a file or a directory. The MAC of a new directory and the
+	// ones of its ancestors are computed by seal, unless nil, in the same
+	// transaction.
+	Mknod(ctx context.Context, parent Ino, _type uint8, mode, id uint32, inode *Ino, name, key []byte, attr *Attr, seal Sealer) syscall.Errno
+	// SealDir stores the MAC of the child list of a directory, computed by
+	// seal, and the ones of its ancestors as far as seal holds their keys. The
+	// root has a MAC per user, over the entries of the user.
+	SealDir(userId uint32, inode Ino, seal Sealer) error
+	// SealContent records the version and the MAC of the content of a file
+	// just committed and computes the MACs of its ancestors by seal.
+	SealContent(userId uint32, inode Ino, version uint64, mac []byte, seal Sealer) error
+	// GetDirMac returns the MAC of a directory, nil if it has never been sealed.
+	GetDirMac(userId uint32, inode Ino, mac *[]byte) error
+	// UpdateAttr changes the attributes of a file or a directory the user can
+	// write in a transaction. update is given the stored attributes, opens
+	// them if sealed, changes them and seals them again in attr.Sealed. The
+	// attributes sealed replace the ones kept in the clear.
+	UpdateAttr(ctx context.Context, userId uint32, inode Ino, attr *Attr, update func(attr *Attr) error) syscall.Errno
+	// Extend grows the length of a file up to length, and sets its time of
+	// modification, once its content is written.
+	Extend(ctx context.Context, userId uint32, inode Ino, length uint64) syscall.Errno
 	GetKey(ctx context.Context, inode Ino, key *[]byte) syscall.Errno
-	GetSharedKey(ctx context.Context, userdId uint32, inode Ino, key *[]byte) syscall.Errno
+	// GetShare returns how a directory is shared with the user, directly or through one of its groups.
+	GetShare(ctx context.Context, userdId uint32, inode Ino, share *Share) syscall.Errno
 
 	CheckUser(username string) error
-	CreateUser(username string, password, salt, rootKey, privKey, pubKey []byte) error
-	VerifyUser(username string, password []byte, rootKey, privKey *[]byte) error
-	GetSalt(username string, salt *[]byte) error
-	ChangePassword(username string, password, salt, rootKey, privKey []byte) error
-	ShareDir(user uint32, inode Ino, name, key []byte) error
-	UnshareDir(user uint32, inode Ino) error
+	// CreateUser creates a user whose empty root is sealed by seal.
+	CreateUser(username string, password, salt, rootKey, privKey, pubKey []byte, keyType uint8, kdf Kdf, seal Sealer) error
+	VerifyUser(username string, password []byte, rootKey, privKey *[]byte, keyType *uint8) error
+	// GetSalt returns the salt and the KDF the master key of the user is derived with.
+	GetSalt(username string, salt *[]byte, kdf *Kdf) error
+	ChangePassword(username string, password, salt, rootKey, privKey []byte, kdf Kdf) error
+	// SetRecovery replaces the recovery key of a user, nil fields remove it.
+	SetRecovery(username string, recovery *Recovery) error
+	GetRecovery(username string, recovery *Recovery) error
+	// SetEscrow replaces the keys of a user wrapped for the escrow key of the volume.
+	SetEscrow(username string, escrow *Recovery) error
+	GetEscrow(username string, escrow *Recovery) error
+	// ShareDir shares a directory on behalf of sharer with a user or a group.
+	// The permissions granted cannot exceed the ones sharer holds on it. A
+	// directory shared with write access is detached from the MAC of its
+	// parent from then on, which is computed again by seal.
+	ShareDir(sharer uint32, share *Share, seal Sealer) error
+	UnshareDir(inode Ino, user, group uint32) error
+	// GetShares returns the users a directory is shared with.
+	GetShares(inode Ino, shares *[]Share) error
+	// GetSharesOut returns the shares made by the user.
+	GetSharesOut(sharer uint32, shares *[]Share) error
+	// GetSharesIn returns the directories shared with the user.
+	GetSharesIn(userId uint32, shares *[]Share) error
+	// GetGroupShares returns the directories shared with a group.
+	GetGroupShares(group uint32, shares *[]Share) error
+	// GetExpiredShares returns the shares made by sharer that expired at now.
+	GetExpiredShares(sharer uint32, now int64, shares *[]Share) error
+	// PruneShares deletes the expired shares made by sharer, only the ones of
+	// inode unless it is 0.
+	PruneShares(sharer uint32, now int64, inode Ino, pruned *[]Share) error
+	// Rekey applies a step of a rekey of the keys of a user. The MAC of the
+	// Sealed directory is computed by seal in the same transaction. It fails
+	// with syscall.EAGAIN when the list of Sealed no longer has the MAC
+	// Listed, as another client changed it since it was read.
+	Rekey(userId uint32, step *RekeyStep, seal Sealer) error
+	// GetRekeys returns the nodes left pending by an interrupted rekey, in order.
+	GetRekeys(userId uint32, pending *[]Rekey) error
 	GetPathKey(inode Ino, keys *[][]byte) error
+	// GetPath returns the entries from inode up to the root, with their names,
+	// keys and sealed attributes.
+	GetPath(inode Ino, entries *[]*Entry) error
+
+	// CreateGroup creates a group whose first member is its owner. The key of
+	// the owner is wrapped by seal once the id of the group is known.
+	CreateGroup(group *Group, seal func(id uint32) ([]byte, error)) error
+	GetGroup(name string, group *Group) error
+	GetGroupById(id uint32, group *Group) error
+	GetMembers(group uint32, members *[]Member) error
+	// GetMemberships returns the groups the user is a member of.
+	GetMemberships(userId uint32, members *[]Member) error
+	// AddMember adds a user to a group of owner.
+	AddMember(owner uint32, member *Member) error
+	// RotateGroup replaces the key pair of a group of owner: its members are
+	// replaced by the given ones and its shares are wrapped for the new key.
+	RotateGroup(owner uint32, group *Group, members []Member, shares []Share) error
+	// MigrateUserKey replaces the key pair of a user along with the keys of the
+	// directories shared with it and of the groups it belongs to.
+	MigrateUserKey(userId uint32, keyType uint8, privKey, pubKey, sign []byte, shares []Share, members []Member) error
 }
 
 func RegisterMeta(addr string) Meta {
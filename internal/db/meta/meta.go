@@ -9,6 +9,7 @@ import (
 	"log"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -36,6 +37,9 @@ type edge struct {
 	Inode  Ino    `xorm:"index notnull"`
 	Type   uint8  `xorm:"notnull"`
 	Key    []byte
+	// Detached is set once the directory is shared with write access, as its
+	// recipients change its MAC without the keys of its ancestors
+	Detached bool `xorm:"notnull default false"`
 }
 
 type node struct {
@@ -53,12 +57,17 @@ type node struct {
 	Rdev      uint32
 	Parent    Ino
 	Owner     uint32
+	Mac       []byte // MAC of the child list of a directory, of the content of a file
+	Version   uint64 `xorm:"notnull default 0"` // version of the content of a file
+	Attrs     []byte // attributes encrypted with the key of the node, when hidden
 }
 
 type namedNode struct {
-	node `xorm:"extends"`
-	Name []byte `xorm:"varbinary(255)"`
-	Key  []byte
+	node     `xorm:"extends"`
+	Name     []byte `xorm:"varbinary(255)"`
+	Key      []byte
+	Group    uint32
+	Detached bool
 }
 
 type user struct {
@@ -69,14 +78,64 @@ type user struct {
 	RootKey  []byte `xorm:"notnull"`
 	PrKey    []byte `xorm:"notnull"`
 	PubKey   []byte `xorm:"notnull"`
+	KeyType  uint8  `xorm:"notnull default 0"` // algorithms of the key pair
+	Sign     []byte // signature of the user record by its private key
+	RootMac  []byte // MAC of the entries of the user at the root
+	// KDF of the master key, users created before it was stored used these defaults
+	Kdf            string `xorm:"varchar(32) notnull default 'argon2id'"`
+	KdfMemory      uint32 `xorm:"notnull default 524288"`
+	KdfIterations  uint32 `xorm:"notnull default 5"`
+	KdfParallelism uint8  `xorm:"notnull default 2"`
+	KdfKeyfile     bool   `xorm:"notnull default false"` // a key file is needed along the password
+	// public key of the recovery key and the keys of the user wrapped for it
+	RecoveryPub   []byte
+	RecoveryRoot  []byte
+	RecoveryPrKey []byte
+	// escrow public key of the volume and the keys of the user wrapped for it
+	EscrowPub   []byte
+	EscrowRoot  []byte
+	EscrowPrKey []byte
 }
 
 type shared struct {
-	Id    int64  `xorm:"pk autoincr"`
-	Inode Ino    `xorm:"notnull"`
-	Name  []byte `xorm:"unique(edge) varbinary(255) notnull"`
-	User  uint32 `xorm:"notnull"`
-	Key   []byte `xorm:"notnull"`
+	Id      int64  `xorm:"pk autoincr"`
+	Inode   Ino    `xorm:"notnull"`
+	Name    []byte `xorm:"unique(edge) varbinary(255) notnull"`
+	User    uint32 `xorm:"notnull"`
+	GroupId uint32 `xorm:"notnull default 0"`
+	Key     []byte `xorm:"notnull"`
+	Perm    uint8  `xorm:"notnull default 3"`
+	Expires int64  `xorm:"notnull default 0"` // unix time, 0 if the share does not expire
+	// Sharer is the user who shared the directory, its owner or a recipient
+	// allowed to reshare it. Shares made before it was stored have none.
+	Sharer uint32 `xorm:"notnull default 0"`
+}
+
+// rekey is the checkpoint of a rekey: a node whose key was replaced while its
+// children or its content key are still protected by its old key.
+type rekey struct {
+	Id     int64  `xorm:"pk autoincr"`
+	User   uint32 `xorm:"unique(rekey) notnull"`
+	Inode  Ino    `xorm:"unique(rekey) notnull"`
+	OldKey []byte `xorm:"notnull"`
+}
+
+// notExpired selects the shares that did not expire at the given time.
+const notExpired = "(expires = 0 OR expires > ?)"
+
+type group struct {
+	Id      uint32 `xorm:"pk autoincr"`
+	Name    string `xorm:"notnull unique"`
+	Owner   uint32 `xorm:"notnull"`
+	PubKey  []byte `xorm:"notnull"`
+	KeyType uint8  `xorm:"notnull default 0"`
+}
+
+type member struct {
+	Id      int64  `xorm:"pk autoincr"`
+	GroupId uint32 `xorm:"unique(member) notnull"`
+	User    uint32 `xorm:"unique(member) notnull"`
+	Key     []byte `xorm:"notnull"`
 }
 
 type dbMeta struct {
@@ -115,6 +174,10 @@ func (m *dbMeta) Load() (*Format, error) {
 	if err = json.Unmarshal(body, format); err != nil {
 		return nil, fmt.Errorf("json: %s", err)
 	}
+	// add the columns introduced since the volume was formatted
+	if err = m.syncTables(); err != nil {
+		return nil, err
+	}
 	m.Lock()
 	m.fmt = format
 	m.Unlock()
@@ -138,7 +201,7 @@ func (m *dbMeta) doLoad() (data []byte, err error) {
 	return
 }
 
-func (m *dbMeta) Init(format *Format) error {
+func (m *dbMeta) syncTables() error {
 	if err := m.db.Sync2(new(setting)); err != nil {
 		return fmt.Errorf("create table setting: %s", err)
 	}
@@ -148,6 +211,19 @@ func (m *dbMeta) Init(format *Format) error {
 	if err := m.db.Sync2(new(user), new(shared)); err != nil {
 		return fmt.Errorf("create table user, shared: %s", err)
 	}
+	if err := m.db.Sync2(new(group), new(member)); err != nil {
+		return fmt.Errorf("create table group, member: %s", err)
+	}
+	if err := m.db.Sync2(new(rekey)); err != nil {
+		return fmt.Errorf("create table rekey: %s", err)
+	}
+	return nil
+}
+
+func (m *dbMeta) Init(format *Format) error {
+	if err := m.syncTables(); err != nil {
+		return err
+	}
 
 	var s = setting{Name: "format"}
 	var ok bool
@@ -243,6 +319,8 @@ func (m *dbMeta) parseAttr(n *node, attr *Attr) {
 	attr.Length = n.Length
 	attr.Rdev = n.Rdev
 	attr.Parent = n.Parent
+	attr.Owner = n.Owner
+	attr.Sealed = n.Attrs
 	attr.Full = true
 }
 
@@ -262,6 +340,24 @@ func (m *dbMeta) parseNode(attr *Attr, n *node) {
 	n.Length = attr.Length
 	n.Rdev = attr.Rdev
 	n.Parent = attr.Parent
+	n.Attrs = attr.Sealed
+}
+
+// hiddenCols are the columns of a node whose values are sealed in its
+// attributes when the volume hides them.
+var hiddenCols = []string{"attrs", "mode", "length", "owner", "atime", "mtime", "ctime", "atimensec", "mtimensec", "ctimensec"}
+
+// hideAttr replaces the attributes of a node by their sealed version. The
+// owner of the directories and of the entries of the root is kept, as
+// permissions and shares are checked with it.
+func hideAttr(n *node, sealed []byte) {
+	n.Attrs = sealed
+	n.Mode, n.Length = 0, 0
+	n.Atime, n.Mtime, n.Ctime = 0, 0, 0
+	n.Atimensec, n.Mtimensec, n.Ctimensec = 0, 0, 0
+	if n.Type != TypeDirectory && n.Parent != RootInode {
+		n.Owner = 0
+	}
 }
 
 func mustInsert(s *xorm.Session, beans ...interface{}) error {
@@ -323,7 +419,11 @@ func (m *dbMeta) roTxn(f func(s *xorm.Session) error) error {
 
 	var lastErr error
 	for i := 0; i < 50; i++ {
-		err := f(s)
+		// the reads see the database as of one point in time
+		err := s.Begin()
+		if err == nil {
+			err = f(s)
+		}
 		if eno, ok := err.(syscall.Errno); ok && eno == 0 {
 			err = nil
 		}
@@ -342,16 +442,39 @@ func (m *dbMeta) roTxn(f func(s *xorm.Session) error) error {
 	return lastErr
 }
 
+// GetNextInode reserves a new inode number. The counter is kept in the
+// settings so that users mounting the volume at the same time never get the
+// same inode.
 func (m *dbMeta) GetNextInode(ctx context.Context, lastIno *Ino) error {
-	return m.roTxn(func(s *xorm.Session) error {
+	return m.txn(func(s *xorm.Session) error {
+		var ino Ino
+		counter := setting{Name: "nextInode"}
+		ok, err := s.Get(&counter)
+		if err != nil {
+			return err
+		}
+		if ok {
+			v, err := strconv.ParseUint(counter.Value, 10, 64)
+			if err != nil {
+				return err
+			}
+			ino = Ino(v)
+		}
 		var n node
 		if _, err := s.Desc("Inode").Get(&n); err != nil {
 			return err
 		}
-		ino := n.Inode
-		ino++
+		if ino <= n.Inode {
+			ino = n.Inode + 1
+		}
+		counter.Value = strconv.FormatUint(uint64(ino+1), 10)
+		if ok {
+			_, err = s.Update(&counter, &setting{Name: counter.Name})
+		} else {
+			_, err = s.Insert(&counter)
+		}
 		*lastIno = ino
-		return nil
+		return err
 	})
 }
 
@@ -368,7 +491,20 @@ func (m *dbMeta) GetUserId(username string, uid *uint32) error {
 	})
 }
 
-func (m *dbMeta) GetUserPublicKey(username string, pubKey *[]byte) error {
+func (m *dbMeta) GetUserName(uid uint32, username *string) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var u = user{Id: uid}
+		if ok, err := s.Get(&u); err != nil {
+			return err
+		} else if !ok {
+			return syscall.ENOENT
+		}
+		*username = u.Username
+		return nil
+	})
+}
+
+func (m *dbMeta) GetUserPublicKey(username string, keyType *uint8, pubKey *[]byte) error {
 	return m.roTxn(func(s *xorm.Session) error {
 		var u = user{Username: username}
 		if ok, err := s.Get(&u); err != nil {
@@ -376,11 +512,45 @@ func (m *dbMeta) GetUserPublicKey(username string, pubKey *[]byte) error {
 		} else if !ok {
 			return syscall.ENOENT
 		}
+		*keyType = u.KeyType
 		*pubKey = u.PubKey
 		return nil
 	})
 }
 
+func (m *dbMeta) GetUserSignature(username string, sign *[]byte) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var u = user{Username: username}
+		if ok, err := s.Get(&u); err != nil {
+			return err
+		} else if !ok {
+			return syscall.ENOENT
+		}
+		*sign = u.Sign
+		return nil
+	})
+}
+
+func (m *dbMeta) SetUserPublicKey(username string, keyType uint8, pubKey []byte) error {
+	return m.txn(func(s *xorm.Session) error {
+		n, err := s.Cols("pub_key", "key_type").Update(&user{PubKey: pubKey, KeyType: keyType}, &user{Username: username})
+		if err == nil && n == 0 {
+			return syscall.ENOENT
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) SetUserSignature(username string, sign []byte) error {
+	return m.txn(func(s *xorm.Session) error {
+		n, err := s.Cols("sign").Update(&user{Sign: sign}, &user{Username: username})
+		if err == nil && n == 0 {
+			return syscall.ENOENT
+		}
+		return err
+	})
+}
+
 func (m *dbMeta) GetAttr(ctx context.Context, inode Ino, attr *Attr) syscall.Errno {
 	return errno(m.roTxn(func(s *xorm.Session) error {
 		var n = node{Inode: inode}
@@ -395,7 +565,7 @@ func (m *dbMeta) GetAttr(ctx context.Context, inode Ino, attr *Attr) syscall.Err
 	}))
 }
 
-func (m *dbMeta) SetAttr(ctx context.Context, inode Ino, in *fuse.SetAttrIn, attr *Attr) syscall.Errno {
+func (m *dbMeta) SetAttr(ctx context.Context, userId uint32, inode Ino, in *fuse.SetAttrIn, attr *Attr) syscall.Errno {
 	return errno(m.txn(func(s *xorm.Session) error {
 		var cur = node{Inode: inode}
 		ok, err := s.Get(&cur)
@@ -405,6 +575,15 @@ func (m *dbMeta) SetAttr(ctx context.Context, inode Ino, in *fuse.SetAttrIn, att
 		if !ok {
 			return syscall.ENOENT
 		}
+		if err = m.checkWrite(s, userId, inode); err != nil {
+			return err
+		}
+		if in.Valid&fuse.FATTR_SIZE != 0 && cur.Type == TypeFile {
+			cur.Length = in.Size
+			if _, err = s.Cols("length").Update(&node{Length: cur.Length}, &node{Inode: inode}); err != nil {
+				return err
+			}
+		}
 		var curAttr Attr
 		m.parseAttr(&cur, &curAttr)
 		now := time.Now()
@@ -471,6 +650,55 @@ func (m *dbMeta) mergeAttr(ctx context.Context, set uint16, cur, attr *Attr, now
 	return &dirtyAttr, 0
 }
 
+// access returns the permissions the user holds on the given inode: all of
+// them inside its own tree, the ones of the closest share otherwise.
+func (m *dbMeta) access(s *xorm.Session, userId uint32, inode Ino) (uint8, error) {
+	var perm uint8
+	var found bool
+	for inode != RootInode {
+		if inode == SharedInode {
+			return PermRead, nil
+		}
+		if !found {
+			share, err := m.findShare(s, userId, inode)
+			if err != nil {
+				return 0, err
+			}
+			if share != nil {
+				perm, found = share.Perm, true
+			}
+		}
+		var n = node{Inode: inode}
+		ok, err := s.Get(&n)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, syscall.ENOENT
+		}
+		if n.Parent == RootInode {
+			if n.Owner == userId {
+				return PermAll, nil
+			}
+			return perm, nil
+		}
+		inode = n.Parent
+	}
+	// every user has its own entries at the root
+	return PermAll, nil
+}
+
+func (m *dbMeta) checkWrite(s *xorm.Session, userId uint32, inode Ino) error {
+	perm, err := m.access(s, userId, inode)
+	if err != nil {
+		return err
+	}
+	if perm&PermWrite == 0 {
+		return syscall.EACCES
+	}
+	return nil
+}
+
 func (m *dbMeta) GetKey(ctx context.Context, inode Ino, key *[]byte) syscall.Errno {
 	return errno(m.roTxn(func(s *xorm.Session) error {
 		var e = edge{Inode: inode}
@@ -486,17 +714,42 @@ func (m *dbMeta) GetKey(ctx context.Context, inode Ino, key *[]byte) syscall.Err
 	}))
 }
 
-func (m *dbMeta) GetSharedKey(ctx context.Context, userId uint32, inode Ino, key *[]byte) syscall.Errno {
+// findShare returns the share of inode for the user: its own share if any,
+// otherwise the one of its groups with the permissions of all of them.
+func (m *dbMeta) findShare(s *xorm.Session, userId uint32, inode Ino) (*shared, error) {
+	var shares []shared
+	err := s.Where("inode = ? AND (user = ? OR group_id IN (SELECT group_id FROM nsfs_member WHERE user = ?))", inode, userId, userId).
+		And(notExpired, time.Now().Unix()).Asc("id").Find(&shares)
+	if err != nil {
+		return nil, err
+	}
+	var found *shared
+	var perm uint8
+	for i := range shares {
+		if shares[i].User == userId {
+			return &shares[i], nil
+		}
+		if found == nil {
+			found = &shares[i]
+		}
+		perm |= shares[i].Perm
+	}
+	if found != nil {
+		found.Perm = perm
+	}
+	return found, nil
+}
+
+func (m *dbMeta) GetShare(ctx context.Context, userId uint32, inode Ino, share *Share) syscall.Errno {
 	return errno(m.roTxn(func(s *xorm.Session) error {
-		var share = shared{Inode: inode, User: userId}
-		ok, err := s.Get(&share)
+		sh, err := m.findShare(s, userId, inode)
 		if err != nil {
 			return err
 		}
-		if !ok {
+		if sh == nil {
 			return syscall.ENOENT
 		}
-		*key = share.Key
+		*share = Share{Inode: sh.Inode, User: sh.User, Group: sh.GroupId, Name: sh.Name, Key: sh.Key, Perm: sh.Perm, Expires: sh.Expires}
 		return nil
 	}))
 }
@@ -506,8 +759,9 @@ func (m *dbMeta) Lookup(ctx context.Context, userId uint32, parent, inode Ino, a
 		var exist bool
 		var err error
 		if parent == SharedInode {
-			var share = shared{Inode: inode, User: userId}
-			exist, err = s.Get(&share)
+			var share *shared
+			share, err = m.findShare(s, userId, inode)
+			exist = share != nil
 		} else {
 			var edge = edge{Parent: parent, Inode: inode}
 			exist, err = s.Get(&edge)
@@ -531,7 +785,7 @@ func (m *dbMeta) Lookup(ctx context.Context, userId uint32, parent, inode Ino, a
 	}))
 }
 
-func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id uint32, inode *Ino, name, key []byte, attr *Attr) syscall.Errno {
+func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id uint32, inode *Ino, name, key []byte, attr *Attr, seal Sealer) syscall.Errno {
 	return errno(m.txn(func(s *xorm.Session) error {
 		var pn = node{Inode: parent}
 		ok, err := s.Get(&pn)
@@ -544,6 +798,9 @@ func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id ui
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if err = m.checkWrite(s, id, parent); err != nil {
+			return err
+		}
 		var pattr Attr
 		m.parseAttr(&pn, &pattr)
 		var e = edge{Parent: parent, Name: name}
@@ -584,7 +841,8 @@ func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id ui
 			pn.Nlink++
 			updateParent = true
 		}
-		if updateParent || time.Duration(now-pn.Mtime*1e3-int64(pn.Mtimensec)) >= SkipDirMtime {
+		// the times of a parent with hidden attributes are updated by the caller
+		if pn.Attrs == nil && (updateParent || time.Duration(now-pn.Mtime*1e3-int64(pn.Mtimensec)) >= SkipDirMtime) {
 			pn.Mtime = now / 1e3
 			pn.Ctime = now / 1e3
 			updateParent = true
@@ -609,6 +867,9 @@ func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id ui
 			n.Rdev = 0
 			n.Type = TypeFile
 		}
+		if n.Attrs != nil {
+			hideAttr(&n, n.Attrs)
+		}
 
 		if err = mustInsert(s, &edge{Parent: parent, Name: name, Inode: *inode, Type: _type, Key: key}, &n); err != nil {
 			return err
@@ -619,79 +880,91 @@ func (m *dbMeta) Mknod(ctx context.Context, parent Ino, _type uint8, mode, id ui
 			}
 		}
 		m.parseAttr(&n, attr)
-		return nil
+		if _type == TypeDirectory {
+			return m.sealDir(s, id, *inode, seal)
+		}
+		return m.sealDir(s, id, parent, seal)
 	}, parent))
 }
 
-func (m *dbMeta) joinNodes(parent Ino, nns *[]namedNode) syscall.Errno {
-	return errno(m.roTxn(func(s *xorm.Session) error {
-		var nodes []node
-		err := s.SQL("SELECT * FROM `nsfs_edge` INNER JOIN `nsfs_node` ON nsfs_edge.inode=nsfs_node.inode WHERE nsfs_edge.parent = ?", parent).Find(&nodes)
-		if err != nil {
-			log.Fatalf("Failed to find nodes: %v", err)
-		}
-		var edges []edge
-		err = s.SQL("SELECT * FROM `nsfs_edge` INNER JOIN `nsfs_node` ON nsfs_edge.inode=nsfs_node.inode WHERE nsfs_edge.parent = ?", parent).Find(&edges)
-		if err != nil {
-			log.Fatalf("Failed to find edges: %v", err)
-		}
-		if len(nodes) != len(edges) {
-			log.Fatalf("Nodes and edges are not equal: %d %d", len(nodes), len(edges))
-		}
-		for _, n := range nodes {
-			nn := namedNode{node: n}
-			for _, e := range edges {
-				if e.Inode == n.Inode {
-					nn.Name = e.Name
-					nn.Key = e.Key
-					break
-				}
+func (m *dbMeta) joinNodes(s *xorm.Session, parent Ino, nns *[]namedNode) error {
+	var nodes []node
+	err := s.SQL("SELECT * FROM `nsfs_edge` INNER JOIN `nsfs_node` ON nsfs_edge.inode=nsfs_node.inode WHERE nsfs_edge.parent = ?", parent).Find(&nodes)
+	if err != nil {
+		log.Fatalf("Failed to find nodes: %v", err)
+	}
+	var edges []edge
+	err = s.SQL("SELECT * FROM `nsfs_edge` INNER JOIN `nsfs_node` ON nsfs_edge.inode=nsfs_node.inode WHERE nsfs_edge.parent = ?", parent).Find(&edges)
+	if err != nil {
+		log.Fatalf("Failed to find edges: %v", err)
+	}
+	if len(nodes) != len(edges) {
+		log.Fatalf("Nodes and edges are not equal: %d %d", len(nodes), len(edges))
+	}
+	for _, n := range nodes {
+		nn := namedNode{node: n}
+		for _, e := range edges {
+			if e.Inode == n.Inode {
+				nn.Name = e.Name
+				nn.Key = e.Key
+				nn.Detached = e.Detached
+				break
 			}
-			*nns = append(*nns, nn)
 		}
-		return nil
-	}))
+		*nns = append(*nns, nn)
+	}
+	return nil
 }
 
-func (m *dbMeta) joinSharedNodes(userId uint32, nns *[]namedNode) syscall.Errno {
-	return errno(m.roTxn(func(s *xorm.Session) error {
-		var nodes []node
-		err := s.SQL("SELECT * FROM `nsfs_shared` INNER JOIN `nsfs_node` ON nsfs_shared.inode=nsfs_node.inode WHERE nsfs_shared.user = ?", userId).Find(&nodes)
-		if err != nil {
-			log.Fatalf("Failed to find nodes: %v", err)
+func (m *dbMeta) joinSharedNodes(s *xorm.Session, userId uint32, nns *[]namedNode) error {
+	var shares []shared
+	err := s.Where("user = ? OR group_id IN (SELECT group_id FROM nsfs_member WHERE user = ?)", userId, userId).
+		And(notExpired, time.Now().Unix()).Asc("id").Find(&shares)
+	if err != nil {
+		return err
+	}
+	seen := make(map[Ino]int)
+	for _, sh := range shares {
+		if i, ok := seen[sh.Inode]; ok {
+			// the own share of the user takes precedence over the ones of its groups
+			if sh.User == userId {
+				(*nns)[i].Name, (*nns)[i].Key, (*nns)[i].Group = sh.Name, sh.Key, 0
+			}
+			continue
 		}
-		var shares []shared
-		err = s.SQL("SELECT * FROM `nsfs_shared` INNER JOIN `nsfs_node` ON nsfs_shared.inode=nsfs_node.inode WHERE nsfs_shared.user = ?", userId).Find(&shares)
+		var n = node{Inode: sh.Inode}
+		ok, err := s.Get(&n)
 		if err != nil {
-			log.Fatalf("Failed to find edges: %v", err)
-		}
-		if len(nodes) != len(shares) {
-			log.Fatalf("Nodes and edges are not equal: %d %d", len(nodes), len(shares))
+			return err
 		}
-		for _, n := range nodes {
-			nn := namedNode{node: n}
-			for _, sh := range shares {
-				if sh.Inode == n.Inode {
-					nn.Name = sh.Name
-					nn.Key = sh.Key
-					break
-				}
-			}
-			*nns = append(*nns, nn)
+		if !ok {
+			continue
 		}
-		return nil
-	}))
+		seen[sh.Inode] = len(*nns)
+		*nns = append(*nns, namedNode{node: n, Name: sh.Name, Key: sh.Key, Group: sh.GroupId})
+	}
+	return nil
 }
 
 func (m *dbMeta) Readdir(ctx context.Context, inode Ino, userId uint32, entries *[]*Entry) syscall.Errno {
+	return m.ReadDirMac(ctx, inode, userId, entries, nil)
+}
+
+func (m *dbMeta) ReadDirMac(ctx context.Context, inode Ino, userId uint32, entries *[]*Entry, mac *[]byte) syscall.Errno {
 	// The join does not seem to work properly so doing some "brute force"
-	nodes := make([]namedNode, 0)
-	var err syscall.Errno
-	if inode == SharedInode {
-		err = m.joinSharedNodes(userId, &nodes)
-	} else {
-		err = m.joinNodes(inode, &nodes)
-	}
+	var nodes []namedNode
+	err := m.roTxn(func(s *xorm.Session) error {
+		nodes = nodes[:0]
+		if inode == SharedInode {
+			return m.joinSharedNodes(s, userId, &nodes)
+		}
+		if mac != nil {
+			if err := dirMac(s, userId, inode, mac); err != nil {
+				return err
+			}
+		}
+		return m.joinNodes(s, inode, &nodes)
+	})
 	for _, n := range nodes {
 		if len(n.Name) == 0 {
 			logger.Errorf("Corrupt entry with empty name: inode %d parent %d", n.Inode, inode)
@@ -701,18 +974,22 @@ func (m *dbMeta) Readdir(ctx context.Context, inode Ino, userId uint32, entries
 			continue
 		}
 		entry := &Entry{
-			Inode: n.Inode,
-			Name:  n.Name,
-			Key:   n.Key,
-			Attr:  &Attr{},
+			Inode:    n.Inode,
+			Name:     n.Name,
+			Key:      n.Key,
+			Group:    n.Group,
+			Mac:      n.Mac,
+			Version:  n.Version,
+			Detached: n.Detached,
+			Attr:     &Attr{},
 		}
 		m.parseAttr(&n.node, entry.Attr)
 		*entries = append(*entries, entry)
 	}
-	return err
+	return errno(err)
 }
 
-func (m *dbMeta) Rmdir(ctx context.Context, parent, inode Ino) syscall.Errno {
+func (m *dbMeta) Rmdir(ctx context.Context, userId uint32, parent, inode Ino, seal Sealer) syscall.Errno {
 	return errno(m.txn(func(s *xorm.Session) error {
 		var pn = node{Inode: parent}
 		ok, err := s.Get(&pn)
@@ -725,6 +1002,9 @@ func (m *dbMeta) Rmdir(ctx context.Context, parent, inode Ino) syscall.Errno {
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if err = m.checkWrite(s, userId, parent); err != nil {
+			return err
+		}
 		var pattr Attr
 		m.parseAttr(&pn, &pattr)
 		var e = edge{Parent: parent, Inode: inode}
@@ -752,10 +1032,14 @@ func (m *dbMeta) Rmdir(ctx context.Context, parent, inode Ino) syscall.Errno {
 		}
 		now := time.Now().UnixNano()
 		pn.Nlink--
-		pn.Mtime = now / 1e3
-		pn.Ctime = now / 1e3
-		pn.Mtimensec = int16(now % 1e3)
-		pn.Ctimensec = int16(now % 1e3)
+		cols := []string{"nlink"}
+		if pn.Attrs == nil {
+			pn.Mtime = now / 1e3
+			pn.Ctime = now / 1e3
+			pn.Mtimensec = int16(now % 1e3)
+			pn.Ctimensec = int16(now % 1e3)
+			cols = append(cols, "mtime", "ctime", "mtimensec", "ctimensec")
+		}
 
 		if _, err := s.Delete(&edge{Parent: parent, Name: e.Name}); err != nil {
 			return err
@@ -769,12 +1053,15 @@ func (m *dbMeta) Rmdir(ctx context.Context, parent, inode Ino) syscall.Errno {
 			return err
 		}
 
-		_, err = s.Cols("nlink", "mtime", "ctime", "mtimensec", "ctimensec").Update(&pn, &node{Inode: pn.Inode})
-		return err
+		_, err = s.Cols(cols...).Update(&pn, &node{Inode: pn.Inode})
+		if err != nil {
+			return err
+		}
+		return m.sealDir(s, userId, parent, seal)
 	}, parent))
 }
 
-func (m *dbMeta) Unlink(ctx context.Context, parent, inode Ino) syscall.Errno {
+func (m *dbMeta) Unlink(ctx context.Context, userId uint32, parent, inode Ino, seal Sealer) syscall.Errno {
 	return errno(m.txn(func(s *xorm.Session) error {
 		var n node
 		var pn = node{Inode: parent}
@@ -788,6 +1075,9 @@ func (m *dbMeta) Unlink(ctx context.Context, parent, inode Ino) syscall.Errno {
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if err = m.checkWrite(s, userId, parent); err != nil {
+			return err
+		}
 		var e = edge{Parent: parent, Inode: inode}
 		ok, err = s.Get(&e)
 		if err != nil {
@@ -815,7 +1105,7 @@ func (m *dbMeta) Unlink(ctx context.Context, parent, inode Ino) syscall.Errno {
 		}
 
 		var updateParent bool
-		if time.Duration(now-pn.Mtime*1e3-int64(pn.Mtimensec)) >= SkipDirMtime {
+		if pn.Attrs == nil && time.Duration(now-pn.Mtime*1e3-int64(pn.Mtimensec)) >= SkipDirMtime {
 			pn.Mtime = now / 1e3
 			pn.Ctime = now / 1e3
 			pn.Mtimensec = int16(now % 1e3)
@@ -839,12 +1129,148 @@ func (m *dbMeta) Unlink(ctx context.Context, parent, inode Ino) syscall.Errno {
 				return err
 			}
 		}
-		return err
+		return m.sealDir(s, userId, parent, seal)
 	}, parent))
 }
 
-func (m *dbMeta) Write(ctx context.Context, inode uint64, data []byte, off int64) syscall.Errno {
-	ino := Ino(inode)
+// sealDir stores the MAC of the child list of a directory as it is in the
+// transaction, so that it always matches the entries once committed. The
+// MACs of its ancestors, whose lists hold it, are stored again up to the root
+// of the user, a detached directory, or the first one seal has no key for.
+func (m *dbMeta) sealDir(s *xorm.Session, userId uint32, inode Ino, seal Sealer) error {
+	if seal == nil {
+		return nil
+	}
+	for inode != SharedInode {
+		var edges []edge
+		q := s.Where("parent = ?", inode)
+		if inode == RootInode {
+			q = q.And("inode IN (SELECT inode FROM nsfs_node WHERE owner = ?)", userId)
+		}
+		if err := q.Find(&edges); err != nil {
+			return err
+		}
+		inodes := make([]Ino, len(edges))
+		for i, e := range edges {
+			inodes[i] = e.Inode
+		}
+		var nodes []node
+		if err := s.Cols("inode", "mac", "version").In("inode", inodes).Find(&nodes); err != nil {
+			return err
+		}
+		chained := make(map[Ino]node, len(nodes))
+		for _, n := range nodes {
+			chained[n.Inode] = n
+		}
+		entries := make([]*Entry, 0, len(edges))
+		for _, e := range edges {
+			n := chained[e.Inode]
+			entries = append(entries, &Entry{Inode: e.Inode, Name: e.Name, Key: e.Key, Attr: &Attr{Typ: e.Type}, Mac: n.Mac, Version: n.Version, Detached: e.Detached})
+		}
+		mac, err := seal(inode, ChildList(inode, entries))
+		if err != nil || mac == nil {
+			return err
+		}
+		if inode == RootInode {
+			_, err = s.Cols("root_mac").Update(&user{RootMac: mac}, &user{Id: userId})
+			return err
+		}
+		if _, err = s.Cols("mac").Update(&node{Mac: mac}, &node{Inode: inode}); err != nil {
+			return err
+		}
+		if inode, err = m.chainedParent(s, inode); err != nil || inode == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+// chainedParent returns the parent whose list holds the MAC of a node, 0 if
+// the node is detached from it.
+func (m *dbMeta) chainedParent(s *xorm.Session, inode Ino) (Ino, error) {
+	e := edge{Inode: inode}
+	ok, err := s.Get(&e)
+	if err != nil || !ok || e.Detached {
+		return 0, err
+	}
+	return e.Parent, nil
+}
+
+func (m *dbMeta) SealDir(userId uint32, inode Ino, seal Sealer) error {
+	return m.txn(func(s *xorm.Session) error {
+		return m.sealDir(s, userId, inode, seal)
+	}, inode)
+}
+
+func (m *dbMeta) SealContent(userId uint32, inode Ino, version uint64, mac []byte, seal Sealer) error {
+	return m.txn(func(s *xorm.Session) error {
+		if _, err := s.Cols("mac", "version").Update(&node{Mac: mac, Version: version}, &node{Inode: inode}); err != nil {
+			return err
+		}
+		parent, err := m.chainedParent(s, inode)
+		if err != nil || parent == 0 {
+			return err
+		}
+		return m.sealDir(s, userId, parent, seal)
+	}, inode)
+}
+
+func (m *dbMeta) GetDirMac(userId uint32, inode Ino, mac *[]byte) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		return dirMac(s, userId, inode, mac)
+	})
+}
+
+// dirMac reads the MAC of a directory, the one of the root being kept with
+// the user.
+func dirMac(s *xorm.Session, userId uint32, inode Ino, mac *[]byte) error {
+	var ok bool
+	var err error
+	if inode == RootInode {
+		u := user{Id: userId}
+		ok, err = s.Cols("root_mac").Get(&u)
+		*mac = u.RootMac
+	} else {
+		n := node{Inode: inode}
+		ok, err = s.Cols("mac").Get(&n)
+		*mac = n.Mac
+	}
+	if err == nil && !ok {
+		err = syscall.ENOENT
+	}
+	return err
+}
+
+func (m *dbMeta) UpdateAttr(ctx context.Context, userId uint32, inode Ino, attr *Attr, update func(attr *Attr) error) syscall.Errno {
+	return errno(m.txn(func(s *xorm.Session) error {
+		var n = node{Inode: inode}
+		ok, err := s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if inode == RootInode || inode == SharedInode {
+			return syscall.EPERM
+		}
+		if err = m.checkWrite(s, userId, inode); err != nil {
+			return err
+		}
+		m.parseAttr(&n, attr)
+		if err = update(attr); err != nil {
+			return err
+		}
+		if attr.Sealed == nil {
+			return syscall.EINVAL
+		}
+		hideAttr(&n, attr.Sealed)
+		_, err = s.Cols(hiddenCols...).Update(&n, &node{Inode: inode})
+		return err
+	}, inode))
+}
+
+func (m *dbMeta) Extend(ctx context.Context, userId uint32, ino Ino, length uint64) syscall.Errno {
 	return errno(m.txn(func(s *xorm.Session) error {
 		nodeAttr := node{Inode: ino}
 		ok, err := s.Get(&nodeAttr)
@@ -857,8 +1283,10 @@ func (m *dbMeta) Write(ctx context.Context, inode uint64, data []byte, off int64
 		if nodeAttr.Type != TypeFile {
 			return syscall.EPERM
 		}
-		newleng := uint64(len(data)) + uint64(off)
-		nodeAttr.Length = newleng
+		if err = m.checkWrite(s, userId, ino); err != nil {
+			return err
+		}
+		nodeAttr.Length = max(nodeAttr.Length, length)
 		now := time.Now()
 		nodeAttr.Mtime = now.UnixNano() / 1e3
 		nodeAttr.Mtimensec = int16(now.Nanosecond() % 1e3)
@@ -882,7 +1310,7 @@ func (m *dbMeta) CheckUser(username string) error {
 	})
 }
 
-func (m *dbMeta) CreateUser(username string, password, salt, rootKey, privKey, pubKey []byte) error {
+func (m *dbMeta) CreateUser(username string, password, salt, rootKey, privKey, pubKey []byte, keyType uint8, kdf Kdf, seal Sealer) error {
 	return m.txn(func(s *xorm.Session) error {
 		exist, err := s.Get(&user{Username: username})
 		if err != nil {
@@ -904,13 +1332,22 @@ func (m *dbMeta) CreateUser(username string, password, salt, rootKey, privKey, p
 			RootKey:  rootKey,
 			PrKey:    privKey,
 			PubKey:   pubKey,
+			KeyType:  keyType,
+
+			Kdf:            kdf.Algo,
+			KdfMemory:      kdf.Memory,
+			KdfIterations:  kdf.Iterations,
+			KdfParallelism: kdf.Parallelism,
+			KdfKeyfile:     kdf.Keyfile,
 		}
-		_, err = s.Insert(user)
-		return err
+		if _, err = s.Insert(user); err != nil {
+			return err
+		}
+		return m.sealDir(s, user.Id, RootInode, seal)
 	})
 }
 
-func (m *dbMeta) VerifyUser(username string, password []byte, rootKey, privKey *[]byte) error {
+func (m *dbMeta) VerifyUser(username string, password []byte, rootKey, privKey *[]byte, keyType *uint8) error {
 	return m.roTxn(func(s *xorm.Session) error {
 		user := user{Username: username}
 		exist, err := s.Get(&user)
@@ -931,11 +1368,12 @@ func (m *dbMeta) VerifyUser(username string, password []byte, rootKey, privKey *
 		}
 		*rootKey = user.RootKey
 		*privKey = user.PrKey
+		*keyType = user.KeyType
 		return nil
 	})
 }
 
-func (m *dbMeta) GetSalt(username string, salt *[]byte) error {
+func (m *dbMeta) GetSalt(username string, salt *[]byte, kdf *Kdf) error {
 	return m.roTxn(func(s *xorm.Session) error {
 		user := user{Username: username}
 		exist, err := s.Get(&user)
@@ -946,11 +1384,12 @@ func (m *dbMeta) GetSalt(username string, salt *[]byte) error {
 			return syscall.ENOENT
 		}
 		*salt = user.Salt
+		*kdf = Kdf{Algo: user.Kdf, Memory: user.KdfMemory, Iterations: user.KdfIterations, Parallelism: user.KdfParallelism, Keyfile: user.KdfKeyfile}
 		return nil
 	})
 }
 
-func (m *dbMeta) ChangePassword(username string, password, salt, rootKey, privKey []byte) error {
+func (m *dbMeta) ChangePassword(username string, password, salt, rootKey, privKey []byte, kdf Kdf) error {
 	return m.txn(func(s *xorm.Session) error {
 		userToChange := user{Username: username}
 		exist, err := s.Get(&userToChange)
@@ -970,35 +1409,271 @@ func (m *dbMeta) ChangePassword(username string, password, salt, rootKey, privKe
 		userToChange.Salt = salt
 		userToChange.RootKey = rootKey
 		userToChange.PrKey = privKey
-		_, err = s.Cols("password", "salt", "root_key", "pr_key").Update(&userToChange, &user{Username: username})
+		userToChange.Kdf = kdf.Algo
+		userToChange.KdfMemory = kdf.Memory
+		userToChange.KdfIterations = kdf.Iterations
+		userToChange.KdfParallelism = kdf.Parallelism
+		userToChange.KdfKeyfile = kdf.Keyfile
+		_, err = s.Cols("password", "salt", "root_key", "pr_key", "kdf", "kdf_memory", "kdf_iterations", "kdf_parallelism", "kdf_keyfile").
+			Update(&userToChange, &user{Username: username})
 		return err
 	})
 }
 
-func (m *dbMeta) ShareDir(userId uint32, inode Ino, name, key []byte) error {
+func (m *dbMeta) SetRecovery(username string, r *Recovery) error {
+	u := user{RecoveryPub: r.PubKey, RecoveryRoot: r.RootKey, RecoveryPrKey: r.PrivKey}
+	return m.setUserKeys(username, &u, "recovery_pub", "recovery_root", "recovery_pr_key")
+}
+
+func (m *dbMeta) GetRecovery(username string, r *Recovery) error {
+	return m.getUserKeys(username, func(u *user) {
+		*r = Recovery{PubKey: u.RecoveryPub, RootKey: u.RecoveryRoot, PrivKey: u.RecoveryPrKey}
+	})
+}
+
+func (m *dbMeta) SetEscrow(username string, r *Recovery) error {
+	u := user{EscrowPub: r.PubKey, EscrowRoot: r.RootKey, EscrowPrKey: r.PrivKey}
+	return m.setUserKeys(username, &u, "escrow_pub", "escrow_root", "escrow_pr_key")
+}
+
+func (m *dbMeta) GetEscrow(username string, r *Recovery) error {
+	return m.getUserKeys(username, func(u *user) {
+		*r = Recovery{PubKey: u.EscrowPub, RootKey: u.EscrowRoot, PrivKey: u.EscrowPrKey}
+	})
+}
+
+// setUserKeys updates the given columns of a user.
+func (m *dbMeta) setUserKeys(username string, u *user, cols ...string) error {
 	return m.txn(func(s *xorm.Session) error {
-		user := user{Id: userId}
-		exist, err := s.Get(&user)
+		n, err := s.Cols(cols...).Update(u, &user{Username: username})
+		if err == nil && n == 0 {
+			err = syscall.ENOENT
+		}
+		return err
+	})
+}
+
+// getUserKeys passes the record of a user to get.
+func (m *dbMeta) getUserKeys(username string, get func(u *user)) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		u := user{Username: username}
+		exist, err := s.Get(&u)
 		if err != nil {
 			return err
 		}
 		if !exist {
 			return syscall.ENOENT
 		}
-		shared := shared{Inode: inode, Name: name, User: userId, Key: key}
-		_, err = s.Insert(shared)
+		get(&u)
+		return nil
+	})
+}
+
+func (m *dbMeta) ShareDir(sharer uint32, share *Share, seal Sealer) error {
+	return m.txn(func(s *xorm.Session) error {
+		var exist bool
+		var err error
+		if share.Group != 0 {
+			exist, err = s.Get(&group{Id: share.Group})
+		} else {
+			exist, err = s.Get(&user{Id: share.User})
+		}
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		granted, err := m.access(s, sharer, share.Inode)
+		if err != nil {
+			return err
+		}
+		if granted&PermReshare == 0 || share.Perm&^granted != 0 {
+			return syscall.EACCES
+		}
+		shared := shared{Inode: share.Inode, Name: share.Name, User: share.User, GroupId: share.Group, Key: share.Key, Perm: share.Perm, Expires: share.Expires, Sharer: sharer}
+		if _, err = s.Insert(shared); err != nil {
+			return err
+		}
+		if share.Perm&PermWrite == 0 {
+			return nil
+		}
+		e := edge{Inode: share.Inode}
+		if ok, err := s.Get(&e); err != nil || !ok || e.Detached {
+			return err
+		}
+		if _, err = s.Cols("detached").Update(&edge{Detached: true}, &edge{Id: e.Id}); err != nil {
+			return err
+		}
+		// the list of the parent changed, it must be sealed again
+		var sealed bool
+		err = m.sealDir(s, sharer, e.Parent, func(inode Ino, list []byte) ([]byte, error) {
+			mac, err := seal(inode, list)
+			sealed = sealed || mac != nil
+			return mac, err
+		})
+		if err == nil && !sealed {
+			return syscall.EACCES
+		}
 		return err
 	})
 }
 
-func (m *dbMeta) UnshareDir(userId uint32, inode Ino) error {
+func (m *dbMeta) UnshareDir(inode Ino, userId, groupId uint32) error {
+	if userId == 0 && groupId == 0 {
+		return syscall.EINVAL
+	}
 	return m.txn(func(s *xorm.Session) error {
-		shared := shared{Inode: inode, User: userId}
+		shared := shared{Inode: inode, User: userId, GroupId: groupId}
 		_, err := s.Delete(&shared)
 		return err
 	})
 }
 
+func (m *dbMeta) GetShares(inode Ino, shares *[]Share) error {
+	return m.findShares(shares, "inode = ? AND "+notExpired, inode, time.Now().Unix())
+}
+
+// sharedBy selects the shares made by a user. The shares made before the
+// sharer was stored are the ones of the owner of the directory.
+const sharedBy = "(sharer = ? OR (sharer = 0 AND inode IN (SELECT inode FROM nsfs_node WHERE owner = ?)))"
+
+func (m *dbMeta) GetSharesOut(sharer uint32, shares *[]Share) error {
+	return m.findShares(shares, sharedBy, sharer, sharer)
+}
+
+func (m *dbMeta) GetSharesIn(userId uint32, shares *[]Share) error {
+	return m.findShares(shares, "(user = ? OR group_id IN (SELECT group_id FROM nsfs_member WHERE user = ?)) AND "+notExpired, userId, userId, time.Now().Unix())
+}
+
+func (m *dbMeta) GetGroupShares(groupId uint32, shares *[]Share) error {
+	return m.findShares(shares, "group_id = ?", groupId)
+}
+
+func (m *dbMeta) findShares(shares *[]Share, query string, args ...interface{}) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var rows []shared
+		if err := s.Where(query, args...).Asc("id").Find(&rows); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			var n = node{Inode: r.Inode}
+			if _, err := s.Get(&n); err != nil {
+				return err
+			}
+			sharer := r.Sharer
+			if sharer == 0 {
+				sharer = n.Owner
+			}
+			*shares = append(*shares, Share{Inode: r.Inode, User: r.User, Group: r.GroupId, Owner: n.Owner, Sharer: sharer, Name: r.Name, Key: r.Key, Perm: r.Perm, Expires: r.Expires})
+		}
+		return nil
+	})
+}
+
+// expired selects the shares that expired at the given time.
+const expired = "expires != 0 AND expires <= ?"
+
+func (m *dbMeta) GetExpiredShares(sharer uint32, now int64, shares *[]Share) error {
+	return m.findShares(shares, expired+" AND "+sharedBy, now, sharer, sharer)
+}
+
+func (m *dbMeta) PruneShares(sharer uint32, now int64, inode Ino, pruned *[]Share) error {
+	return m.txn(func(s *xorm.Session) error {
+		var rows []shared
+		q := s.Where(expired+" AND "+sharedBy, now, sharer, sharer)
+		if inode != 0 {
+			q = q.And("inode = ?", inode)
+		}
+		err := q.Asc("id").Find(&rows)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if _, err = s.Delete(&shared{Id: r.Id}); err != nil {
+				return err
+			}
+			*pruned = append(*pruned, Share{Inode: r.Inode, User: r.User, Group: r.GroupId, Sharer: sharer, Perm: r.Perm, Expires: r.Expires})
+		}
+		return nil
+	})
+}
+
+// updateKey replaces the name and the key of an entry, and its sealed attributes if given.
+func updateKey(s *xorm.Session, e KeyUpdate) error {
+	n, err := s.Cols("name", "key").Update(&edge{Name: e.Name, Key: e.Key}, &edge{Inode: e.Inode})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return syscall.ENOENT
+	}
+	if e.Attrs != nil {
+		_, err = s.Cols("attrs").Update(&node{Attrs: e.Attrs}, &node{Inode: e.Inode})
+	}
+	return err
+}
+
+func (m *dbMeta) Rekey(userId uint32, step *RekeyStep, seal Sealer) error {
+	return m.txn(func(s *xorm.Session) error {
+		if step.Listed != nil {
+			var mac []byte
+			if err := dirMac(s, userId, step.Sealed, &mac); err != nil {
+				return err
+			}
+			if !bytes.Equal(mac, step.Listed) {
+				return syscall.EAGAIN
+			}
+		}
+		if step.RootKey != nil {
+			n, err := s.Cols("root_key").Update(&user{RootKey: step.RootKey}, &user{Id: userId})
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return syscall.ENOENT
+			}
+		}
+		for _, e := range step.Entries {
+			if err := updateKey(s, e); err != nil {
+				return err
+			}
+		}
+		for _, sh := range step.Shares {
+			if _, err := s.Cols("name", "key").Update(&shared{Name: sh.Name, Key: sh.Key}, &shared{Inode: sh.Inode, User: sh.User, GroupId: sh.Group}); err != nil {
+				return err
+			}
+		}
+		if step.Done != 0 {
+			if _, err := s.Where("user = ? AND inode = ?", userId, step.Done).Delete(&rekey{}); err != nil {
+				return err
+			}
+		}
+		for _, r := range step.Pending {
+			if _, err := s.Insert(&rekey{User: userId, Inode: r.Inode, OldKey: r.OldKey}); err != nil {
+				return err
+			}
+		}
+		if step.Sealed != 0 {
+			return m.sealDir(s, userId, step.Sealed, seal)
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) GetRekeys(userId uint32, pending *[]Rekey) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var rows []rekey
+		if err := s.Where("user = ?", userId).Asc("id").Find(&rows); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			*pending = append(*pending, Rekey{Inode: r.Inode, OldKey: r.OldKey})
+		}
+		return nil
+	})
+}
+
 func (m *dbMeta) GetPathKey(inode Ino, keys *[][]byte) error {
 	return m.txn(func(s *xorm.Session) error {
 		e := edge{Inode: inode}
@@ -1027,6 +1702,189 @@ func (m *dbMeta) GetPathKey(inode Ino, keys *[][]byte) error {
 	})
 }
 
+func (m *dbMeta) GetPath(inode Ino, entries *[]*Entry) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		for inode != RootInode {
+			e := edge{Inode: inode}
+			exist, err := s.Get(&e)
+			if err != nil {
+				return err
+			}
+			if !exist {
+				return syscall.ENOENT
+			}
+			n := node{Inode: e.Inode}
+			if _, err = s.Cols("attrs").Get(&n); err != nil {
+				return err
+			}
+			*entries = append(*entries, &Entry{Inode: e.Inode, Name: e.Name, Key: e.Key, Attr: &Attr{Typ: e.Type, Parent: e.Parent, Sealed: n.Attrs}})
+			inode = e.Parent
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) CreateGroup(g *Group, seal func(id uint32) ([]byte, error)) error {
+	return m.txn(func(s *xorm.Session) error {
+		exist, err := s.Get(&group{Name: g.Name})
+		if err != nil {
+			return err
+		}
+		if exist {
+			return syscall.EEXIST
+		}
+		row := group{Name: g.Name, Owner: g.Owner, PubKey: g.PubKey, KeyType: g.KeyType}
+		if _, err = s.Insert(&row); err != nil {
+			return err
+		}
+		g.Id = row.Id
+		key, err := seal(row.Id)
+		if err != nil {
+			return err
+		}
+		_, err = s.Insert(&member{GroupId: row.Id, User: g.Owner, Key: key})
+		return err
+	})
+}
+
+func (m *dbMeta) GetGroup(name string, g *Group) error {
+	return m.getGroup(&group{Name: name}, g)
+}
+
+func (m *dbMeta) GetGroupById(id uint32, g *Group) error {
+	return m.getGroup(&group{Id: id}, g)
+}
+
+func (m *dbMeta) getGroup(cond *group, g *Group) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		exist, err := s.Get(cond)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		*g = Group{Id: cond.Id, Name: cond.Name, Owner: cond.Owner, PubKey: cond.PubKey, KeyType: cond.KeyType}
+		return nil
+	})
+}
+
+func (m *dbMeta) GetMembers(groupId uint32, members *[]Member) error {
+	return m.findMembers(&member{GroupId: groupId}, members)
+}
+
+func (m *dbMeta) GetMemberships(userId uint32, members *[]Member) error {
+	return m.findMembers(&member{User: userId}, members)
+}
+
+func (m *dbMeta) findMembers(cond *member, members *[]Member) error {
+	return m.roTxn(func(s *xorm.Session) error {
+		var rows []member
+		if err := s.Asc("id").Find(&rows, cond); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			*members = append(*members, Member{Group: r.GroupId, User: r.User, Key: r.Key})
+		}
+		return nil
+	})
+}
+
+// checkGroupOwner returns an error unless the group exists and is owned by owner.
+func (m *dbMeta) checkGroupOwner(s *xorm.Session, owner, groupId uint32) error {
+	var g = group{Id: groupId}
+	exist, err := s.Get(&g)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return syscall.ENOENT
+	}
+	if g.Owner != owner {
+		return syscall.EACCES
+	}
+	return nil
+}
+
+func (m *dbMeta) AddMember(owner uint32, mb *Member) error {
+	return m.txn(func(s *xorm.Session) error {
+		if err := m.checkGroupOwner(s, owner, mb.Group); err != nil {
+			return err
+		}
+		exist, err := s.Get(&user{Id: mb.User})
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return syscall.ENOENT
+		}
+		exist, err = s.Exist(&member{GroupId: mb.Group, User: mb.User})
+		if err != nil {
+			return err
+		}
+		if exist {
+			return syscall.EEXIST
+		}
+		_, err = s.Insert(&member{GroupId: mb.Group, User: mb.User, Key: mb.Key})
+		return err
+	})
+}
+
+func (m *dbMeta) RotateGroup(owner uint32, g *Group, members []Member, shares []Share) error {
+	return m.txn(func(s *xorm.Session) error {
+		if err := m.checkGroupOwner(s, owner, g.Id); err != nil {
+			return err
+		}
+		if _, err := s.Cols("pub_key", "key_type").Update(&group{PubKey: g.PubKey, KeyType: g.KeyType}, &group{Id: g.Id}); err != nil {
+			return err
+		}
+		if _, err := s.Delete(&member{GroupId: g.Id}); err != nil {
+			return err
+		}
+		for _, mb := range members {
+			if _, err := s.Insert(&member{GroupId: g.Id, User: mb.User, Key: mb.Key}); err != nil {
+				return err
+			}
+		}
+		for _, sh := range shares {
+			if _, err := s.Cols("key").Update(&shared{Key: sh.Key}, &shared{Inode: sh.Inode, GroupId: g.Id}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) MigrateUserKey(userId uint32, keyType uint8, privKey, pubKey, sign []byte, shares []Share, members []Member) error {
+	return m.txn(func(s *xorm.Session) error {
+		u := user{PrKey: privKey, PubKey: pubKey, KeyType: keyType, Sign: sign}
+		n, err := s.Cols("pr_key", "pub_key", "key_type", "sign").Update(&u, &user{Id: userId})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return syscall.ENOENT
+		}
+		for _, sh := range shares {
+			if sh.User != userId || sh.Group != 0 {
+				return syscall.EINVAL
+			}
+			if _, err = s.Cols("key").Where("inode = ? AND user = ? AND group_id = 0", sh.Inode, userId).Update(&shared{Key: sh.Key}); err != nil {
+				return err
+			}
+		}
+		for _, mb := range members {
+			if mb.User != userId {
+				return syscall.EINVAL
+			}
+			if _, err = s.Cols("key").Update(&member{Key: mb.Key}, &member{GroupId: mb.Group, User: userId}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func newSQLMeta(driver, addr string) (Meta, error) {
 	engine, err := xorm.NewEngine(driver, addr)
 	if err != nil {
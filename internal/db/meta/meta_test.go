@@ -0,0 +1,132 @@
+package meta
+
+import (
+	"context"
+	"crypto/sha256"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// testSeal stands for the MACs of the lists, which the meta does not check.
+func testSeal(inode Ino, list []byte) ([]byte, error) {
+	sum := sha256.Sum256(list)
+	return sum[:], nil
+}
+
+func newTestMeta(t *testing.T) Meta {
+	t.Helper()
+	m := RegisterMeta(filepath.Join(t.TempDir(), "meta.db"))
+	if err := m.Init(&Format{Name: "test"}); err != nil {
+		t.Fatalf("Init: %s", err)
+	}
+	return m
+}
+
+func createTestUser(t *testing.T, m Meta, name string) uint32 {
+	t.Helper()
+	err := m.CreateUser(name, []byte("hash"), []byte("salt"), []byte("root key"), []byte("private key"), []byte("public key"), 0, Kdf{}, testSeal)
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %s", name, err)
+	}
+	var id uint32
+	if err = m.GetUserId(name, &id); err != nil {
+		t.Fatalf("GetUserId(%s): %s", name, err)
+	}
+	return id
+}
+
+func mknod(t *testing.T, m Meta, parent Ino, typ uint8, owner uint32, name string) Ino {
+	t.Helper()
+	ctx := context.Background()
+	var ino Ino
+	if err := m.GetNextInode(ctx, &ino); err != nil {
+		t.Fatalf("GetNextInode: %s", err)
+	}
+	if errno := m.Mknod(ctx, parent, typ, 0644, owner, &ino, []byte(name), []byte("key"), &Attr{}, testSeal); errno != 0 {
+		t.Fatalf("Mknod(%s): %s", name, errno)
+	}
+	return ino
+}
+
+func TestSetAttrAccess(t *testing.T) {
+	m := newTestMeta(t)
+	alice := createTestUser(t, m, "alice")
+	dir := mknod(t, m, RootInode, TypeDirectory, alice, "dir")
+	file := mknod(t, m, dir, TypeFile, alice, "file")
+	users := map[string]uint8{"reader": PermRead, "writer": PermRead | PermWrite, "stranger": 0}
+	ids := make(map[string]uint32)
+	for name, perm := range users {
+		ids[name] = createTestUser(t, m, name)
+		if perm == 0 {
+			continue
+		}
+		share := &Share{Inode: dir, User: ids[name], Name: []byte("dir of " + name), Key: []byte("key"), Perm: perm}
+		if err := m.ShareDir(alice, share, testSeal); err != nil {
+			t.Fatalf("ShareDir(%s): %s", name, err)
+		}
+	}
+	tests := []struct {
+		user  uint32
+		inode Ino
+		want  syscall.Errno
+	}{
+		{user: alice, inode: file},
+		{user: alice, inode: dir},
+		{user: ids["writer"], inode: file},
+		{user: ids["reader"], inode: file, want: syscall.EACCES},
+		{user: ids["reader"], inode: dir, want: syscall.EACCES},
+		{user: ids["stranger"], inode: file, want: syscall.EACCES},
+	}
+	for _, tt := range tests {
+		var in fuse.SetAttrIn
+		in.Valid = fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW
+		var attr Attr
+		if errno := m.SetAttr(context.Background(), tt.user, tt.inode, &in, &attr); errno != tt.want {
+			t.Errorf("SetAttr of inode %d by user %d = %v, want %v", tt.inode, tt.user, errno, tt.want)
+		}
+	}
+}
+
+func TestRekeyListed(t *testing.T) {
+	m := newTestMeta(t)
+	alice := createTestUser(t, m, "alice")
+	dir := mknod(t, m, RootInode, TypeDirectory, alice, "dir")
+	file := mknod(t, m, dir, TypeFile, alice, "file")
+	if err := m.SealDir(alice, dir, testSeal); err != nil {
+		t.Fatalf("SealDir: %s", err)
+	}
+	var mac []byte
+	var entries []*Entry
+	if errno := m.ReadDirMac(context.Background(), dir, alice, &entries, &mac); errno != 0 {
+		t.Fatalf("ReadDirMac: %s", errno)
+	}
+	step := &RekeyStep{
+		Done:    dir,
+		Entries: []KeyUpdate{{Inode: file, Name: []byte("file rekeyed"), Key: []byte("new key")}},
+		Pending: []Rekey{{Inode: file, OldKey: []byte("old key")}},
+		Sealed:  dir,
+		Listed:  mac,
+	}
+	// another client creates an entry after the list was read
+	mknod(t, m, dir, TypeFile, alice, "other")
+	if err := m.Rekey(alice, step, testSeal); err != syscall.EAGAIN {
+		t.Fatalf("Rekey = %v with the list changed, want %v", err, syscall.EAGAIN)
+	}
+	var pending []Rekey
+	if err := m.GetRekeys(alice, &pending); err != nil || len(pending) != 0 {
+		t.Fatalf("GetRekeys = %d nodes, %v, want none from the step refused", len(pending), err)
+	}
+	if errno := m.ReadDirMac(context.Background(), dir, alice, &entries, &mac); errno != 0 {
+		t.Fatalf("ReadDirMac: %s", errno)
+	}
+	step.Listed = mac
+	if err := m.Rekey(alice, step, testSeal); err != nil {
+		t.Fatalf("Rekey: %s", err)
+	}
+	if err := m.GetRekeys(alice, &pending); err != nil || len(pending) != 1 || pending[0].Inode != file {
+		t.Fatalf("GetRekeys = %+v, %v, want the file pending", pending, err)
+	}
+}
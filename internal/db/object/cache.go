@@ -0,0 +1,424 @@
+package object
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCache keeps the encrypted chunks read from or written to another
+// storage in the files of a local directory, up to a number of bytes, and
+// evicts the least recently used ones. Every file starts with the SHA-256 of
+// its chunk, checked when read, and a corrupt file is read from the storage
+// again. As this is the hash the content of the file authenticates, a chunk
+// of a file is only read from the cache when the caller expects this hash,
+// and from the storage otherwise. The chunks stored by their hash never
+// change. The rest is left to the storage.
+type diskCache struct {
+	ObjectStorage
+	dir     string
+	max     int64
+	mu      sync.Mutex
+	used    int64
+	lru     *list.List               // of *cacheEntry, most recently used first
+	entries map[string]*list.Element // by id
+}
+
+// cacheEntry is a chunk in the cache. The id of the chunk of a file is
+// c<inode>.<indx>, and its file is named after its id and its version. The id
+// and the file of a chunk stored by its hash are o and its hash in hex.
+type cacheEntry struct {
+	id      string
+	file    string
+	inode   uint64
+	indx    uint32
+	version uint64
+	size    int64
+}
+
+// NewDiskCache returns a storage caching the chunks of backend in dir, up to
+// max bytes. The chunks left by a previous mount are used again.
+func NewDiskCache(backend ObjectStorage, dir string, max int64) (ObjectStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &diskCache{ObjectStorage: backend, dir: dir, max: max, lru: list.New(), entries: make(map[string]*list.Element)}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *diskCache) String() string {
+	return fmt.Sprintf("%s cached in %s", c.ObjectStorage, c.dir)
+}
+
+func (c *diskCache) Shutdown() {
+	Shutdown(c.ObjectStorage)
+}
+
+// load indexes the files of the cache, the most recently used first.
+func (c *diskCache) load() error {
+	dirents, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	type found struct {
+		e     *cacheEntry
+		mtime time.Time
+	}
+	var files []found
+	for _, d := range dirents {
+		e, ok := parseCacheFile(d.Name())
+		info, err := d.Info()
+		if !ok || err != nil || !info.Mode().IsRegular() {
+			// leftovers of writes interrupted, or files that are not ours
+			_ = os.Remove(filepath.Join(c.dir, d.Name()))
+			continue
+		}
+		e.size = info.Size()
+		files = append(files, found{e, info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		if old, ok := c.entries[f.e.id]; ok {
+			c.remove(old) // an older version of the chunk
+		}
+		c.entries[f.e.id] = c.lru.PushFront(f.e)
+		c.used += f.e.size
+	}
+	c.evict()
+	return nil
+}
+
+func chunkID(inode uint64, indx uint32) string {
+	return fmt.Sprintf("c%d.%d", inode, indx)
+}
+
+func objectID(hash []byte) string {
+	return "o" + hex.EncodeToString(hash)
+}
+
+// parseCacheFile returns the entry of a file of the cache given its name.
+func parseCacheFile(name string) (*cacheEntry, bool) {
+	if hash, ok := strings.CutPrefix(name, "o"); ok {
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+			return nil, false
+		}
+		return &cacheEntry{id: name, file: name}, true
+	}
+	rest, ok := strings.CutPrefix(name, "c")
+	parts := strings.Split(rest, ".")
+	if !ok || len(parts) != 3 {
+		return nil, false
+	}
+	inode, err1 := strconv.ParseUint(parts[0], 10, 64)
+	indx, err2 := strconv.ParseUint(parts[1], 10, 32)
+	version, err3 := strconv.ParseUint(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, false
+	}
+	return &cacheEntry{id: chunkID(inode, uint32(indx)), file: name, inode: inode, indx: uint32(indx), version: version}, true
+}
+
+// lookup returns the entry of a chunk and marks it as used.
+func (c *diskCache) lookup(id string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// read returns the chunk of an entry, nil if it does not match its checksum
+// or is gone, in which case it is dropped. A chunk that is not the one whose
+// hash is given, when given, is an older one and nil is returned.
+func (c *diskCache) read(e *cacheEntry, hash []byte) []byte {
+	path := filepath.Join(c.dir, e.file)
+	data, err := os.ReadFile(path)
+	if err == nil && len(data) >= sha256.Size {
+		if hash != nil && !bytes.Equal(hash, data[:sha256.Size]) {
+			return nil // replaced once read again from the storage
+		}
+		if sum := sha256.Sum256(data[sha256.Size:]); bytes.Equal(sum[:], data[:sha256.Size]) {
+			now := time.Now()
+			_ = os.Chtimes(path, now, now) // keeps the order of use for the next mount
+			return data[sha256.Size:]
+		}
+		logger.Warnf("Cached chunk %s is corrupt, reading it again", e.file)
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[e.id]; ok && el.Value.(*cacheEntry) == e {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// store writes a chunk in the cache, replacing the version cached before.
+// Failing to cache is not an error of the storage, it is only logged.
+func (c *diskCache) store(e *cacheEntry, data []byte) {
+	sum := sha256.Sum256(data)
+	f, err := os.CreateTemp(c.dir, "tmp-")
+	if err == nil {
+		if _, err = f.Write(append(sum[:], data...)); err == nil {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), filepath.Join(c.dir, e.file))
+		}
+		if err != nil {
+			_ = os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		logger.Warnf("Cannot cache chunk %s: %s", e.file, err)
+		return
+	}
+	e.size = int64(sha256.Size + len(data))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[e.id]; ok {
+		if old.Value.(*cacheEntry).file == e.file {
+			c.used -= old.Value.(*cacheEntry).size // overwritten by the rename
+			c.lru.Remove(old)
+			delete(c.entries, e.id)
+		} else {
+			c.remove(old)
+		}
+	}
+	c.entries[e.id] = c.lru.PushFront(e)
+	c.used += e.size
+	c.evict()
+}
+
+// drop deletes the chunks that match from the cache.
+func (c *diskCache) drop(match func(e *cacheEntry) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.entries {
+		if match(el.Value.(*cacheEntry)) {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *diskCache) evict() {
+	for c.used > c.max && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *diskCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.id)
+	c.used -= e.size
+	_ = os.Remove(filepath.Join(c.dir, e.file))
+}
+
+// chunkEntry returns the entry of the chunk of a file at a version.
+func chunkEntry(inode uint64, indx uint32, version uint64) *cacheEntry {
+	id := chunkID(inode, indx)
+	return &cacheEntry{id: id, file: fmt.Sprintf("%s.%d", id, version), inode: inode, indx: indx, version: version}
+}
+
+// rangeHash returns the hash of a chunk in hashes, nil if it is not in.
+func rangeHash(hashes []byte, indx uint32) []byte {
+	off := int(indx) * sha256.Size
+	if off+sha256.Size > len(hashes) {
+		return nil
+	}
+	return hashes[off : off+sha256.Size]
+}
+
+func (c *diskCache) Get(inode uint64, version uint64, off, length int64, hashes []byte) ([]Chunk, error) {
+	r, err := c.GetReader(inode, version, off, length, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return readChunks(r)
+}
+
+// GetReader reads the chunks of the range that are cached with their expected
+// hash from the cache, and streams the others from the storage in a single
+// request, caching them on the way.
+func (c *diskCache) GetReader(inode uint64, version uint64, off, length int64, hashes []byte) (io.ReadCloser, error) {
+	first, last, ok := chunkRange(off, length)
+	if !ok {
+		return io.NopCloser(&bytes.Buffer{}), nil
+	}
+	r := &cacheReader{c: c, inode: inode, version: version, hashes: hashes}
+	var from, to uint32
+	missing := false
+	for indx := first; ; indx++ {
+		if rangeHash(hashes, indx) != nil && c.lookup(chunkID(inode, indx)) != nil {
+			r.cached = append(r.cached, indx)
+		} else {
+			if !missing {
+				from = indx
+			}
+			to, missing = indx, true
+		}
+		if indx == last {
+			break
+		}
+	}
+	if missing {
+		var err error
+		off, length = int64(from)*ChunkSize, int64(to-from+1)*ChunkSize
+		if r.backend, err = c.ObjectStorage.GetReader(inode, version, off, length, hashes); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// cacheReader merges the chunks found in the cache, read when their turn
+// comes, with the ones streamed from the storage, in the order of their index.
+type cacheReader struct {
+	c       *diskCache
+	inode   uint64
+	version uint64
+	hashes  []byte
+	cached  []uint32      // indexes of the chunks found in the cache
+	backend io.ReadCloser // the other chunks, nil once read
+	next    *Chunk        // chunk read from the storage, not sent yet
+	buf     bytes.Buffer
+}
+
+func (r *cacheReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		chunk, err := r.chunk()
+		if err != nil {
+			return 0, err
+		}
+		if err = WriteChunk(&r.buf, chunk); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// chunk returns the next chunk of the range, and io.EOF after the last one.
+func (r *cacheReader) chunk() (Chunk, error) {
+	if r.next == nil && r.backend != nil {
+		next, err := ReadChunk(r.backend)
+		if err == io.EOF {
+			err = r.backend.Close()
+			r.backend = nil
+		} else if err == nil {
+			r.next = &next
+		}
+		if err != nil {
+			return Chunk{}, err
+		}
+	}
+	if len(r.cached) > 0 && (r.next == nil || r.cached[0] < r.next.Indx) {
+		indx := r.cached[0]
+		r.cached = r.cached[1:]
+		hash := rangeHash(r.hashes, indx)
+		if e := r.c.lookup(chunkID(r.inode, indx)); e != nil {
+			if data := r.c.read(e, hash); data != nil {
+				return Chunk{Indx: indx, Version: e.version, Data: data}, nil
+			}
+		}
+		// evicted or corrupt since, read alone from the storage
+		chunks, err := r.c.ObjectStorage.Get(r.inode, r.version, int64(indx)*ChunkSize, ChunkSize, r.hashes)
+		if err != nil {
+			return Chunk{}, err
+		}
+		for _, chunk := range chunks {
+			if chunk.Indx == indx {
+				r.c.cache(r.inode, chunk)
+				return chunk, nil
+			}
+		}
+		return r.chunk() // a hole, left out
+	}
+	if r.next == nil {
+		return Chunk{}, io.EOF
+	}
+	chunk := *r.next
+	r.next = nil
+	if len(r.cached) > 0 && r.cached[0] == chunk.Indx {
+		r.cached = r.cached[1:] // read from the storage already
+	}
+	r.c.cache(r.inode, chunk)
+	return chunk, nil
+}
+
+func (r *cacheReader) Close() error {
+	r.cached = nil
+	if r.backend == nil {
+		return nil
+	}
+	err := r.backend.Close()
+	r.backend = nil
+	return err
+}
+
+// cache stores a chunk of a file read from the storage. Content written as a
+// whole before chunks is not in chunks to cache.
+func (c *diskCache) cache(inode uint64, chunk Chunk) {
+	if chunk.Version > 0 {
+		c.store(chunkEntry(inode, chunk.Indx, chunk.Version), chunk.Data)
+	}
+}
+
+func (c *diskCache) Put(inode uint64, indx uint32, version uint64, data []byte) error {
+	if err := c.ObjectStorage.Put(inode, indx, version, data); err != nil {
+		return err
+	}
+	c.store(chunkEntry(inode, indx, version), data)
+	return nil
+}
+
+func (c *diskCache) Collect(inode uint64, version uint64, count uint32) error {
+	c.drop(func(e *cacheEntry) bool { return e.id[0] == 'c' && e.inode == inode && e.indx >= count })
+	return c.ObjectStorage.Collect(inode, version, count)
+}
+
+func (c *diskCache) Delete(inode uint64, key string) error {
+	c.drop(func(e *cacheEntry) bool { return e.id[0] == 'c' && e.inode == inode })
+	return c.ObjectStorage.Delete(inode, key)
+}
+
+func (c *diskCache) GetObject(hash []byte) ([]byte, error) {
+	id := objectID(hash)
+	if e := c.lookup(id); e != nil {
+		if data := c.read(e, hash); data != nil {
+			return data, nil
+		}
+	}
+	data, err := c.ObjectStorage.GetObject(hash)
+	if err == nil {
+		c.store(&cacheEntry{id: id, file: id}, data)
+	}
+	return data, err
+}
+
+func (c *diskCache) PutObject(hash, data []byte) error {
+	if err := c.ObjectStorage.PutObject(hash, data); err != nil {
+		return err
+	}
+	id := objectID(hash)
+	c.store(&cacheEntry{id: id, file: id}, data)
+	return nil
+}
@@ -1,8 +1,12 @@
 package object
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"time"
 
@@ -23,37 +27,235 @@ func (s *dbData) String() string {
 }
 
 type blob struct {
-	Inode    uint64    `xorm:"pk"`
-	Key      []byte    `xorm:"notnull"`
-	Size     int64     `xorm:"notnull"`
+	Inode    uint64 `xorm:"pk"`
+	Key      []byte `xorm:"notnull"`
+	Size     int64  `xorm:"notnull"`
+	Exact    []byte // exact size, encrypted, when sizes are padded
+	Version  uint64 `xorm:"notnull default 0"`
+	Hashes   []byte `xorm:"mediumblob"` // hashes of the encrypted chunks
+	Mac      []byte
 	Modified time.Time `xorm:"notnull updated"`
-	Data     []byte    `xorm:"mediumblob"`
+	Data     []byte    `xorm:"mediumblob"` // whole content written before chunks, at version 0
+	Keys     []byte    `xorm:"mediumblob"` // keys of the deduplicated chunks, encrypted
+
+	// the version written over, until the new one is collected
+	PrevKey     []byte
+	PrevSize    int64
+	PrevExact   []byte
+	PrevVersion uint64
+	PrevHashes  []byte `xorm:"mediumblob"`
+	PrevMac     []byte
+	PrevKeys    []byte `xorm:"mediumblob"`
+}
+
+// chunk is a chunk of a file at the version it was written at. A chunk is
+// written at a new version next to the previous one, which is only deleted
+// once the new version is authenticated.
+type chunk struct {
+	Id      int64  `xorm:"pk bigserial"`
+	Inode   uint64 `xorm:"unique(chunk_version) notnull"`
+	Indx    uint32 `xorm:"unique(chunk_version) notnull"`
+	Version uint64 `xorm:"unique(chunk_version) notnull"`
+	Data    []byte `xorm:"mediumblob"`
 }
 
-func (s *dbData) Get(inode uint64, off int64, key *[]byte) ([]byte, error) {
+// object is a chunk stored by the hex of its hash, shared by every file that
+// holds the same chunk. Refs counts the occurrences of the chunk in the files,
+// so that it is deleted along the last one.
+type object struct {
+	Hash string `xorm:"pk varchar(64)"`
+	Data []byte `xorm:"mediumblob"`
+	Refs int64  `xorm:"notnull default 0"`
+}
+
+func (s *dbData) Get(inode uint64, version uint64, off, length int64, hashes []byte) ([]Chunk, error) {
+	first, last, ok := chunkRange(off, length)
+	if !ok {
+		return nil, nil
+	}
+	if version == 0 {
+		if first > 0 {
+			return nil, nil
+		}
+		return s.whole(inode)
+	}
+	var rows []chunk
+	if err := s.chunks(inode, version, first, last).Find(&rows); err != nil {
+		return nil, err
+	}
+	var chunks []Chunk
+	for _, c := range rows {
+		if len(chunks) > 0 && chunks[len(chunks)-1].Indx == c.Indx {
+			continue // replaced by the one read before
+		}
+		chunks = append(chunks, Chunk{Indx: c.Indx, Version: c.Version, Data: c.Data})
+	}
+	return chunks, nil
+}
+
+// chunks queries the chunks of a range written at or before version, by
+// index and the latest first.
+func (s *dbData) chunks(inode uint64, version uint64, first, last uint32) *xorm.Session {
+	return s.db.Where("inode = ? AND indx >= ? AND indx <= ? AND version <= ?", inode, first, last, version).Asc("indx").Desc("version")
+}
+
+// whole returns the content written as a whole before chunks, if any.
+func (s *dbData) whole(inode uint64) ([]Chunk, error) {
 	var b = blob{Inode: inode}
-	ok, err := s.db.Get(&b)
+	ok, err := s.db.Cols("data").Get(&b)
+	if err != nil || !ok || len(b.Data) == 0 {
+		return nil, err
+	}
+	return []Chunk{{Indx: 0, Version: 0, Data: b.Data}}, nil
+}
+
+// rowsReader encodes the chunks of a range as they are read from the database.
+type rowsReader struct {
+	rows *xorm.Rows
+	read bool   // a chunk was read
+	last uint32 // index of the last chunk read
+	buf  bytes.Buffer
+}
+
+func (r *rowsReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.rows == nil || !r.rows.Next() {
+			if r.rows != nil {
+				if err := r.rows.Err(); err != nil {
+					return 0, err
+				}
+			}
+			return 0, io.EOF
+		}
+		var c chunk
+		if err := r.rows.Scan(&c); err != nil {
+			return 0, err
+		}
+		if r.read && c.Indx == r.last {
+			continue // replaced by the one read before
+		}
+		r.read, r.last = true, c.Indx
+		if err := WriteChunk(&r.buf, Chunk{Indx: c.Indx, Version: c.Version, Data: c.Data}); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+func (r *rowsReader) Close() error {
+	if r.rows == nil {
+		return nil
+	}
+	err := r.rows.Close()
+	r.rows = nil
+	return err
+}
+
+func (s *dbData) GetReader(inode uint64, version uint64, off, length int64, hashes []byte) (io.ReadCloser, error) {
+	first, last, ok := chunkRange(off, length)
+	if !ok || version == 0 && first > 0 {
+		return io.NopCloser(&bytes.Buffer{}), nil
+	}
+	if version == 0 {
+		whole, err := s.whole(inode)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		for _, c := range whole {
+			if err = WriteChunk(&buf, c); err != nil {
+				return nil, err
+			}
+		}
+		return io.NopCloser(&buf), nil
+	}
+	rows, err := s.chunks(inode, version, first, last).Rows(&chunk{})
 	if err != nil {
 		return nil, err
 	}
+	return &rowsReader{rows: rows}, nil
+}
+
+func (s *dbData) Put(inode uint64, indx uint32, version uint64, data []byte) error {
+	c := chunk{Inode: inode, Indx: indx, Version: version, Data: data}
+	n, err := s.db.Cols("data").Where("inode = ? AND indx = ? AND version = ?", inode, indx, version).Update(&c)
+	if err == nil && n == 0 {
+		n, err = s.db.Insert(&c)
+	}
+	if err == nil && n == 0 {
+		err = errors.New("not inserted or updated")
+	}
+	return err
+}
+
+func (s *dbData) Discard(inode uint64, version uint64) error {
+	_, err := s.db.Where("inode = ? AND version > ?", inode, version).Delete(&chunk{})
+	return err
+}
+
+func (s *dbData) Collect(inode uint64, version uint64, count uint32) error {
+	_, err := s.db.Transaction(func(ses *xorm.Session) (interface{}, error) {
+		var b = blob{Inode: inode}
+		ok, err := ses.Cols("inode", "version").Get(&b)
+		if err != nil || !ok || b.Version != version {
+			return nil, err // committed again since, collected after that version
+		}
+		if _, err = ses.Where("inode = ? AND (version > ? OR indx >= ?)", inode, version, count).Delete(&chunk{}); err != nil {
+			return nil, err
+		}
+		// the chunks replaced by the ones of this version
+		table := s.db.TableName(&chunk{})
+		if _, err = ses.Where("inode = ? AND version < ? AND indx IN (SELECT indx FROM "+table+" WHERE inode = ? AND version = ?)",
+			inode, version, inode, version).Delete(&chunk{}); err != nil {
+			return nil, err
+		}
+		_, err = ses.NoAutoTime().Cols("data").Cols(prevCols...).Update(&blob{}, &blob{Inode: inode})
+		return nil, err
+	})
+	return err
+}
+
+// prevCols are the columns of the previous version of a blob.
+var prevCols = []string{"prev_key", "prev_size", "prev_exact", "prev_version", "prev_hashes", "prev_mac", "prev_keys"}
+
+func (s *dbData) Stat(inode uint64, info *Info) error {
+	var b = blob{Inode: inode}
+	ok, err := s.db.Omit("data").Get(&b)
+	if err != nil {
+		return err
+	}
 	if !ok {
-		return nil, os.ErrNotExist
+		return os.ErrNotExist
 	}
-	if off > int64(len(b.Data)) {
-		off = int64(len(b.Data))
+	*info = Info{Key: b.Key, Size: b.Size, ExactSize: b.Exact, Version: b.Version, Hashes: b.Hashes, Mac: b.Mac, ChunkKeys: b.Keys}
+	if b.PrevKey != nil {
+		info.Previous = &Info{Key: b.PrevKey, Size: b.PrevSize, ExactSize: b.PrevExact, Version: b.PrevVersion, Hashes: b.PrevHashes, Mac: b.PrevMac, ChunkKeys: b.PrevKeys}
 	}
-	data := b.Data[off:]
-	*key = b.Key
-	return data, nil
+	return nil
 }
 
-func (s *dbData) Put(inode uint64, key []byte, data []byte, size int64) error {
-	now := time.Now()
-	// size of clear data (not encrypted) -> TODO: update length of encrypted data
-	b := blob{Inode: inode, Key: key, Data: data, Size: size, Modified: now}
-	n, err := s.db.Insert(&b)
-	if err != nil || n == 0 {
-		n, err = s.db.Update(&b, &blob{Inode: inode})
+func (s *dbData) Commit(inode uint64, info *Info) error {
+	// size of clear data (not encrypted), rounded up when sizes are padded
+	b := blob{Inode: inode, Key: info.Key, Size: info.Size, Exact: info.ExactSize, Version: info.Version, Hashes: info.Hashes, Mac: info.Mac, Modified: time.Now(), Keys: info.ChunkKeys}
+	if p := info.Previous; p != nil {
+		b.PrevKey, b.PrevSize, b.PrevExact, b.PrevVersion, b.PrevHashes, b.PrevMac, b.PrevKeys = p.Key, p.Size, p.ExactSize, p.Version, p.Hashes, p.Mac, p.ChunkKeys
+	}
+	// the content written as a whole is kept until collected, in case the
+	// version written over it is read
+	cols := append([]string{"key", "size", "exact", "version", "hashes", "mac", "modified", "keys"}, prevCols...)
+	var n int64
+	var err error
+	if info.Hidden {
+		b.Size, b.Modified = 0, time.Time{}
+		n, err = s.db.NoAutoTime().Cols(cols...).Update(&b, &blob{Inode: inode})
+		if err == nil && n == 0 {
+			n, err = s.db.NoAutoTime().Insert(&b)
+		}
+	} else {
+		n, err = s.db.Cols(cols...).Update(&b, &blob{Inode: inode})
+		if err == nil && n == 0 {
+			n, err = s.db.Insert(&b)
+		}
 	}
 	if err == nil && n == 0 {
 		err = errors.New("not inserted or updated")
@@ -62,6 +264,9 @@ func (s *dbData) Put(inode uint64, key []byte, data []byte, size int64) error {
 }
 
 func (s *dbData) Delete(inode uint64, key string) error {
+	if _, err := s.db.Delete(&chunk{Inode: inode}); err != nil {
+		return err
+	}
 	affected, err := s.db.Delete(&blob{Inode: inode})
 	if err == nil && affected == 0 {
 		return nil
@@ -69,6 +274,91 @@ func (s *dbData) Delete(inode uint64, key string) error {
 	return err
 }
 
+func (s *dbData) GetObject(hash []byte) ([]byte, error) {
+	var o = object{Hash: hex.EncodeToString(hash)}
+	ok, err := s.db.Get(&o)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return o.Data, nil
+}
+
+func (s *dbData) PutObject(hash, data []byte) error {
+	o := object{Hash: hex.EncodeToString(hash), Data: data, Refs: 1}
+	var err error
+	for try := 0; try < 2; try++ {
+		_, err = s.db.Transaction(func(ses *xorm.Session) (interface{}, error) {
+			n, err := ses.Incr("refs").Where("hash = ?", o.Hash).Update(&object{})
+			if err == nil && n == 0 {
+				_, err = ses.Insert(&o)
+			}
+			return nil, err
+		})
+		if err == nil {
+			break
+		}
+		// stored meanwhile by another client, referenced on the next try
+	}
+	return err
+}
+
+func (s *dbData) ReleaseObject(hash []byte) error {
+	h := hex.EncodeToString(hash)
+	_, err := s.db.Transaction(func(ses *xorm.Session) (interface{}, error) {
+		n, err := ses.Decr("refs").Where("hash = ? AND refs > 1", h).Update(&object{})
+		if err == nil && n == 0 {
+			_, err = ses.Delete(&object{Hash: h}) // the last reference
+		}
+		return nil, err
+	})
+	return err
+}
+
+// counted tells whether the objects of the database are counted already. The
+// ones of volumes deduplicated before are counted by countRefs.
+func counted(engine *xorm.Engine) (bool, error) {
+	tables, err := engine.DBMetas()
+	if err != nil {
+		return false, err
+	}
+	name := engine.TableName(new(object))
+	for _, t := range tables {
+		if t.Name == name {
+			return t.GetColumn("refs") != nil, nil
+		}
+	}
+	return true, nil // created counted
+}
+
+// countRefs counts the references to the objects from the hashes of the
+// blobs, and deletes the objects no blob references.
+func countRefs(engine *xorm.Engine) error {
+	refs := make(map[string]int64)
+	err := engine.Cols("hashes").Iterate(new(blob), func(i int, bean interface{}) error {
+		hashes := bean.(*blob).Hashes
+		for off := 0; off+sha256.Size <= len(hashes); off += sha256.Size {
+			refs[hex.EncodeToString(hashes[off:off+sha256.Size])]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = engine.Transaction(func(ses *xorm.Session) (interface{}, error) {
+		for h, n := range refs {
+			if _, err := ses.Cols("refs").Update(&object{Refs: n}, &object{Hash: h}); err != nil {
+				return nil, err
+			}
+		}
+		_, err := ses.Where("refs = 0").Delete(&object{})
+		return nil, err
+	})
+	return err
+}
+
 func newSQLStore(driver, addr string) (ObjectStorage, error) {
 	engine, err := xorm.NewEngine(driver, addr)
 	if err != nil {
@@ -90,6 +380,21 @@ func newSQLStore(driver, addr string) (ObjectStorage, error) {
 	if err := engine.Sync2(new(blob)); err != nil {
 		return nil, fmt.Errorf("create table blob: %s", err)
 	}
+	if err := engine.Sync2(new(chunk)); err != nil {
+		return nil, fmt.Errorf("create table chunk: %s", err)
+	}
+	ok, err := counted(engine)
+	if err != nil {
+		return nil, fmt.Errorf("read table object: %s", err)
+	}
+	if err := engine.Sync2(new(object)); err != nil {
+		return nil, fmt.Errorf("create table object: %s", err)
+	}
+	if !ok {
+		if err := countRefs(engine); err != nil {
+			return nil, fmt.Errorf("count references to objects: %s", err)
+		}
+	}
 	return &dbData{engine, addr}, nil
 }
 
@@ -0,0 +1,296 @@
+package object
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestStore(t *testing.T) ObjectStorage {
+	t.Helper()
+	s, err := CreateStorage(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatalf("CreateStorage: %s", err)
+	}
+	return s
+}
+
+// putChunks stores chunks 0, 1, 3 and 4 of inode 1, chunk 2 being a hole,
+// and returns their hashes by index.
+func putChunks(t *testing.T, s ObjectStorage) []byte {
+	t.Helper()
+	hashes := make([]byte, 5*sha256.Size)
+	for _, indx := range []uint32{0, 1, 3, 4} {
+		data := []byte(fmt.Sprintf("chunk %d", indx))
+		if err := s.Put(1, indx, 1, data); err != nil {
+			t.Fatalf("Put(%d): %s", indx, err)
+		}
+		sum := sha256.Sum256(data)
+		copy(hashes[int(indx)*sha256.Size:], sum[:])
+	}
+	return hashes
+}
+
+func TestGetRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		off, length int64
+		want        []uint32 // indexes of the chunks returned
+	}{
+		{name: "first byte", off: 0, length: 1, want: []uint32{0}},
+		{name: "within a chunk", off: ChunkSize + 10, length: 100, want: []uint32{1}},
+		{name: "across chunks", off: ChunkSize - 1, length: 2, want: []uint32{0, 1}},
+		{name: "over a hole", off: ChunkSize, length: 3 * ChunkSize, want: []uint32{1, 3}},
+		{name: "hole only", off: 2 * ChunkSize, length: ChunkSize, want: nil},
+		{name: "past the end", off: 10 * ChunkSize, length: ChunkSize, want: nil},
+		{name: "whole", off: 0, length: 5 * ChunkSize, want: []uint32{0, 1, 3, 4}},
+		{name: "empty", off: 0, length: 0, want: nil},
+	}
+	backend := newTestStore(t)
+	hashes := putChunks(t, backend)
+	cache, err := NewDiskCache(backend, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("NewDiskCache: %s", err)
+	}
+	// half of the chunks are cached already
+	if _, err = cache.Get(1, 1, 0, 1, hashes); err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if _, err = cache.Get(1, 1, 3*ChunkSize, 1, hashes); err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	stores := map[string]ObjectStorage{"database": backend, "cache": cache}
+	for name, s := range stores {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				chunks, err := s.Get(1, 1, tt.off, tt.length, hashes)
+				if err != nil {
+					t.Fatalf("Get: %s", err)
+				}
+				check(t, "Get", chunks, tt.want)
+				r, err := s.GetReader(1, 1, tt.off, tt.length, hashes)
+				if err != nil {
+					t.Fatalf("GetReader: %s", err)
+				}
+				if chunks, err = readChunks(r); err != nil {
+					t.Fatalf("GetReader: %s", err)
+				}
+				check(t, "GetReader", chunks, tt.want)
+			})
+		}
+	}
+}
+
+func check(t *testing.T, op string, chunks []Chunk, want []uint32) {
+	t.Helper()
+	if len(chunks) != len(want) {
+		t.Fatalf("%s returned %d chunks, want %d", op, len(chunks), len(want))
+	}
+	for i, c := range chunks {
+		if c.Indx != want[i] || c.Version != 1 || !bytes.Equal(c.Data, []byte(fmt.Sprintf("chunk %d", want[i]))) {
+			t.Fatalf("%s returned chunk %d at version %d with %q, want chunk %d", op, c.Indx, c.Version, c.Data, want[i])
+		}
+	}
+}
+
+func TestGetWhole(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.Commit(1, &Info{Key: []byte("key"), Size: 5}); err != nil {
+		t.Fatalf("Commit: %s", err)
+	}
+	// content written as a whole before chunks
+	if _, err := s.(*dbData).db.Cols("data").Update(&blob{Data: []byte("whole")}, &blob{Inode: 1}); err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+	chunks, err := s.Get(1, 0, 0, 5, nil)
+	if err != nil || len(chunks) != 1 || chunks[0].Indx != 0 || chunks[0].Version != 0 || string(chunks[0].Data) != "whole" {
+		t.Fatalf("Get = %v, %v, want the whole content as chunk 0", chunks, err)
+	}
+	r, err := s.GetReader(1, 0, 0, 5, nil)
+	if err != nil {
+		t.Fatalf("GetReader: %s", err)
+	}
+	if chunks, err = readChunks(r); err != nil || len(chunks) != 1 || string(chunks[0].Data) != "whole" {
+		t.Fatalf("GetReader = %v, %v, want the whole content as chunk 0", chunks, err)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	s := newTestStore(t)
+	put := func(indx uint32, version uint64) {
+		t.Helper()
+		if err := s.Put(1, indx, version, []byte(fmt.Sprintf("%d@%d", indx, version))); err != nil {
+			t.Fatalf("Put(%d, %d): %s", indx, version, err)
+		}
+	}
+	get := func(version uint64) string {
+		t.Helper()
+		chunks, err := s.Get(1, version, 0, 3*ChunkSize, nil)
+		if err != nil {
+			t.Fatalf("Get(%d): %s", version, err)
+		}
+		var got []string
+		for _, c := range chunks {
+			got = append(got, string(c.Data))
+		}
+		return strings.Join(got, " ")
+	}
+	commit := func(version uint64) {
+		t.Helper()
+		if err := s.Commit(1, &Info{Key: []byte("key"), Version: version, Previous: &Info{Key: []byte("key"), Version: version - 1}}); err != nil {
+			t.Fatalf("Commit(%d): %s", version, err)
+		}
+	}
+	put(0, 1)
+	put(1, 1)
+	put(2, 1)
+	commit(1)
+	// version 2 rewrites chunk 1 next to version 1, which stays readable
+	put(1, 2)
+	commit(2)
+	if got, want := get(1), "0@1 1@1 2@1"; got != want {
+		t.Fatalf("version 1 reads %q, want %q", got, want)
+	}
+	if got, want := get(2), "0@1 1@2 2@1"; got != want {
+		t.Fatalf("version 2 reads %q, want %q", got, want)
+	}
+	var info Info
+	if err := s.Stat(1, &info); err != nil || info.Previous == nil || info.Previous.Version != 1 {
+		t.Fatalf("Stat = %+v, %v, want version 1 as the previous one", info, err)
+	}
+	// a write of version 3 that was never chained is discarded
+	put(0, 3)
+	put(2, 3)
+	if err := s.Discard(1, 2); err != nil {
+		t.Fatalf("Discard: %s", err)
+	}
+	if got, want := get(3), "0@1 1@2 2@1"; got != want {
+		t.Fatalf("version 3 reads %q after discard, want %q", got, want)
+	}
+	// nothing is collected for a version that is no longer committed
+	if err := s.Collect(1, 1, 3); err != nil {
+		t.Fatalf("Collect: %s", err)
+	}
+	if got, want := get(1), "0@1 1@1 2@1"; got != want {
+		t.Fatalf("version 1 reads %q after a stale collect, want %q", got, want)
+	}
+	// collecting version 2, truncated to 2 chunks, drops the chunks it replaced
+	if err := s.Collect(1, 2, 2); err != nil {
+		t.Fatalf("Collect: %s", err)
+	}
+	if got, want := get(2), "0@1 1@2"; got != want {
+		t.Fatalf("version 2 reads %q after collect, want %q", got, want)
+	}
+	if got, want := get(1), "0@1"; got != want {
+		t.Fatalf("version 1 reads %q after collect, want %q", got, want)
+	}
+	if err := s.Stat(1, &info); err != nil || info.Previous != nil {
+		t.Fatalf("Stat = %+v, %v, want no previous version once collected", info, err)
+	}
+}
+
+func TestRefs(t *testing.T) {
+	s := newTestStore(t)
+	hash := []byte("hash")
+	for i := 0; i < 2; i++ {
+		if err := s.PutObject(hash, []byte("data")); err != nil {
+			t.Fatalf("PutObject: %s", err)
+		}
+	}
+	if err := s.ReleaseObject(hash); err != nil {
+		t.Fatalf("ReleaseObject: %s", err)
+	}
+	if data, err := s.GetObject(hash); err != nil || string(data) != "data" {
+		t.Fatalf("GetObject = %q, %v with a reference left", data, err)
+	}
+	if err := s.ReleaseObject(hash); err != nil {
+		t.Fatalf("ReleaseObject: %s", err)
+	}
+	if _, err := s.GetObject(hash); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("GetObject = %v once released, want %v", err, os.ErrNotExist)
+	}
+}
+
+// TestRefsClients releases and references the same object from two clients
+// of a database at once: each round ends with one reference, which must keep
+// the object whatever the order.
+func TestRefsClients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	var clients [2]ObjectStorage
+	for i := range clients {
+		var err error
+		if clients[i], err = CreateStorage(path + "?_busy_timeout=5000"); err != nil {
+			t.Fatalf("CreateStorage: %s", err)
+		}
+	}
+	hash := []byte("hash")
+	if err := clients[0].PutObject(hash, []byte("data")); err != nil {
+		t.Fatalf("PutObject: %s", err)
+	}
+	for round := 0; round < 50; round++ {
+		var wg sync.WaitGroup
+		errs := make(chan error, 2)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- clients[0].ReleaseObject(hash)
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- clients[1].PutObject(hash, []byte("data"))
+		}()
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("round %d: %s", round, err)
+			}
+		}
+		if _, err := clients[0].GetObject(hash); err != nil {
+			t.Fatalf("round %d: the object referenced was deleted: %s", round, err)
+		}
+	}
+}
+
+func TestCountRefs(t *testing.T) {
+	s := newTestStore(t)
+	db := s.(*dbData).db
+	// objects of a volume deduplicated before the store counted them
+	h1, h2, h3 := sha256.Sum256([]byte("1")), sha256.Sum256([]byte("2")), sha256.Sum256([]byte("3"))
+	for _, h := range [][32]byte{h1, h2, h3} {
+		if _, err := db.Insert(&object{Hash: hex.EncodeToString(h[:]), Data: []byte("data"), Refs: 0}); err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+	}
+	hole := make([]byte, sha256.Size)
+	blobs := []blob{
+		{Inode: 1, Key: []byte("key"), Hashes: bytes.Join([][]byte{h1[:], hole, h2[:], h1[:]}, nil)},
+		{Inode: 2, Key: []byte("key"), Hashes: h1[:]},
+	}
+	for _, b := range blobs {
+		if _, err := db.Insert(&b); err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+	}
+	if err := countRefs(db); err != nil {
+		t.Fatalf("countRefs: %s", err)
+	}
+	for h, want := range map[[32]byte]int64{h1: 3, h2: 1} {
+		o := object{Hash: hex.EncodeToString(h[:])}
+		if ok, err := db.Get(&o); err != nil || !ok || o.Refs != want {
+			t.Fatalf("object %x has %d references, want %d", h[:4], o.Refs, want)
+		}
+	}
+	if ok, err := db.Exist(&object{Hash: hex.EncodeToString(h3[:])}); err != nil || ok {
+		t.Fatal("the object no blob references was kept")
+	}
+}
@@ -1,6 +1,10 @@
 package object
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"time"
 
 	"github.com/bastienvty/netsecfs/utils"
@@ -32,17 +36,141 @@ func (o *obj) IsDir() bool          { return o.isDir }
 func (o *obj) IsSymlink() bool      { return false }
 func (o *obj) StorageClass() string { return o.sc }
 
+// ChunkSize is the size of the plain content of a chunk, the last one of an
+// object being shorter.
+const ChunkSize = 1 << 16
+
+// Chunk is an encrypted chunk of an object, with its index and the version it
+// was written at, which it is authenticated with.
+type Chunk struct {
+	Indx    uint32
+	Version uint64
+	Data    []byte
+}
+
+// chunkRange returns the indexes of the first and the last chunk holding the
+// length bytes from off, and false when there are none.
+func chunkRange(off, length int64) (uint32, uint32, bool) {
+	if length <= 0 || off < 0 {
+		return 0, 0, false
+	}
+	return uint32(off / ChunkSize), uint32((off + length - 1) / ChunkSize), true
+}
+
+// WriteChunk encodes a chunk: its index, its version and the length of its
+// data, big-endian, then its data.
+func WriteChunk(w io.Writer, c Chunk) error {
+	head := binary.BigEndian.AppendUint32(nil, c.Indx)
+	head = binary.BigEndian.AppendUint64(head, c.Version)
+	head = binary.BigEndian.AppendUint32(head, uint32(len(c.Data)))
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := w.Write(c.Data)
+	return err
+}
+
+// ReadChunk decodes a chunk encoded by WriteChunk, and returns io.EOF when
+// there are no more.
+func ReadChunk(r io.Reader) (Chunk, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Chunk{}, errors.New("truncated chunk header")
+		}
+		return Chunk{}, err
+	}
+	c := Chunk{Indx: binary.BigEndian.Uint32(head[0:]), Version: binary.BigEndian.Uint64(head[4:])}
+	c.Data = make([]byte, binary.BigEndian.Uint32(head[12:]))
+	if _, err := io.ReadFull(r, c.Data); err != nil {
+		return Chunk{}, fmt.Errorf("truncated chunk %d: %w", c.Indx, err)
+	}
+	return c, nil
+}
+
+// readChunks reads all the chunks of r and closes it.
+func readChunks(r io.ReadCloser) ([]Chunk, error) {
+	defer r.Close()
+	var chunks []Chunk
+	for {
+		c, err := ReadChunk(r)
+		if err == io.EOF {
+			return chunks, nil
+		} else if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+	}
+}
+
+// Info describes an object: the wrapped key of its content, the size of its
+// plain content and the version of its last write. Hashes holds the SHA-256 of
+// every encrypted chunk, and Mac authenticates them along the version and the
+// size. When sizes are padded, Size is rounded up and the exact size is in
+// ExactSize, encrypted. Hidden leaves the size and the time of the commit out
+// of the store, for volumes that encrypt the attributes of their files. When
+// chunks are deduplicated, they are objects stored by their hash and
+// ChunkKeys holds their keys, encrypted with the content key. Previous is the
+// version the content was written over, committed along until the new one is
+// authenticated elsewhere, so that the content stays readable in between.
+type Info struct {
+	Key       []byte
+	Size      int64
+	ExactSize []byte
+	Version   uint64
+	Hashes    []byte
+	Mac       []byte
+	Hidden    bool
+	ChunkKeys []byte
+	Previous  *Info
+}
+
 // ObjectStorage is the interface for object storage.
+// The content of an object is stored as encrypted chunks.
 // all of these API should be idempotent.
 type ObjectStorage interface {
 	// Description of the object storage.
 	String() string
-	// Get the data for the given object specified by key.
-	Get(inode uint64, off int64, key *[]byte) ([]byte, error)
-	// Put data read from a reader to an object specified by key.
-	Put(inode uint64, key []byte, data []byte, size int64) error
+	// Get returns the chunks holding the length bytes of an object from off,
+	// in order and without the holes. Chunks are read whole, as they are
+	// encrypted and authenticated one by one. Content written as a whole before
+	// chunks is returned as chunk 0, at version 0. hashes are the SHA-256 of the
+	// chunks of the object by index, as in Info.Hashes, or nil. A cache serves a
+	// chunk it holds only when it has this hash, without asking the storage.
+	// The chunk of an index is the one written last at or before version.
+	Get(inode uint64, version uint64, off, length int64, hashes []byte) ([]Chunk, error)
+	// GetReader streams the chunks Get returns, each encoded by WriteChunk, so
+	// that large ranges are never held in memory at once. The chunks are
+	// decoded by ReadChunk, and the reader must be closed once read.
+	GetReader(inode uint64, version uint64, off, length int64, hashes []byte) (io.ReadCloser, error)
+	// Put the data of a chunk of an object, written at the given version. The
+	// chunks of the previous versions are kept until collected.
+	Put(inode uint64, indx uint32, version uint64, data []byte) error
+	// Discard deletes the chunks of an object written after version, by a
+	// write that was never authenticated, before the version is written again.
+	Discard(inode uint64, version uint64) error
+	// Collect deletes what the committed version of an object no longer needs
+	// once it is authenticated: the chunks written after it or replaced by it,
+	// the ones from count on, its previous version and the content written as
+	// a whole before chunks. Nothing is deleted once another version is committed.
+	Collect(inode uint64, version uint64, count uint32) error
+	// Stat returns the description of an object.
+	Stat(inode uint64, info *Info) error
+	// Commit creates or updates the description of an object, and of the
+	// version it was written over.
+	Commit(inode uint64, info *Info) error
 	// Delete a object.
 	Delete(inode uint64, key string) error
+
+	// GetObject returns the data stored under its hash, for deduplicated chunks.
+	GetObject(hash []byte) ([]byte, error)
+	// PutObject stores data under its hash, unless already stored, and adds a
+	// reference to it.
+	PutObject(hash, data []byte) error
+	// ReleaseObject drops a reference to the data stored under a hash, and
+	// deletes it along the last one, in the same transaction so that a
+	// reference added meanwhile by another client keeps it.
+	ReleaseObject(hash []byte) error
 }
 
 type Shutdownable interface {
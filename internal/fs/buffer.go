@@ -0,0 +1,143 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// writeBufferSize is the size of the chunks of a file buffered before they
+// are flushed, without waiting for the file to be closed.
+const writeBufferSize = 1 << 24 // 16M
+
+// writeBuffer holds the chunks of a file written since it was last flushed,
+// in the clear, so that small writes are encrypted and stored at once.
+type writeBuffer struct {
+	chunks map[uint32][]byte // whole data of the chunks written
+	base   int64             // size of the content the chunks were read from
+	size   int64             // size of the file once flushed
+	used   int64             // bytes of the chunks buffered, read or written
+}
+
+// buffer writes data at off in the buffer of the file, reading the chunks it
+// changes first, and flushes the buffer once full. The data mutex must be held.
+func (n *Node) buffer(ctx context.Context, data []byte, off int64) syscall.Errno {
+	var c *content // opened once an old chunk is needed
+	defer func() {
+		if c != nil {
+			c.close()
+		}
+	}()
+	b := n.dirty
+	if b == nil {
+		b = &writeBuffer{chunks: make(map[uint32][]byte)}
+		var err error
+		if c, err = n.openContent(false); err == nil {
+			b.base = c.info.Size
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return syscall.EIO
+		}
+		b.size = b.base
+		n.dirty = b
+	}
+	end := off + int64(len(data))
+	for pos := off; pos < end; {
+		indx := uint32(pos / chunkSize)
+		start := pos % chunkSize
+		cnt := min(chunkSize-start, end-pos)
+		buf, ok := b.chunks[indx]
+		if !ok && (start != 0 || cnt != chunkSize) && int64(indx)*chunkSize < b.base {
+			if c == nil {
+				var err error
+				if c, err = n.openContent(false); err != nil {
+					return syscall.EIO
+				}
+			}
+			old, err := c.read(int64(indx)*chunkSize, chunkSize)
+			if err != nil {
+				return syscall.EIO
+			}
+			buf = append([]byte(nil), old...)
+			b.used += int64(len(buf))
+		}
+		if need := start + cnt; need > int64(len(buf)) {
+			b.used += need - int64(len(buf))
+			buf = append(buf, make([]byte, need-int64(len(buf)))...)
+		}
+		copy(buf[start:], data[pos-off:pos-off+cnt])
+		b.chunks[indx] = buf
+		pos += cnt
+	}
+	b.size = max(b.size, end)
+	if b.used >= writeBufferSize {
+		return n.flush(ctx)
+	}
+	return 0
+}
+
+// overlay copies the chunks buffered over dest, the data read at off. The
+// part of a buffered chunk past its data is a hole.
+func (b *writeBuffer) overlay(dest []byte, off int64) {
+	end := off + int64(len(dest))
+	for pos := off; pos < end; {
+		indx := uint32(pos / chunkSize)
+		start := pos % chunkSize
+		cnt := min(chunkSize-start, end-pos)
+		if buf, ok := b.chunks[indx]; ok {
+			part := dest[pos-off : pos-off+cnt]
+			clear(part)
+			if start < int64(len(buf)) {
+				copy(part, buf[start:])
+			}
+		}
+		pos += cnt
+	}
+}
+
+// flush stores the chunks buffered as a new version of the content, then the
+// length of the file. The chunks stay buffered until the content is committed,
+// so that a failed flush loses nothing. The data mutex must be held.
+func (n *Node) flush(ctx context.Context) syscall.Errno {
+	b := n.dirty
+	if b == nil {
+		return 0
+	}
+	c, err := n.openContent(true)
+	if err != nil {
+		return syscall.EIO
+	}
+	err = c.write(b.chunks, b.size)
+	c.close()
+	if err != nil {
+		return syscall.EIO
+	}
+	n.dirty = nil
+	ino := n.StableAttr().Ino
+	var errno syscall.Errno
+	if n.opts.EncryptAttrs {
+		var attr meta.Attr
+		errno = n.updateAttr(ctx, &attr, func(a *meta.Attr) {
+			a.Length = max(a.Length, uint64(b.size))
+			setTime(&a.Mtime, &a.Mtimensec, time.Now())
+		})
+	} else {
+		errno = n.meta.Extend(ctx, n.userId, Ino(ino), uint64(b.size))
+	}
+	if errno == syscall.ENOENT {
+		// unlinked meanwhile, the data goes with it
+		return fs.ToErrno(n.dropContent(ino))
+	}
+	return errno
+}
+
+// discard drops the chunks buffered, once the file is unlinked.
+func (n *Node) discard() {
+	n.dataMu.Lock()
+	n.dirty = nil
+	n.dataMu.Unlock()
+}
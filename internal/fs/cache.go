@@ -0,0 +1,134 @@
+package fs
+
+import (
+	"container/list"
+	"sync"
+)
+
+// chunkCache keeps the plain data of the chunks last read, up to a number of
+// bytes, and evicts the least recently used ones. A chunk is only returned for
+// the hash of its encrypted data it was read with, so that a chunk changed by
+// another client is read again. A nil cache caches nothing.
+type chunkCache struct {
+	mu    sync.Mutex
+	max   int64
+	used  int64
+	lru   *list.List                          // of *cached, most recently used first
+	files map[uint64]map[uint32]*list.Element // chunks cached by inode and index
+}
+
+type cached struct {
+	ino  uint64
+	indx uint32
+	hash string
+	data []byte
+}
+
+// newChunkCache returns a cache of max bytes, nil if max is not positive.
+func newChunkCache(max int64) *chunkCache {
+	if max <= 0 {
+		return nil
+	}
+	return &chunkCache{max: max, lru: list.New(), files: make(map[uint64]map[uint32]*list.Element)}
+}
+
+// get returns the data of a chunk cached for the given hash.
+func (c *chunkCache) get(ino uint64, indx uint32, hash []byte) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.files[ino][indx]
+	if !ok || e.Value.(*cached).hash != string(hash) {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cached).data, true
+}
+
+// contains tells whether a chunk is cached, whatever its hash.
+func (c *chunkCache) contains(ino uint64, indx uint32) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.files[ino][indx]
+	return ok
+}
+
+// put caches the data of a chunk read for the given hash. The data must not
+// be changed afterwards.
+func (c *chunkCache) put(ino uint64, indx uint32, hash, data []byte) {
+	if c == nil || int64(len(data)) > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.files[ino][indx]; ok {
+		c.remove(e)
+	}
+	chunks := c.files[ino]
+	if chunks == nil {
+		chunks = make(map[uint32]*list.Element)
+		c.files[ino] = chunks
+	}
+	chunks[indx] = c.lru.PushFront(&cached{ino: ino, indx: indx, hash: string(hash), data: data})
+	c.used += int64(len(data))
+	for c.used > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops the chunks of a file from index from on.
+func (c *chunkCache) invalidate(ino uint64, from uint32) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for indx, e := range c.files[ino] {
+		if indx >= from {
+			c.remove(e)
+		}
+	}
+}
+
+// drop drops a chunk of a file.
+func (c *chunkCache) drop(ino uint64, indx uint32) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.files[ino][indx]; ok {
+		c.remove(e)
+	}
+}
+
+// purge zeroes and drops every chunk, once unmounted.
+func (c *chunkCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		clear(e.Value.(*cached).data)
+	}
+	c.lru.Init()
+	c.files = make(map[uint64]map[uint32]*list.Element)
+	c.used = 0
+}
+
+func (c *chunkCache) remove(e *list.Element) {
+	v := c.lru.Remove(e).(*cached)
+	c.used -= int64(len(v.data))
+	if chunks := c.files[v.ino]; chunks != nil {
+		delete(chunks, v.indx)
+		if len(chunks) == 0 {
+			delete(c.files, v.ino)
+		}
+	}
+}
@@ -1,16 +1,30 @@
 package fs
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"slices"
 	"syscall"
 
+	"github.com/bastienvty/netsecfs/internal/compress"
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
+// File is an open file. It keeps the content it was last read from, already
+// authenticated, as long as no other version of it is committed.
 type File struct {
 	n *Node
+	c *content // under the data mutex of n
 }
 
 var _ fs.FileHandle = (*File)(nil)
@@ -20,60 +34,820 @@ var _ = (fs.FileFlusher)((*File)(nil))
 var _ = (fs.FileReleaser)((*File)(nil))
 var _ = (fs.FileFsyncer)((*File)(nil))
 
+var errTampered = errors.New("content failed to authenticate")
+
+// content gives access to the chunks of a file, encrypted with its content key.
+// Deduplicated chunks are encrypted with their own keys instead, which are
+// kept with the content and encrypted with its key.
+type content struct {
+	n         *Node
+	ino       uint64
+	key       *crypto.Key
+	info      object.Info
+	stored    object.Info // info of the version opened as committed, kept as the previous one on commit
+	chunkKeys []byte      // keys of the deduplicated chunks, one per chunk
+	objects   []pending   // deduplicated chunks written, stored on commit
+	dropped   [][]byte    // hashes of the deduplicated chunks replaced
+}
+
+// pending is a deduplicated chunk waiting to be stored under its hash.
+type pending struct {
+	hash, data []byte
+}
+
+// openContent unwraps the content key of the file. A new key is generated when
+// the file has no content yet and create is set, otherwise os.ErrNotExist is
+// returned. The version and the MAC of the content must be the ones the list
+// of the parent chains. The previous version is opened instead when the
+// current one was committed but not chained yet, by a write in progress or
+// interrupted by a crash. The content is read again while a write of another
+// client keeps it from matching, see recheck. The content must be closed to
+// wipe its key.
+func (n *Node) openContent(create bool) (*content, error) {
+	ino := n.StableAttr().Ino
+	var last chainCheck
+	for try := 0; ; try++ {
+		c, err := n.openContentOf(ino, create)
+		var version uint64
+		var mac []byte
+		if err == nil {
+			version, mac = c.info.Version, c.info.Mac
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if n.chained(context.Background(), version, mac) {
+			return c, err
+		}
+		if c != nil {
+			c.close()
+			if prev := c.stored.Previous; prev != nil && n.chained(context.Background(), prev.Version, prev.Mac) {
+				return n.openInfo(ino, *prev)
+			}
+		}
+		if !n.recheck(&last, try, version, mac) {
+			tampered(Ino(ino), "version")
+			return nil, errTampered
+		}
+	}
+}
+
+// openContentOf opens the content of the file n is the node of, given its
+// inode, for the nodes that are not part of the mount.
+func (n *Node) openContentOf(ino uint64, create bool) (*content, error) {
+	var info object.Info
+	err := n.obj.Stat(ino, &info)
+	if errors.Is(err, os.ErrNotExist) && create {
+		c := &content{n: n, ino: ino}
+		key := make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if c.info.Key, err = n.enc.Encrypt(n.key.Bytes(), key, crypto.ContentKeyAD(c.ino)); err != nil {
+			return nil, err
+		}
+		if c.key, err = n.keys.Key(key); err != nil {
+			return nil, err
+		}
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return n.openInfo(ino, info)
+}
+
+// openInfo unwraps the key of a committed version of the content and
+// authenticates it.
+func (n *Node) openInfo(ino uint64, info object.Info) (*content, error) {
+	c := &content{n: n, ino: ino, info: info, stored: info}
+	c.info.Previous = nil
+	c.info.Hashes = slices.Clone(info.Hashes) // changed in place by writes
+	key, err := n.enc.Decrypt(n.key.Bytes(), c.info.Key, crypto.ContentKeyAD(c.ino))
+	if err != nil {
+		return nil, err
+	}
+	if c.key, err = n.keys.Key(key); err != nil {
+		return nil, err
+	}
+	if c.info.ExactSize != nil {
+		exact, err := n.enc.Decrypt(c.key.Bytes(), c.info.ExactSize, crypto.SizeAD(c.ino, c.info.Version))
+		if err != nil || len(exact) != 8 {
+			c.close()
+			tampered(Ino(c.ino), "size")
+			return nil, errTampered
+		}
+		c.info.Size = int64(binary.BigEndian.Uint64(exact))
+	}
+	if c.info.ChunkKeys != nil {
+		if c.chunkKeys, err = n.enc.Decrypt(c.key.Bytes(), c.info.ChunkKeys, crypto.ChunkKeysAD(c.ino, c.info.Version)); err != nil {
+			c.close()
+			tampered(Ino(c.ino), "chunk keys")
+			return nil, errTampered
+		}
+	}
+	if c.sealed() && !crypto.VerifyMAC(c.key.Bytes(), c.digest(), c.info.Mac) || !c.sealed() && n.opts.Sealed {
+		c.close()
+		tampered(Ino(c.ino), "content")
+		return nil, errTampered
+	}
+	return c, nil
+}
+
+// close wipes the content key and the keys of the chunks.
+func (c *content) close() {
+	c.key.Wipe()
+	clear(c.chunkKeys)
+}
+
+// sealed tells whether the content is authenticated by a MAC. Content written
+// before MACs has none until its next write, or until the tree is sealed.
+func (c *content) sealed() bool {
+	return c.info.Mac != nil
+}
+
+// digest is what the MAC of the content authenticates: its version, its size
+// and the root hash over the hashes of its encrypted chunks.
+func (c *content) digest() []byte {
+	root := sha256.Sum256(c.info.Hashes)
+	d := binary.BigEndian.AppendUint64([]byte("netsecfs file\x00"), c.ino)
+	d = binary.BigEndian.AppendUint64(d, c.info.Version)
+	d = binary.BigEndian.AppendUint64(d, uint64(c.info.Size))
+	return append(d, root[:]...)
+}
+
+// hash returns the hash of an encrypted chunk, zero for a hole.
+func (c *content) hash(indx uint32) []byte {
+	off := int(indx) * sha256.Size
+	if off+sha256.Size > len(c.info.Hashes) {
+		return make([]byte, sha256.Size)
+	}
+	return c.info.Hashes[off : off+sha256.Size]
+}
+
+func (c *content) setHash(indx uint32, sum []byte) {
+	off := int(indx) * sha256.Size
+	if need := off + sha256.Size; need > len(c.info.Hashes) {
+		c.info.Hashes = append(c.info.Hashes, make([]byte, need-len(c.info.Hashes))...)
+	}
+	copy(c.info.Hashes[off:], sum)
+}
+
+// chunkKey returns the key of a deduplicated chunk, nil for a hole.
+func (c *content) chunkKey(indx uint32) []byte {
+	off := int(indx) * sha256.Size
+	if off+sha256.Size > len(c.chunkKeys) {
+		return nil
+	}
+	return c.chunkKeys[off : off+sha256.Size]
+}
+
+func (c *content) setChunkKey(indx uint32, key []byte) {
+	off := int(indx) * sha256.Size
+	if need := off + sha256.Size; need > len(c.chunkKeys) {
+		c.chunkKeys = append(c.chunkKeys, make([]byte, need-len(c.chunkKeys))...)
+	}
+	copy(c.chunkKeys[off:], key)
+}
+
+// drop records that the deduplicated chunks from indx on are no longer
+// referenced by the content once committed.
+func (c *content) drop(indx, end uint32) {
+	for ; indx < end; indx++ {
+		if h := c.hash(indx); string(h) != string(make([]byte, sha256.Size)) {
+			c.dropped = append(c.dropped, append([]byte(nil), h...))
+		}
+	}
+}
+
+// splitHashes returns the hashes of the chunks that are not holes.
+func splitHashes(hashes []byte) [][]byte {
+	var split [][]byte
+	zero := make([]byte, sha256.Size)
+	for off := 0; off+sha256.Size <= len(hashes); off += sha256.Size {
+		if h := hashes[off : off+sha256.Size]; string(h) != string(zero) {
+			split = append(split, h)
+		}
+	}
+	return split
+}
+
+// store stores the deduplicated chunks written, each adding a reference to
+// the chunk it is stored as. They are referenced before the content, so that
+// they cannot be deleted in between. A chunk stored again by a commit retried
+// is referenced twice, and kept longer than needed rather than lost.
+func (n *Node) store(objects []pending) error {
+	for _, o := range objects {
+		if err := n.obj.PutObject(o.hash, o.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release drops a reference to deduplicated chunks, which are deleted once no
+// file references them anymore.
+func (n *Node) release(hashes [][]byte) error {
+	for _, h := range hashes {
+		if err := n.obj.ReleaseObject(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rehash computes the hashes of the chunks written before MACs.
+func (c *content) rehash() error {
+	c.info.Hashes = nil
+	r, err := c.n.obj.GetReader(c.ino, c.info.Version, 0, c.info.Size, nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		chunk, err := object.ReadChunk(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(chunk.Data)
+		c.setHash(chunk.Indx, sum[:])
+	}
+}
+
+// prepare makes sure the content is in chunks whose hashes are all known
+// before it is changed, and that no chunk is left of a version written over it
+// but never chained.
+func (c *content) prepare() error {
+	if err := c.n.obj.Discard(c.ino, c.info.Version); err != nil {
+		return err
+	}
+	if c.legacy() {
+		return c.migrate()
+	}
+	if !c.sealed() && c.info.Version > 0 {
+		return c.rehash()
+	}
+	return nil
+}
+
+// commit authenticates the new version of the content and stores it. When
+// sizes are padded, the stored size is rounded up and the exact one encrypted.
+// When attributes are encrypted, the size and the time are left out entirely.
+// The version written over is committed along and its chunks are kept, so
+// that it stays readable until the list of the parent chains the new one.
+// Only then is it collected.
+func (c *content) commit() error {
+	if err := c.n.store(c.objects); err != nil {
+		return err
+	}
+	c.objects = nil
+	c.info.Mac = crypto.MAC(c.key.Bytes(), c.digest())
+	info := c.info
+	info.ExactSize = nil
+	if c.n.opts.Dedup {
+		var err error
+		if info.ChunkKeys, err = c.n.enc.Encrypt(c.key.Bytes(), c.chunkKeys, crypto.ChunkKeysAD(c.ino, c.info.Version)); err != nil {
+			return err
+		}
+	}
+	if c.n.opts.PadSizes {
+		exact := binary.BigEndian.AppendUint64(nil, uint64(c.info.Size))
+		var err error
+		if info.ExactSize, err = c.n.enc.Encrypt(c.key.Bytes(), exact, crypto.SizeAD(c.ino, c.info.Version)); err != nil {
+			return err
+		}
+		info.Size = paddedSize(c.info.Size)
+		info.Hidden = c.n.opts.EncryptAttrs
+	}
+	if c.stored.Key != nil {
+		info.Previous = &c.stored
+	}
+	if err := c.n.obj.Commit(c.ino, &info); err != nil {
+		return err
+	}
+	// the list of the parent chains the new version
+	if err := c.n.meta.SealContent(c.n.userId, Ino(c.ino), c.info.Version, c.info.Mac, c.n.seal); err != nil {
+		return err
+	}
+	c.n.mu.Lock()
+	c.n.listed = &meta.Entry{Inode: Ino(c.ino), Mac: c.info.Mac, Version: c.info.Version}
+	c.n.mu.Unlock()
+	info.Previous = nil
+	info.Hashes = slices.Clone(info.Hashes)
+	c.stored = info
+	count := uint32((c.info.Size + chunkSize - 1) / chunkSize)
+	if err := c.n.obj.Collect(c.ino, c.info.Version, count); err != nil {
+		// collected after the next write
+		logger.Warnf("Cannot collect the chunks of inode %d: %s", c.ino, err)
+	}
+	if !c.n.opts.Dedup {
+		return nil
+	}
+	dropped := c.dropped
+	c.dropped = nil
+	return c.n.release(dropped)
+}
+
+// legacy tells whether the content was written as a whole before chunks.
+func (c *content) legacy() bool {
+	return c.info.Version == 0 && c.info.Size > 0
+}
+
+// chunk returns the plain data of a chunk, nil for a hole. The data of chunks
+// whose hash is known is cached and must not be changed.
+func (c *content) chunk(indx uint32) ([]byte, error) {
+	cacheable := c.sealed() && !c.hole(indx)
+	if cacheable {
+		if data, ok := c.n.cache.get(c.ino, indx, c.hash(indx)); ok {
+			c.n.stats.CacheHits.Add(1)
+			return data, nil
+		}
+		c.n.stats.CacheMisses.Add(1)
+	}
+	data, err := c.fetch(indx)
+	if err == nil && cacheable {
+		c.n.cache.put(c.ino, indx, c.hash(indx), data)
+	}
+	return data, err
+}
+
+// fetch reads, authenticates and decrypts a chunk.
+func (c *content) fetch(indx uint32) ([]byte, error) {
+	var version uint64
+	var data []byte
+	var err error
+	if c.n.opts.Dedup {
+		version = c.info.Version // the chunks are all compressed
+		if key := c.chunkKey(indx); key != nil && string(key) != string(make([]byte, sha256.Size)) {
+			data, err = c.n.obj.GetObject(c.hash(indx))
+		}
+	} else if !c.sealed() || !c.hole(indx) {
+		var chunks []object.Chunk
+		chunks, err = c.n.obj.Get(c.ino, c.info.Version, int64(indx)*chunkSize, chunkSize, c.hashes())
+		if err == nil && len(chunks) > 0 && chunks[0].Indx == indx {
+			data, version = chunks[0].Data, chunks[0].Version
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return c.open(indx, data, version)
+}
+
+// hashes returns the hashes of the chunks the storage must return, nil when
+// they are not known.
+func (c *content) hashes() []byte {
+	if !c.sealed() {
+		return nil
+	}
+	return c.info.Hashes
+}
+
+// hole tells whether a chunk of sealed content is a hole.
+func (c *content) hole(indx uint32) bool {
+	return string(c.hash(indx)) == string(make([]byte, sha256.Size))
+}
+
+// chunks returns the plain data of the chunks from first to last, nil for
+// the holes. The chunks of files that are not cached are streamed in a single
+// request and opened as they come.
+func (c *content) chunks(first, last uint32) (map[uint32][]byte, error) {
+	chunks := make(map[uint32][]byte)
+	if c.n.opts.Dedup || !c.sealed() {
+		// chunks stored by their hash, or whose holes are not known
+		for indx := first; indx <= last; indx++ {
+			data, err := c.chunk(indx)
+			if err != nil {
+				return nil, err
+			}
+			chunks[indx] = data
+		}
+		return chunks, nil
+	}
+	var from, to uint32
+	missing := 0
+	for indx := first; indx <= last; indx++ {
+		if c.hole(indx) {
+			continue
+		}
+		if data, ok := c.n.cache.get(c.ino, indx, c.hash(indx)); ok {
+			c.n.stats.CacheHits.Add(1)
+			chunks[indx] = data
+			continue
+		}
+		c.n.stats.CacheMisses.Add(1)
+		if missing == 0 {
+			from = indx
+		}
+		to = indx
+		missing++
+	}
+	if missing == 0 {
+		return chunks, nil
+	}
+	r, err := c.n.obj.GetReader(c.ino, c.info.Version, int64(from)*chunkSize, int64(to-from+1)*chunkSize, c.info.Hashes)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for {
+		chunk, err := object.ReadChunk(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		indx := chunk.Indx
+		if _, ok := chunks[indx]; ok || indx < from || indx > to || c.hole(indx) {
+			continue // cached, or to be reported as tampered below
+		}
+		if chunks[indx], err = c.open(indx, chunk.Data, chunk.Version); err != nil {
+			return nil, err
+		}
+		c.n.cache.put(c.ino, indx, c.hash(indx), chunks[indx])
+	}
+	for indx := from; indx <= to; indx++ {
+		if _, ok := chunks[indx]; !ok && !c.hole(indx) {
+			_, err = c.open(indx, nil, 0) // missing from the storage
+			return nil, err
+		}
+	}
+	return chunks, nil
+}
+
+// open authenticates and decrypts a chunk written at version, nil for a hole.
+func (c *content) open(indx uint32, data []byte, version uint64) ([]byte, error) {
+	var err error
+	if c.sealed() {
+		want := c.hash(indx)
+		if data == nil && string(want) != string(make([]byte, sha256.Size)) {
+			tampered(Ino(c.ino), "missing chunk")
+			return nil, errTampered
+		} else if sum := sha256.Sum256(data); data != nil && string(sum[:]) != string(want) {
+			tampered(Ino(c.ino), "chunk")
+			return nil, errTampered
+		}
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var plain []byte
+	if c.n.opts.Dedup {
+		plain, err = c.n.enc.Decrypt(c.chunkKey(indx), data, crypto.ObjectAD())
+	} else {
+		plain, err = c.n.enc.Decrypt(c.key.Bytes(), data, crypto.ChunkAD(c.ino, indx, version))
+	}
+	// content written as a whole before chunks is never compressed
+	if err != nil || !c.n.opts.Compress || version == 0 {
+		return plain, err
+	}
+	if data, err = compress.Decode(plain, chunkSize); err != nil {
+		return nil, err
+	}
+	c.n.stats.Read.Add(int64(len(data)))
+	c.n.stats.ReadStored.Add(int64(len(plain)))
+	return data, nil
+}
+
+// chunkBucket returns the size a chunk of n bytes is padded to, a power of
+// two from fileBlockSize up to chunkSize.
+func chunkBucket(n int64) int64 {
+	b := int64(fileBlockSize)
+	for b < n {
+		b <<= 1
+	}
+	return min(b, chunkSize)
+}
+
+// paddedSize returns the size of a content of size bytes once its last chunk
+// is padded.
+func paddedSize(size int64) int64 {
+	if size == 0 {
+		return 0
+	}
+	full := (size - 1) / chunkSize * chunkSize
+	return full + chunkBucket(size-full)
+}
+
+// putChunk compresses, encrypts and stores a chunk. When sizes are padded,
+// the chunk is padded with zeros, which read as a hole past the end of the
+// file, or which follow the compressed payload.
+func (c *content) putChunk(indx uint32, data []byte, version uint64) error {
+	c.n.cache.drop(c.ino, indx)
+	if c.n.opts.Compress {
+		encoded, err := compress.Encode(c.n.opts.Compression, data)
+		if err != nil {
+			return err
+		}
+		c.n.stats.Written.Add(int64(len(data)))
+		c.n.stats.WrittenStored.Add(int64(len(encoded)))
+		data = encoded
+	}
+	if n := chunkBucket(int64(len(data))); c.n.opts.PadSizes && n > int64(len(data)) {
+		padded := make([]byte, n)
+		copy(padded, data)
+		data = padded
+	}
+	if c.n.opts.Dedup {
+		key := crypto.ChunkKey(c.n.dedup.Bytes(), data)
+		cipher, err := c.n.enc.EncryptConvergent(key, data, crypto.ObjectAD())
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(cipher)
+		c.drop(indx, indx+1)
+		c.objects = append(c.objects, pending{hash: sum[:], data: cipher})
+		c.setHash(indx, sum[:])
+		c.setChunkKey(indx, key)
+		return nil
+	}
+	cipher, err := c.n.enc.Encrypt(c.key.Bytes(), data, crypto.ChunkAD(c.ino, indx, version))
+	if err != nil {
+		return err
+	}
+	if err = c.n.obj.Put(c.ino, indx, version, cipher); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(cipher)
+	c.setHash(indx, sum[:])
+	return nil
+}
+
+// read returns the plain content in [off, off+size) and less at the end of the file.
+func (c *content) read(off, size int64) ([]byte, error) {
+	if off >= c.info.Size {
+		return nil, nil
+	}
+	end := min(off+size, c.info.Size)
+	if c.legacy() {
+		data, err := c.chunk(0)
+		if err != nil {
+			return nil, err
+		}
+		return data[min(off, int64(len(data))):min(end, int64(len(data)))], nil
+	}
+	chunks, err := c.chunks(uint32(off/chunkSize), uint32((end-1)/chunkSize))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, end-off)
+	for pos := off; pos < end; {
+		indx := uint32(pos / chunkSize)
+		start := pos % chunkSize
+		data := chunks[indx]
+		n := min(chunkSize-start, end-pos)
+		if start < int64(len(data)) {
+			copy(buf[pos-off:pos-off+n], data[start:]) // the rest of a short chunk is a hole
+		}
+		pos += n
+	}
+	return buf, nil
+}
+
+// write replaces whole chunks as a new version of the content, which is at
+// least size bytes long afterwards.
+func (c *content) write(chunks map[uint32][]byte, size int64) error {
+	if err := c.prepare(); err != nil {
+		return err
+	}
+	version := c.info.Version + 1
+	indexes := make([]uint32, 0, len(chunks))
+	for indx := range chunks {
+		indexes = append(indexes, indx)
+	}
+	slices.Sort(indexes)
+	for _, indx := range indexes {
+		if err := c.putChunk(indx, chunks[indx], version); err != nil {
+			return err
+		}
+	}
+	c.info.Size = max(c.info.Size, size)
+	c.info.Version = version
+	return c.commit()
+}
+
+// truncate sets the size of the content, dropping the chunks past it.
+func (c *content) truncate(size int64) error {
+	if err := c.prepare(); err != nil {
+		return err
+	}
+	if size < c.info.Size {
+		indx := uint32(size / chunkSize)
+		if rest := size % chunkSize; rest != 0 {
+			data, err := c.chunk(indx)
+			if err != nil {
+				return err
+			}
+			if int64(len(data)) > rest {
+				c.info.Version++
+				if err = c.putChunk(indx, data[:rest], c.info.Version); err != nil {
+					return err
+				}
+			}
+			indx++
+		}
+		// the chunks past the end are collected once the new size is chained
+		c.n.cache.invalidate(c.ino, indx)
+		if c.n.opts.Dedup {
+			c.drop(indx, uint32(len(c.info.Hashes)/sha256.Size))
+		}
+		if n := int(indx) * sha256.Size; n < len(c.info.Hashes) {
+			c.info.Hashes = c.info.Hashes[:n]
+		}
+		if n := int(indx) * sha256.Size; n < len(c.chunkKeys) {
+			clear(c.chunkKeys[n:])
+			c.chunkKeys = c.chunkKeys[:n]
+		}
+	}
+	c.info.Size = size
+	c.info.Version = max(c.info.Version, 1)
+	return c.commit()
+}
+
+// migrate splits content written as a whole into chunks.
+func (c *content) migrate() error {
+	data, err := c.chunk(0)
+	if err != nil {
+		return err
+	}
+	c.info.Version = 1
+	c.info.Hashes = nil
+	for off := int64(0); off < int64(len(data)); off += chunkSize {
+		end := min(off+chunkSize, int64(len(data)))
+		if err = c.putChunk(uint32(off/chunkSize), data[off:end], c.info.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncate changes the size of the content of a file, once the chunks
+// buffered are flushed.
+func (n *Node) truncate(ctx context.Context, size int64) syscall.Errno {
+	n.dataMu.Lock()
+	defer n.dataMu.Unlock()
+	if errno := n.flush(ctx); errno != 0 {
+		return errno
+	}
+	c, err := n.openContent(false)
+	if errors.Is(err, os.ErrNotExist) {
+		if size == 0 {
+			return 0
+		}
+		c, err = n.openContent(true)
+	}
+	if err != nil {
+		return syscall.EIO
+	}
+	defer c.close()
+	if err = c.truncate(size); err != nil {
+		return syscall.EIO
+	}
+	return 0
+}
+
 func (f *File) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	ino := f.n.StableAttr().Ino
-	var keyCipher []byte
-	dataCipher, error := f.n.obj.Get(ino, off, &keyCipher)
-	if error != nil {
+	f.n.keysMu.RLock()
+	defer f.n.keysMu.RUnlock()
+	// a read in the middle of a write would see chunks not committed yet
+	f.n.dataMu.Lock()
+	defer f.n.dataMu.Unlock()
+	c, err := f.content()
+	if errors.Is(err, os.ErrNotExist) {
+		c = &content{n: f.n, ino: f.n.StableAttr().Ino} // nothing stored yet
+	} else if err != nil {
 		return nil, syscall.EIO
 	}
-	key, ok := f.n.enc.Decrypt(f.n.key, keyCipher)
-	if ok != nil {
-		return nil, syscall.EIO
+	b := f.n.dirty
+	if b == nil {
+		data, err := c.read(off, int64(len(dest)))
+		if err != nil {
+			return nil, syscall.EIO
+		}
+		f.n.readAhead(c, off, off+int64(len(data)))
+		return fuse.ReadResultData(data), 0
+	}
+	// the chunks buffered are read over the ones stored
+	if off >= b.size {
+		return fuse.ReadResultData(nil), 0
 	}
-	data, ok := f.n.enc.Decrypt(key, dataCipher)
-	if ok != nil {
+	data := make([]byte, min(int64(len(dest)), b.size-off))
+	stored, err := c.read(off, int64(len(data)))
+	if err != nil {
 		return nil, syscall.EIO
 	}
+	copy(data, stored)
+	b.overlay(data, off)
 	return fuse.ReadResultData(data), 0
 }
 
+// content returns the content the file was last read from while it is the
+// version stored, and opens the one stored otherwise. The data mutex must be
+// held.
+func (f *File) content() (*content, error) {
+	if c := f.c; c != nil {
+		var info object.Info
+		err := f.n.obj.Stat(c.ino, &info)
+		if err == nil && info.Version == c.stored.Version && bytes.Equal(info.Mac, c.stored.Mac) &&
+			bytes.Equal(info.Key, c.stored.Key) && c.key.Bytes() != nil {
+			return c, nil
+		}
+		c.close()
+		f.c = nil
+	}
+	c, err := f.n.openContent(false)
+	if err != nil {
+		return nil, err
+	}
+	f.c = c
+	return c, nil
+}
+
+// readAhead reads the chunks following [off, end) into the cache in the
+// background when the file is read sequentially, unless they already are.
+func (n *Node) readAhead(c *content, off, end int64) {
+	n.mu.Lock()
+	sequential := off == n.readEnd
+	n.readEnd = end
+	n.mu.Unlock()
+	if !sequential || n.cache == nil || n.opts.ReadAhead <= 0 || end >= c.info.Size {
+		return
+	}
+	first := uint32((end-1)/chunkSize) + 1
+	last := min(first+uint32(n.opts.ReadAhead)-1, uint32((c.info.Size-1)/chunkSize))
+	if first > last || n.cache.contains(c.ino, last) || !n.ahead.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer n.ahead.Store(false)
+		n.keysMu.RLock()
+		defer n.keysMu.RUnlock()
+		n.dataMu.Lock()
+		defer n.dataMu.Unlock()
+		if n.key.Bytes() == nil {
+			// forgotten in the meantime
+			return
+		}
+		c, err := n.openContent(false)
+		if err != nil {
+			return
+		}
+		defer c.close()
+		_, _ = c.chunks(first, last)
+	}()
+}
+
+// Write buffers the data written, see buffer. The file is written when
+// flushed, closed or synced.
 func (f *File) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
-	ino := f.n.StableAttr().Ino
-	err := f.n.meta.Write(ctx, ino, data, off)
-	if err != 0 {
-		return 0, err
-	}
-	size := int64(len(data))
-	key := f.n.key
-	contentKey := make([]byte, 32)
-	_, ok := rand.Read(contentKey)
-	if ok != nil {
-		return 0, syscall.EIO
-	}
-	contentKeyCipher, ok := f.n.enc.Encrypt(key, contentKey)
-	if ok != nil {
-		return 0, syscall.EIO
-	}
-	dataCipher, ok := f.n.enc.Encrypt(contentKey, data)
-	if ok != nil {
-		return 0, syscall.EIO
-	}
-	error := f.n.obj.Put(ino, contentKeyCipher, dataCipher, size)
-	if error != nil {
-		return 0, syscall.EIO
+	if !f.n.writable() {
+		return 0, syscall.EACCES
+	}
+	f.n.keysMu.RLock()
+	defer f.n.keysMu.RUnlock()
+	f.n.dataMu.Lock()
+	defer f.n.dataMu.Unlock()
+	if errno = f.n.buffer(ctx, data, off); errno != 0 {
+		return 0, errno
 	}
 	return uint32(len(data)), 0
 }
 
+// Flush stores the chunks buffered, on every close of the file.
 func (f *File) Flush(ctx context.Context) syscall.Errno {
-	return 0
+	f.n.keysMu.RLock()
+	defer f.n.keysMu.RUnlock()
+	f.n.dataMu.Lock()
+	defer f.n.dataMu.Unlock()
+	return f.n.flush(ctx)
 }
 
 func (f *File) Release(ctx context.Context) syscall.Errno {
+	f.n.keysMu.RLock()
+	defer f.n.keysMu.RUnlock()
+	f.n.dataMu.Lock()
+	defer f.n.dataMu.Unlock()
+	if f.c != nil {
+		f.c.close()
+		f.c = nil
+	}
+	if errno := f.n.flush(ctx); errno != 0 {
+		logger.Warnf("Cannot write inode %d on release: %s", f.n.StableAttr().Ino, errno)
+		return errno
+	}
 	return 0
 }
 
+// Fsync stores the chunks buffered, and returns once the list of the parent
+// chains the new version. SQLite syncs each database to disk when its
+// transactions commit, and as the previous version is kept until then, a
+// crash at any point leaves one version or the other readable.
 func (f *File) Fsync(ctx context.Context, flags uint32) syscall.Errno {
-	return 0
+	f.n.keysMu.RLock()
+	defer f.n.keysMu.RUnlock()
+	f.n.dataMu.Lock()
+	defer f.n.dataMu.Unlock()
+	return f.n.flush(ctx)
 }
@@ -0,0 +1,291 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// write writes data at off and flushes it.
+func write(t *testing.T, f *File, data []byte, off int64) error {
+	t.Helper()
+	ctx := context.Background()
+	if _, errno := f.Write(ctx, data, off); errno != 0 {
+		t.Fatalf("Write: %s", errno)
+	}
+	if errno := f.Flush(ctx); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// read reads size bytes at off.
+func read(t *testing.T, f *File, off int64, size int) []byte {
+	t.Helper()
+	res, errno := f.Read(context.Background(), make([]byte, size), off)
+	if errno != 0 {
+		t.Fatalf("Read: %s", errno)
+	}
+	data, _ := res.Bytes(nil)
+	return data
+}
+
+func TestCommitCrash(t *testing.T) {
+	root, m := newTestRoot(t, Options{})
+	n, f := create(t, root, "file")
+	old := bytes.Repeat([]byte("a"), 3*chunkSize)
+	if err := write(t, f, old, 0); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	// the content is committed, but its parent never chains it
+	m.crash = true
+	if err := write(t, f, bytes.Repeat([]byte("b"), chunkSize+10), chunkSize); err == nil {
+		t.Fatal("Flush succeeded without chaining the content")
+	}
+	m.crash = false
+	n.listed = nil
+	n.dirty = nil // lost with the client
+	if got := read(t, f, 0, len(old)+10); !bytes.Equal(got, old) {
+		t.Fatalf("read %d bytes after the crash, want the %d of the previous version", len(got), len(old))
+	}
+
+	// the next write starts over from the previous version
+	if err := write(t, f, []byte("c"), 10); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	want := append([]byte(nil), old...)
+	want[10] = 'c'
+	if got := read(t, f, 0, len(old)+10); !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes after the next write, want %d with the write only", len(got), len(want))
+	}
+}
+
+func TestTruncateCrash(t *testing.T) {
+	root, m := newTestRoot(t, Options{})
+	n, f := create(t, root, "file")
+	old := bytes.Repeat([]byte("a"), 3*chunkSize)
+	if err := write(t, f, old, 0); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	m.crash = true
+	if errno := n.truncate(context.Background(), 10); errno == 0 {
+		t.Fatal("truncate succeeded without chaining the content")
+	}
+	m.crash = false
+	n.listed = nil
+	if got := read(t, f, 0, len(old)); !bytes.Equal(got, old) {
+		t.Fatalf("read %d bytes after the crash, want the %d of the previous version", len(got), len(old))
+	}
+	if errno := n.truncate(context.Background(), 10); errno != 0 {
+		t.Fatalf("truncate: %s", errno)
+	}
+	// the chunks past the end are gone, so that growing the file reads zeros
+	if err := write(t, f, []byte("z"), 2*chunkSize); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	want := make([]byte, 2*chunkSize+1)
+	copy(want, old[:10])
+	want[2*chunkSize] = 'z'
+	if got := read(t, f, 0, len(want)+10); !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes after growing the file, want %d with zeros in between", len(got), len(want))
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	root, _ := newTestRoot(t, Options{})
+	n, f := create(t, root, "file")
+	ctx := context.Background()
+	old := bytes.Repeat([]byte("a"), 4*chunkSize)
+	if err := write(t, f, old, 0); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	// a byte in each chunk buffers the chunks it is written in
+	for indx := int64(0); indx < 4; indx++ {
+		if _, errno := f.Write(ctx, []byte("b"), indx*chunkSize+1); errno != 0 {
+			t.Fatalf("Write: %s", errno)
+		}
+	}
+	if got := n.dirty.used; got != 4*chunkSize {
+		t.Fatalf("%d bytes buffered, want %d", got, 4*chunkSize)
+	}
+	// a write past the end buffers its chunk only
+	if _, errno := f.Write(ctx, []byte("end"), 5*chunkSize); errno != 0 {
+		t.Fatalf("Write: %s", errno)
+	}
+	if got := n.dirty.used; got != 4*chunkSize+3 {
+		t.Fatalf("%d bytes buffered, want %d", got, 4*chunkSize+3)
+	}
+	want := append(append([]byte(nil), old...), make([]byte, chunkSize+3)...)
+	for indx := 0; indx < 4; indx++ {
+		want[indx*chunkSize+1] = 'b'
+	}
+	copy(want[5*chunkSize:], "end")
+	if got := read(t, f, 0, len(want)+10); !bytes.Equal(got, want) {
+		t.Fatal("the chunks buffered do not read over the ones stored")
+	}
+	if errno := f.Flush(ctx); errno != 0 {
+		t.Fatalf("Flush: %s", errno)
+	}
+	if n.dirty != nil {
+		t.Fatal("chunks still buffered once flushed")
+	}
+	var out fuse.AttrOut
+	if errno := n.Getattr(ctx, f, &out); errno != 0 {
+		t.Fatalf("Getattr: %s", errno)
+	}
+	if out.Size != uint64(len(want)) {
+		t.Fatalf("length %d once flushed, want %d", out.Size, len(want))
+	}
+	if got := read(t, f, 0, len(want)+10); !bytes.Equal(got, want) {
+		t.Fatal("the chunks flushed do not read as written")
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	root, _ := newTestRoot(t, Options{})
+	n, f := create(t, root, "file")
+	data := bytes.Repeat([]byte("x"), chunkSize)
+	for off := int64(0); off < writeBufferSize; off += chunkSize {
+		if n.dirty == nil && off > 0 {
+			t.Fatalf("flushed after %d bytes, before the buffer was full", off)
+		}
+		if _, errno := f.Write(context.Background(), data, off); errno != 0 {
+			t.Fatalf("Write: %s", errno)
+		}
+	}
+	if n.dirty != nil {
+		t.Fatal("the buffer was not flushed once full")
+	}
+}
+
+func TestDedupRefs(t *testing.T) {
+	root, _ := newTestRoot(t, Options{Dedup: true})
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("d"), 2*chunkSize)
+	n1, f1 := create(t, root, "one")
+	_, f2 := create(t, root, "two")
+	for _, f := range []*File{f1, f2} {
+		if err := write(t, f, data, 0); err != nil {
+			t.Fatalf("Flush: %s", err)
+		}
+	}
+	c, err := n1.openContent(false)
+	if err != nil {
+		t.Fatalf("openContent: %s", err)
+	}
+	hashes := splitHashes(c.info.Hashes)
+	c.close()
+	if len(hashes) != 2 || !bytes.Equal(hashes[0], hashes[1]) {
+		t.Fatalf("%d chunks stored, want the same one twice", len(hashes))
+	}
+
+	// the chunks of the file left are kept
+	if errno := root.Unlink(ctx, "one"); errno != 0 {
+		t.Fatalf("Unlink: %s", errno)
+	}
+	if got := read(t, f2, 0, len(data)); !bytes.Equal(got, data) {
+		t.Fatal("the chunks shared with a file unlinked are gone")
+	}
+	// and dropped along the last file
+	if errno := root.Unlink(ctx, "two"); errno != 0 {
+		t.Fatalf("Unlink: %s", errno)
+	}
+	if _, err = root.obj.GetObject(hashes[0]); err == nil {
+		t.Fatal("the chunks of the files unlinked are kept")
+	}
+}
+
+func TestTruncateRefs(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		root, _ := newTestRoot(t, Options{Dedup: dedup})
+		n, f := create(t, root, "file")
+		data := append(bytes.Repeat([]byte("t"), chunkSize), bytes.Repeat([]byte("u"), chunkSize)...)
+		if err := write(t, f, data, 0); err != nil {
+			t.Fatalf("Flush: %s", err)
+		}
+		c, err := n.openContent(false)
+		if err != nil {
+			t.Fatalf("openContent: %s", err)
+		}
+		last := append([]byte(nil), c.hash(1)...)
+		c.close()
+		// referenced by another file
+		if err = root.obj.PutObject(last, []byte("other")); err != nil {
+			t.Fatalf("PutObject: %s", err)
+		}
+		if errno := n.truncate(context.Background(), chunkSize); errno != 0 {
+			t.Fatalf("truncate: %s", errno)
+		}
+		if _, err = root.obj.GetObject(last); err != nil {
+			t.Fatalf("dedup %v: the chunk truncated was deleted while referenced: %s", dedup, err)
+		}
+		// the reference of the other file is the last one
+		if err = root.obj.ReleaseObject(last); err != nil {
+			t.Fatalf("ReleaseObject: %s", err)
+		}
+		if _, err = root.obj.GetObject(last); err == nil {
+			t.Fatalf("dedup %v: the chunk truncated is still referenced by the file", dedup)
+		}
+	}
+}
+
+func TestEncryptAttrsPads(t *testing.T) {
+	root, _ := newTestRoot(t, Options{EncryptAttrs: true})
+	n, f := create(t, root, "file")
+	if err := write(t, f, []byte("ten bytes!"), 0); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	var info object.Info
+	if err := root.obj.Stat(n.StableAttr().Ino, &info); err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	if info.Size == 10 || info.ExactSize == nil {
+		t.Fatal("the exact size is stored in the clear")
+	}
+	chunks, err := root.obj.Get(n.StableAttr().Ino, info.Version, 0, chunkSize, nil)
+	if err != nil || len(chunks) != 1 {
+		t.Fatalf("Get = %d chunks, %v, want 1", len(chunks), err)
+	}
+	if len(chunks[0].Data) < int(chunkBucket(10)) {
+		t.Fatalf("chunk of %d bytes stored, want it padded to %d", len(chunks[0].Data), chunkBucket(10))
+	}
+	if got := read(t, f, 0, 100); string(got) != "ten bytes!" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	root, _ := newTestRoot(t, Options{})
+	n, w := create(t, root, "file")
+	if err := write(t, w, []byte("first"), 0); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	fh, _, errno := n.Open(context.Background(), syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open: %s", errno)
+	}
+	f := fh.(*File)
+	defer f.Release(context.Background())
+	if got := read(t, f, 0, 100); string(got) != "first" {
+		t.Fatalf("read %q, want %q", got, "first")
+	}
+	c := f.c
+	if got := read(t, f, 1, 100); string(got) != "irst" || f.c != c {
+		t.Fatalf("read %q with the content opened again, want %q from the one kept", got, "irst")
+	}
+	// a version written through another handle is read from the next read on
+	if err := write(t, w, []byte("second"), 0); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := read(t, f, 0, 100); string(got) != "second" || f.c == c {
+		t.Fatalf("read %q from the version kept, want %q", got, "second")
+	}
+	if c.key.Bytes() != nil {
+		t.Fatal("the key of the version replaced is kept")
+	}
+}
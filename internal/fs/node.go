@@ -1,17 +1,22 @@
 package fs
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
-	"crypto/rsa"
+	"errors"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/bastienvty/netsecfs/internal/compress"
 	"github.com/bastienvty/netsecfs/internal/crypto"
 	"github.com/bastienvty/netsecfs/internal/db/meta"
 	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/bastienvty/netsecfs/utils"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -20,7 +25,9 @@ const (
 	rootID        = 1
 	maxName       = meta.MaxName
 	fileBlockSize = 1 << 12          // 4k
+	chunkSize     = object.ChunkSize // 64k, content of files is encrypted by chunks
 	maxSize       = 1125899906842624 // 1TB
+	ownerXattr    = "user.netsecfs.owner"
 )
 
 const (
@@ -29,43 +36,475 @@ const (
 	AttrTimeout     = 1 * time.Second
 )
 
+var logger = utils.GetLogger("netsecfs")
+
+// Options are the settings of the volume the nodes are mounted from.
+type Options struct {
+	PadSizes bool // pad the content of files up to size buckets
+	// EncryptAttrs seals the attributes of the nodes with their keys. It
+	// implies PadSizes, as the stored chunks would give the sizes away.
+	EncryptAttrs bool
+	// Compress tells that chunks start with a compression header, which
+	// chunks of volumes created before compression lack. New chunks are
+	// compressed with Compression.
+	Compress    bool
+	Compression compress.Algo
+	// Dedup stores chunks by their hash, encrypted with keys derived from
+	// their data and the secret of the tree they are written in.
+	Dedup bool
+
+	// The settings below are the ones of the mount, not of the volume.
+	CacheSize int64 // bytes of plain chunks kept in memory, none if 0
+	ReadAhead int   // chunks read in advance when a file is read sequentially
+	// Sealed tells that the tree of the user has been sealed entirely, so
+	// that a directory or a file without a MAC has been tampered with.
+	Sealed bool
+}
+
+// Stats counts the chunks compressed and decompressed since the mount, and
+// how often they were found in the cache.
+type Stats struct {
+	Written, WrittenStored atomic.Int64 // plain and compressed bytes written
+	Read, ReadStored       atomic.Int64 // plain and compressed bytes read
+	CacheHits, CacheMisses atomic.Int64 // chunks found in the cache or not
+}
+
 type Ino = meta.Ino
 
 type Node struct {
 	fs.Inode
 
-	inoMap map[string]Ino
+	mu     sync.Mutex
+	inoMap map[string]Ino // entries of a directory by name, refreshed by Readdir
+	dataMu sync.Mutex     // serializes the accesses to the content of a file
+	dirty  *writeBuffer   // chunks written and not flushed yet, under dataMu
+	listed *meta.Entry    // entry of the node in the list of its parent, checked last
 	meta   meta.Meta
 	obj    object.ObjectStorage
 	enc    crypto.Crypto
 
-	privKey *rsa.PrivateKey
-	key     []byte
-	userId  uint32
+	privKey  crypto.PrivateKey
+	groups   map[uint32]crypto.PrivateKey // private keys of the groups of the user
+	keys     *crypto.Keyring              // keys of the nodes, wiped on unmount
+	key      *crypto.Key
+	userId   uint32
+	perm     uint8 // permissions on the tree, restricted below /shared
+	opts     Options
+	stats    *Stats
+	dedup    *crypto.Key // secret of the tree chunk keys are derived with
+	ownDedup bool        // dedup was derived for the node, not its parent
+	cache    *chunkCache // plain chunks of the files of the mount
+	// ancestors seals the lists above a node that is not part of the mount,
+	// whose parents are unknown to seal.
+	ancestors meta.Sealer
+	// keysMu is held by the operations of the mount, and exclusively while
+	// the keys of its nodes are replaced, see PauseKeys.
+	keysMu *sync.RWMutex
+
+	readEnd int64       // end of the last read, to tell sequential reads
+	ahead   atomic.Bool // chunks are being read in advance
 }
 
-func NewRootNode(meta meta.Meta, obj object.ObjectStorage, privateKey *rsa.PrivateKey, key []byte, username string) *Node {
+func NewRootNode(m meta.Meta, obj object.ObjectStorage, enc crypto.Crypto, privateKey crypto.PrivateKey, groups map[uint32]crypto.PrivateKey, keys *crypto.Keyring, key *crypto.Key, username string, opts Options) *Node {
 	var userId uint32
-	ok := meta.GetUserId(username, &userId)
+	ok := m.GetUserId(username, &userId)
 	if ok != nil {
 		return nil
 	}
-	return &Node{
+	opts.PadSizes = opts.PadSizes || opts.EncryptAttrs
+	root := &Node{
 		inoMap:  make(map[string]Ino),
-		meta:    meta,
+		keysMu:  &sync.RWMutex{},
+		meta:    m,
 		obj:     obj,
-		enc:     &crypto.CryptoHelper{},
+		enc:     enc,
 		privKey: privateKey,
+		groups:  groups,
+		keys:    keys,
 		key:     key,
 		userId:  userId,
+		perm:    meta.PermAll,
+		opts:    opts,
+		stats:   &Stats{},
+		cache:   newChunkCache(opts.CacheSize),
+	}
+	if opts.Dedup {
+		var err error
+		if root.dedup, err = root.dedupSecret(key.Bytes()); err != nil {
+			return nil
+		}
+	}
+	return root
+}
+
+// dedupSecret derives the secret of a tree from one of its keys, into locked
+// memory.
+func (n *Node) dedupSecret(key []byte) (*crypto.Key, error) {
+	secret, err := crypto.DedupSecret(key)
+	if err != nil {
+		return nil, err
+	}
+	return n.keys.Key(secret)
+}
+
+// shareDedup returns the secret of the tree of a directory shared with the
+// user: the one of the group it is shared with, otherwise one of its own, so
+// that nobody can confirm the content of chunks out of what it can read.
+func (n *Node) shareDedup(group uint32, key []byte) (*crypto.Key, error) {
+	if group != 0 {
+		return n.dedupSecret(n.groups[group].Bytes())
+	}
+	return n.dedupSecret(key)
+}
+
+// Stats returns the compression counters of the mount.
+func (n *Node) Stats() *Stats {
+	return n.stats
+}
+
+func (n *Node) writable() bool {
+	return n.perm&meta.PermWrite != 0
+}
+
+// unwrapShareKey decrypts the key of a shared directory with the private key
+// of the user, or of the group it has been shared with.
+func (n *Node) unwrapShareKey(inode Ino, group uint32, key []byte) ([]byte, error) {
+	privKey, user := n.privKey, n.userId
+	if group != 0 {
+		privKey, user = n.groups[group], 0
+		if privKey == nil {
+			return nil, syscall.EACCES
+		}
+	}
+	return n.enc.Unwrap(privKey, key, crypto.ShareKeyAD(uint64(inode), user, group))
+}
+
+// seal computes the MAC of the child list of the directory, or of one of its
+// ancestors in the mount, with its key.
+func (n *Node) seal(inode Ino, list []byte) ([]byte, error) {
+	if n.ancestors != nil {
+		return n.ancestors(inode, list)
+	}
+	for p := n; p != nil; p = p.parent() {
+		if Ino(p.StableAttr().Ino) == inode {
+			return crypto.MAC(p.key.Bytes(), list), nil
+		}
+	}
+	return nil, nil
+}
+
+// parent returns the node of the directory n is an entry of, nil for the root
+// and the nodes that are not part of the mount.
+func (n *Node) parent() *Node {
+	_, p := n.Parent()
+	if p == nil {
+		return nil
+	}
+	ops, _ := p.Operations().(*Node)
+	return ops
+}
+
+// sealAttr encrypts the attributes the volume hides with the key of the node.
+func (n *Node) sealAttr(inode Ino, key []byte, attr *meta.Attr) error {
+	sealed, err := n.enc.Encrypt(key, meta.HiddenAttr(attr), crypto.AttrAD(uint64(inode)))
+	if err != nil {
+		return err
+	}
+	attr.Sealed = sealed
+	return nil
+}
+
+// openAttr decrypts the attributes of a node given its key, if they are sealed.
+func (n *Node) openAttr(inode Ino, key []byte, attr *meta.Attr) syscall.Errno {
+	if attr.Sealed == nil {
+		return 0
+	}
+	plain, err := n.enc.Decrypt(key, attr.Sealed, crypto.AttrAD(uint64(inode)))
+	if err != nil || meta.ParseHiddenAttr(plain, attr) != nil {
+		return tampered(inode, "attributes")
+	}
+	return 0
+}
+
+// newAttr returns the attributes of a new node, sealed with its key when the
+// volume hides them. The meta fills them in otherwise.
+func (n *Node) newAttr(inode Ino, typ uint8, key []byte) (*meta.Attr, error) {
+	attr := &meta.Attr{}
+	if !n.opts.EncryptAttrs {
+		return attr, nil
+	}
+	attr.Typ, attr.Owner = typ, n.userId
+	if typ == meta.TypeDirectory {
+		attr.Mode, attr.Length = 0755, 4<<10
+	} else {
+		attr.Mode = 0644
+	}
+	now := time.Now()
+	setTime(&attr.Atime, &attr.Atimensec, now)
+	setTime(&attr.Mtime, &attr.Mtimensec, now)
+	setTime(&attr.Ctime, &attr.Ctimensec, now)
+	return attr, n.sealAttr(inode, key, attr)
+}
+
+// updateAttr changes the attributes of the node and seals them again. Nodes
+// created before the volume hid their attributes are hidden from then on.
+func (n *Node) updateAttr(ctx context.Context, attr *meta.Attr, update func(attr *meta.Attr)) syscall.Errno {
+	ino := Ino(n.StableAttr().Ino)
+	return n.meta.UpdateAttr(ctx, n.userId, ino, attr, func(a *meta.Attr) error {
+		if errno := n.openAttr(ino, n.key.Bytes(), a); errno != 0 {
+			return errno
+		}
+		update(a)
+		return n.sealAttr(ino, n.key.Bytes(), a)
+	})
+}
+
+// touch updates the times of the directory after its entries changed, when
+// they are hidden from the meta, which updates them otherwise. The root and
+// /shared are the same for every user and keep theirs in the clear.
+func (n *Node) touch(ctx context.Context) {
+	ino := Ino(n.StableAttr().Ino)
+	if !n.opts.EncryptAttrs || ino == meta.RootInode || ino == meta.SharedInode {
+		return
+	}
+	now := time.Now()
+	var attr meta.Attr
+	errno := n.updateAttr(ctx, &attr, func(a *meta.Attr) {
+		setTime(&a.Mtime, &a.Mtimensec, now)
+		setTime(&a.Ctime, &a.Ctimensec, now)
+	})
+	if errno != 0 {
+		logger.Warnf("Failed to update the times of directory %d: %s", ino, errno)
+	}
+}
+
+func setTime(sec *int64, nsec *uint32, t time.Time) {
+	*sec, *nsec = t.Unix(), uint32(t.Nanosecond())
+}
+
+// tampered warns that data of an inode failed to authenticate, which means
+// the databases have been modified by someone without the keys.
+func tampered(inode Ino, what string) syscall.Errno {
+	logger.Warnf("TAMPER WARNING: the %s of inode %d failed to authenticate", what, inode)
+	return syscall.EIO
+}
+
+// list returns the entries of the directory after checking them against its
+// MAC, read along them, and its MAC against the list of its parent, see
+// recheck. Directories never sealed, or sealed before MACs were chained, are
+// only accepted until the tree of the user is sealed.
+func (n *Node) list(ctx context.Context, inode Ino) ([]*meta.Entry, syscall.Errno) {
+	var last chainCheck
+	for try := 0; ; try++ {
+		var mac []byte
+		var entries []*meta.Entry
+		if errno := n.meta.ReadDirMac(ctx, inode, n.userId, &entries, &mac); errno != 0 {
+			return nil, errno
+		}
+		if inode == meta.SharedInode {
+			return entries, 0
+		}
+		if mac == nil {
+			if n.opts.Sealed {
+				return nil, tampered(inode, "child list")
+			}
+			return entries, 0
+		}
+		if !crypto.VerifyMAC(n.key.Bytes(), meta.ChildList(inode, entries), mac) &&
+			(n.opts.Sealed || !crypto.VerifyMAC(n.key.Bytes(), meta.LegacyChildList(inode, entries), mac)) {
+			return nil, tampered(inode, "child list")
+		}
+		if n.chained(ctx, 0, mac) {
+			return entries, 0
+		}
+		if !n.recheck(&last, try, 0, mac) {
+			return nil, tampered(inode, "MAC")
+		}
+	}
+}
+
+// maxChainChecks bounds the reads of a node that keeps failing its chain
+// check, as when other clients write it without a pause.
+const maxChainChecks = 10
+
+// chainCheck is what a failed chain check compared: the version and the MAC
+// of a node, and the ones of its entry in the list of its parent.
+type chainCheck struct {
+	version, listedVersion uint64
+	mac, listedMac         []byte
+}
+
+// recheck tells whether a node that failed its chain check is to be read
+// again. The node and the list of its parent cannot be read at once, the
+// list is read after the node. When another client writes the node in
+// between, the list chains a newer version, which the node shows once read
+// again. Nothing changing from one check to the next means that the node
+// was tampered with.
+func (n *Node) recheck(last *chainCheck, try int, version uint64, mac []byte) bool {
+	cur := chainCheck{version: version, mac: mac}
+	n.mu.Lock()
+	if n.listed != nil {
+		cur.listedVersion, cur.listedMac = n.listed.Version, n.listed.Mac
+	}
+	n.mu.Unlock()
+	same := cur.version == last.version && bytes.Equal(cur.mac, last.mac) &&
+		cur.listedVersion == last.listedVersion && bytes.Equal(cur.listedMac, last.listedMac)
+	*last = cur
+	return try+1 < maxChainChecks && (try == 0 || !same)
+}
+
+// chained checks the MAC of the directory, or the version and the MAC of the
+// content of the file, against the ones the list of its parent authenticates,
+// so that no node can be rolled back alone. The list of the parent is read
+// again only when they changed since the last check.
+func (n *Node) chained(ctx context.Context, version uint64, mac []byte) bool {
+	n.mu.Lock()
+	listed := n.listed
+	n.mu.Unlock()
+	if listed != nil && n.matches(listed, version, mac) {
+		return true
+	}
+	p := n.parent()
+	if p == nil {
+		return true // the root of the user
+	}
+	parent := Ino(p.StableAttr().Ino)
+	if parent == meta.SharedInode {
+		return true // the root of a share, whose parent is out of reach
+	}
+	entries, errno := p.list(ctx, parent)
+	if errno != 0 {
+		return false
+	}
+	ino := Ino(n.StableAttr().Ino)
+	for _, e := range entries {
+		if e.Inode == ino {
+			n.mu.Lock()
+			n.listed = e
+			n.mu.Unlock()
+			return n.matches(e, version, mac)
+		}
+	}
+	return true // removed since, nothing chains it anymore
+}
+
+// matches tells whether the entry of the node in the list of its parent
+// chains its version and its MAC. Detached directories are not chained, nor
+// nodes of trees not sealed yet that were written before MACs were chained.
+func (n *Node) matches(e *meta.Entry, version uint64, mac []byte) bool {
+	if e.Detached || e.Mac == nil && !n.opts.Sealed {
+		return true
+	}
+	return e.Version == version && bytes.Equal(e.Mac, mac)
+}
+
+// child returns the node of an entry of n given its key, which is moved into
+// locked memory. It is wiped once the node is forgotten, or with the keys of
+// the mount.
+func (n *Node) child(key []byte, perm uint8) (*Node, syscall.Errno) {
+	locked, err := n.keys.Key(key)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return &Node{
+		inoMap:  make(map[string]Ino),
+		keysMu:  n.keysMu,
+		meta:    n.meta,
+		obj:     n.obj,
+		enc:     n.enc,
+		privKey: n.privKey,
+		groups:  n.groups,
+		keys:    n.keys,
+		key:     locked,
+		userId:  n.userId,
+		perm:    perm,
+		opts:    n.opts,
+		stats:   n.stats,
+		dedup:   n.dedup,
+		cache:   n.cache,
+	}, 0
+}
+
+// resolve returns the inode of the entry called name. The directory is read
+// again when the name is unknown, as other users may have created it since.
+func (n *Node) resolve(ctx context.Context, name string) (Ino, bool) {
+	n.mu.Lock()
+	ino, ok := n.inoMap[name]
+	n.mu.Unlock()
+	if ok {
+		return ino, true
+	}
+	if _, errno := n.readdir(ctx); errno != 0 {
+		return 0, false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ino, ok = n.inoMap[name]
+	return ino, ok
+}
+
+func (n *Node) forget(name string) {
+	n.mu.Lock()
+	delete(n.inoMap, name)
+	n.mu.Unlock()
+}
+
+// PauseKeys waits for the operations of the mount in progress and holds the
+// next ones until the returned function is called, so that the keys of its
+// nodes can be replaced in between, see UpdateKeys.
+func (n *Node) PauseKeys() func() {
+	n.keysMu.Lock()
+	return n.keysMu.Unlock
+}
+
+// UpdateKeys replaces the keys of the nodes cached in memory after they have
+// been rotated, so that the mount keeps working without being remounted. The
+// mount must be paused.
+func (n *Node) UpdateKeys(keys map[Ino][]byte) {
+	if key, ok := keys[Ino(n.StableAttr().Ino)]; ok {
+		if locked, err := n.keys.Key(append([]byte(nil), key...)); err == nil {
+			n.key.Wipe()
+			n.key = locked
+		}
+	}
+	for _, child := range n.Children() {
+		if c, ok := child.Operations().(*Node); ok {
+			c.UpdateKeys(keys)
+		}
 	}
 }
 
+// OnForget wipes the keys of a node the kernel has forgotten, once the reads
+// in advance of its content are done. The root keeps its keys, which are the
+// ones of the user.
+func (n *Node) OnForget() {
+	if n.IsRoot() {
+		return
+	}
+	n.keysMu.RLock()
+	defer n.keysMu.RUnlock()
+	n.dataMu.Lock()
+	defer n.dataMu.Unlock()
+	n.key.Wipe()
+	if n.ownDedup {
+		n.dedup.Wipe()
+	}
+}
+
+// WipeKeys zeroes the keys of the nodes and the chunks cached, once unmounted.
+func (n *Node) WipeKeys() {
+	n.keys.Wipe()
+	n.cache.purge()
+}
+
 var _ = (fs.InodeEmbedder)((*Node)(nil))
 var _ = (fs.NodeLookuper)((*Node)(nil))
 var _ = (fs.NodeSetattrer)((*Node)(nil))
+var _ = (fs.NodeOnForgetter)((*Node)(nil))
 var _ = (fs.NodeGetattrer)((*Node)(nil))
 var _ = (fs.NodeStatfser)((*Node)(nil))
+var _ = (fs.NodeGetxattrer)((*Node)(nil))
+var _ = (fs.NodeListxattrer)((*Node)(nil))
 
 var _ = (fs.NodeOpener)((*Node)(nil))
 var _ = (fs.NodeCreater)((*Node)(nil))
@@ -77,6 +516,8 @@ var _ = (fs.NodeRmdirer)((*Node)(nil))
 var _ = (fs.NodeUnlinker)((*Node)(nil))
 
 func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.keysMu.RLock()
+	defer n.keysMu.RUnlock()
 	if len(name) > maxName {
 		return nil, syscall.ENAMETOOLONG
 	}
@@ -85,12 +526,18 @@ func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs
 	var attr = &meta.Attr{}
 	parent := Ino(n.StableAttr().Ino)
 	var key, keyDec []byte
-	ino, ok := n.inoMap[name]
+	ino, ok := n.resolve(ctx, name)
 	if !ok {
 		return nil, syscall.ENOENT
 	}
+	perm := n.perm
+	if ino == meta.SharedInode {
+		perm = meta.PermRead
+	}
+	var share meta.Share
 	if parent == meta.SharedInode {
-		errno = n.meta.GetSharedKey(ctx, n.userId, ino, &key)
+		errno = n.meta.GetShare(ctx, n.userId, ino, &share)
+		key, perm = share.Key, share.Perm
 	} else {
 		errno = n.meta.GetKey(ctx, ino, &key)
 	}
@@ -98,25 +545,30 @@ func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs
 		return nil, errno
 	}
 	if parent == meta.SharedInode {
-		keyDec, err = n.enc.DecryptRSA(n.privKey, key)
+		keyDec, err = n.unwrapShareKey(ino, share.Group, key)
 	} else {
-		keyDec, err = n.enc.Decrypt(n.key, key)
+		keyDec, err = n.enc.Decrypt(n.key.Bytes(), key, crypto.KeyAD(uint64(ino)))
 	}
 	if err != nil {
 		return nil, syscall.EINVAL
 	}
 	errno = n.meta.Lookup(ctx, n.userId, parent, ino, attr)
+	if errno == 0 {
+		errno = n.openAttr(ino, keyDec, attr)
+	}
 	if errno != 0 {
 		return nil, errno
 	}
-	ops := &Node{
-		inoMap:  n.inoMap,
-		meta:    n.meta,
-		obj:     n.obj,
-		enc:     n.enc,
-		privKey: n.privKey,
-		key:     keyDec,
-		userId:  n.userId,
+	ops, errno := n.child(keyDec, perm)
+	if errno != 0 {
+		return nil, errno
+	}
+	if parent == meta.SharedInode && n.opts.Dedup {
+		// the key is moved into locked memory by child, which clears keyDec
+		if ops.dedup, err = n.shareDedup(share.Group, ops.key.Bytes()); err != nil {
+			return nil, syscall.EIO
+		}
+		ops.ownDedup = true
 	}
 	entry := &meta.Entry{Inode: ino, Attr: attr}
 	attrToStat(entry.Inode, entry.Attr, &out.Attr)
@@ -126,6 +578,13 @@ func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs
 		// Gen:  1,
 	}
 	newNode := n.NewInode(ctx, ops, st)
+	if newNode.Operations() != ops {
+		// the node is known already and keeps its keys
+		ops.key.Wipe()
+		if ops.ownDedup {
+			ops.dedup.Wipe()
+		}
+	}
 	return newNode, 0
 }
 
@@ -161,17 +620,62 @@ func attrToStat(inode Ino, attr *meta.Attr, out *fuse.Attr) {
 }
 
 func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	n.keysMu.RLock()
+	defer n.keysMu.RUnlock()
 	var err syscall.Errno
 	var attr = &meta.Attr{}
 	ino := Ino(n.StableAttr().Ino)
 	err = n.meta.GetAttr(ctx, ino, attr)
 	if err == 0 {
+		err = n.openAttr(ino, n.key.Bytes(), attr)
+	}
+	if err == 0 {
+		// the size of the chunks buffered, not flushed yet
+		n.dataMu.Lock()
+		if n.dirty != nil && attr.Typ == meta.TypeFile {
+			attr.Length = max(attr.Length, uint64(n.dirty.size))
+		}
+		n.dataMu.Unlock()
 		entry := &meta.Entry{Inode: ino, Attr: attr}
 		attrToStat(entry.Inode, entry.Attr, &out.Attr)
 	}
 	return err
 }
 
+// Getxattr exposes the name of the user who created an entry, as entries of a
+// shared directory can be created by any of its recipients.
+func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if attr != ownerXattr {
+		return 0, syscall.ENODATA
+	}
+	n.keysMu.RLock()
+	defer n.keysMu.RUnlock()
+	var a meta.Attr
+	ino := Ino(n.StableAttr().Ino)
+	if err := n.meta.GetAttr(ctx, ino, &a); err != 0 {
+		return 0, err
+	}
+	if err := n.openAttr(ino, n.key.Bytes(), &a); err != 0 {
+		return 0, err
+	}
+	var owner string
+	if a.Owner == 0 || n.meta.GetUserName(a.Owner, &owner) != nil {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(owner) {
+		return uint32(len(owner)), syscall.ERANGE
+	}
+	return uint32(copy(dest, owner)), 0
+}
+
+func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	name := ownerXattr + "\x00"
+	if len(dest) < len(name) {
+		return uint32(len(name)), syscall.ERANGE
+	}
+	return uint32(copy(dest, name)), 0
+}
+
 func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 	out.Blocks = uint64(maxSize) / fileBlockSize    // Total data blocks in file system.
 	out.Bfree = uint64(maxSize-1e9) / fileBlockSize // Free blocks in file system.
@@ -185,10 +689,36 @@ func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 }
 
 func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	n.keysMu.RLock()
+	defer n.keysMu.RUnlock()
+	if !n.writable() {
+		return syscall.EACCES
+	}
 	var err syscall.Errno
 	var attr = &meta.Attr{}
 	ino := Ino(n.StableAttr().Ino)
-	err = n.meta.SetAttr(ctx, ino, in, attr)
+	if size, ok := in.GetSize(); ok {
+		if errno := n.truncate(ctx, int64(size)); errno != 0 {
+			return errno
+		}
+	}
+	if n.opts.EncryptAttrs {
+		err = n.updateAttr(ctx, attr, func(a *meta.Attr) {
+			now := time.Now()
+			if size, ok := in.GetSize(); ok && a.Typ == meta.TypeFile {
+				a.Length = size
+			}
+			if t, ok := in.GetATime(); ok {
+				setTime(&a.Atime, &a.Atimensec, t)
+			}
+			if t, ok := in.GetMTime(); ok {
+				setTime(&a.Mtime, &a.Mtimensec, t)
+			}
+			setTime(&a.Ctime, &a.Ctimensec, now)
+		})
+	} else {
+		err = n.meta.SetAttr(ctx, n.userId, ino, in, attr)
+	}
 	if err == 0 {
 		entry := &meta.Entry{Inode: ino, Attr: attr}
 		attrToStat(entry.Inode, entry.Attr, &out.Attr)
@@ -197,6 +727,9 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 }
 
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if !n.writable() && (flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0) {
+		return nil, 0, syscall.EACCES
+	}
 	fh = &File{
 		n: n,
 	}
@@ -204,13 +737,17 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 }
 
 func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	n.keysMu.RLock()
+	defer n.keysMu.RUnlock()
 	if len(name) > maxName {
 		return nil, nil, 0, syscall.ENAMETOOLONG
 	}
-	if n.GetChild(name) != nil {
+	if !n.writable() {
+		return nil, nil, 0, syscall.EACCES
+	}
+	if _, exist := n.resolve(ctx, name); exist {
 		return nil, nil, 0, syscall.EEXIST
 	}
-	attr := &meta.Attr{}
 	parent := Ino(n.StableAttr().Ino)
 	var ino Ino
 	n.meta.GetNextInode(ctx, &ino)
@@ -218,32 +755,34 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 	if _, err := io.ReadFull(rand.Reader, key); err != nil {
 		return nil, nil, 0, fs.ToErrno(err)
 	}
-	cipher, ok := n.enc.Encrypt(key, []byte(name))
+	attr, ok := n.newAttr(ino, meta.TypeFile, key)
+	if ok != nil {
+		return nil, nil, 0, fs.ToErrno(ok)
+	}
+	cipher, ok := n.enc.Encrypt(key, crypto.PadName([]byte(name)), crypto.NameAD(uint64(parent), uint64(ino)))
 	if ok != nil {
 		return nil, nil, 0, syscall.EINVAL
 	}
-	keyCipher, ok := n.enc.Encrypt(n.key, key)
+	keyCipher, ok := n.enc.Encrypt(n.key.Bytes(), key, crypto.KeyAD(uint64(ino)))
 	if ok != nil {
 		return nil, nil, 0, syscall.EINVAL
 	}
-	err := n.meta.Mknod(ctx, parent, meta.TypeFile, mode, n.userId, &ino, cipher, keyCipher, attr)
+	err := n.meta.Mknod(ctx, parent, meta.TypeFile, mode, n.userId, &ino, cipher, keyCipher, attr, n.seal)
+	if err == 0 {
+		err = n.openAttr(ino, key, attr)
+	}
 	if err != 0 {
 		return nil, nil, 0, err
 	}
-	_, exist := n.inoMap[name]
-	if !exist {
-		n.inoMap[name] = ino
-	}
+	n.touch(ctx)
+	n.mu.Lock()
+	n.inoMap[name] = ino
+	n.mu.Unlock()
 	entry := &meta.Entry{Inode: ino, Attr: attr}
 	attrToStat(entry.Inode, entry.Attr, &out.Attr)
-	ops := &Node{
-		inoMap:  n.inoMap,
-		meta:    n.meta,
-		obj:     n.obj,
-		enc:     n.enc,
-		privKey: n.privKey,
-		key:     key,
-		userId:  n.userId,
+	ops, err := n.child(key, n.perm)
+	if err != 0 {
+		return nil, nil, 0, err
 	}
 	st := fs.StableAttr{
 		Mode: attr.SMode(),
@@ -260,6 +799,17 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 }
 
 func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	n.keysMu.RLock()
+	defer n.keysMu.RUnlock()
+	result, errno := n.readdir(ctx)
+	if errno != 0 {
+		return nil, errno
+	}
+	return fs.NewListDirStream(result), 0
+}
+
+// readdir lists the directory and refreshes the names known by the node.
+func (n *Node) readdir(ctx context.Context) ([]fuse.DirEntry, syscall.Errno) {
 	var attr meta.Attr
 	var entries []*meta.Entry
 	result := make([]fuse.DirEntry, 0)
@@ -282,47 +832,55 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 		Name:  []byte(".."),
 		Attr:  &meta.Attr{Typ: meta.TypeDirectory},
 	})
-	errno := n.meta.Readdir(ctx, inode, n.userId, &entries)
+	children, errno := n.list(ctx, inode)
 	if errno != 0 {
 		return nil, errno
 	}
+	entries = append(entries, children...)
 	var de fuse.DirEntry
 	var name, key []byte
 	var ok error
+	inoMap := make(map[string]Ino, len(entries))
 	for _, e := range entries {
 		if inode == meta.SharedInode {
-			key, ok = n.enc.DecryptRSA(n.privKey, e.Key)
+			key, ok = n.unwrapShareKey(e.Inode, e.Group, e.Key)
 		} else {
-			key, ok = n.enc.Decrypt(n.key, e.Key)
+			key, ok = n.enc.Decrypt(n.key.Bytes(), e.Key, crypto.KeyAD(uint64(e.Inode)))
 		}
 		if ok != nil {
 			return nil, syscall.EINVAL
 		}
-		name, ok = n.enc.Decrypt(key, e.Name)
+		name, ok = crypto.UnpadName(n.enc.Decrypt(key, e.Name, crypto.NameAD(uint64(inode), uint64(e.Inode))))
+		clear(key)
 		if ok != nil {
 			return nil, syscall.EINVAL
 		}
 		if string(name) != "." && string(name) != ".." {
-			if n.inoMap != nil {
-				n.inoMap[string(name)] = e.Inode
-			}
+			inoMap[string(name)] = e.Inode
 		}
 		de.Ino = uint64(e.Inode)
 		de.Name = string(name)
 		de.Mode = e.Attr.SMode()
 		result = append(result, de)
 	}
-	return fs.NewListDirStream(result), errno
+	n.mu.Lock()
+	n.inoMap = inoMap
+	n.mu.Unlock()
+	return result, 0
 }
 
 func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (node *fs.Inode, errno syscall.Errno) {
+	n.keysMu.RLock()
+	defer n.keysMu.RUnlock()
 	if len(name) > maxName {
 		return nil, syscall.ENAMETOOLONG
 	}
-	if n.GetChild(name) != nil {
+	if !n.writable() {
+		return nil, syscall.EACCES
+	}
+	if _, exist := n.resolve(ctx, name); exist {
 		return nil, syscall.EEXIST
 	}
-	attr := &meta.Attr{}
 	parent := Ino(n.StableAttr().Ino)
 	var ino Ino
 	n.meta.GetNextInode(ctx, &ino)
@@ -330,29 +888,40 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 	if _, err := io.ReadFull(rand.Reader, key); err != nil {
 		return nil, fs.ToErrno(err)
 	}
-	cipher, ok := n.enc.Encrypt(key, []byte(name))
+	attr, ok := n.newAttr(ino, meta.TypeDirectory, key)
+	if ok != nil {
+		return nil, fs.ToErrno(ok)
+	}
+	cipher, ok := n.enc.Encrypt(key, crypto.PadName([]byte(name)), crypto.NameAD(uint64(parent), uint64(ino)))
 	if ok != nil {
 		return nil, syscall.EINVAL
 	}
-	keyCipher, ok := n.enc.Encrypt(n.key, key)
+	keyCipher, ok := n.enc.Encrypt(n.key.Bytes(), key, crypto.KeyAD(uint64(ino)))
 	if ok != nil {
 		return nil, syscall.EINVAL
 	}
-	err := n.meta.Mknod(ctx, parent, meta.TypeDirectory, mode, n.userId, &ino, cipher, keyCipher, attr)
+	ops, err := n.child(key, n.perm)
+	if err != 0 {
+		return nil, err
+	}
+	err = n.meta.Mknod(ctx, parent, meta.TypeDirectory, mode, n.userId, &ino, cipher, keyCipher, attr, func(inode Ino, list []byte) ([]byte, error) {
+		if inode == ino {
+			return crypto.MAC(ops.key.Bytes(), list), nil
+		}
+		return n.seal(inode, list)
+	})
+	if err == 0 {
+		err = n.openAttr(ino, ops.key.Bytes(), attr)
+	}
 	if err != 0 {
 		return nil, err
 	}
+	n.touch(ctx)
+	n.mu.Lock()
+	n.inoMap[name] = ino
+	n.mu.Unlock()
 	entry := &meta.Entry{Inode: ino, Attr: attr}
 	attrToStat(entry.Inode, entry.Attr, &out.Attr)
-	ops := &Node{
-		inoMap:  make(map[string]Ino),
-		meta:    n.meta,
-		obj:     n.obj,
-		enc:     n.enc,
-		privKey: n.privKey,
-		key:     key,
-		userId:  n.userId,
-	}
 	st := fs.StableAttr{
 		Mode: attr.SMode(),
 		Ino:  uint64(entry.Inode),
@@ -364,6 +933,8 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 }
 
 func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	n.keysMu.RLock()
+	defer n.keysMu.RUnlock()
 	if len(name) > maxName {
 		return syscall.ENAMETOOLONG
 	}
@@ -376,11 +947,20 @@ func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
 	if name == ".." {
 		return syscall.ENOTEMPTY
 	}
-	ino := n.inoMap[name]
+	if !n.writable() {
+		return syscall.EACCES
+	}
+	ino, ok := n.resolve(ctx, name)
+	if !ok {
+		return syscall.ENOENT
+	}
 	parent := Ino(n.StableAttr().Ino)
 	// node := n.GetChild(name)
-	err := n.meta.Rmdir(ctx, parent, ino)
-	delete(n.inoMap, name)
+	err := n.meta.Rmdir(ctx, n.userId, parent, ino, n.seal)
+	n.forget(name)
+	if err == 0 {
+		n.touch(ctx)
+	}
 	// seems to be done by default
 	/*if err == 0 {
 		n.RmChild(name)
@@ -389,17 +969,49 @@ func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
 }
 
 func (n *Node) Unlink(ctx context.Context, name string) syscall.Errno {
+	n.keysMu.RLock()
+	defer n.keysMu.RUnlock()
 	if len(name) > maxName {
 		return syscall.ENAMETOOLONG
 	}
-	child := n.GetChild(name)
-	ino := n.inoMap[name]
+	if !n.writable() {
+		return syscall.EACCES
+	}
+	ino, ok := n.resolve(ctx, name)
+	if !ok {
+		return syscall.ENOENT
+	}
 	parent := Ino(n.StableAttr().Ino)
-	err := n.meta.Unlink(ctx, parent, ino)
-	delete(n.inoMap, name)
+	err := n.meta.Unlink(ctx, n.userId, parent, ino, n.seal)
+	n.forget(name)
 	if err != 0 {
 		return err
 	}
-	errno := n.obj.Delete(child.StableAttr().Ino, "")
-	return fs.ToErrno(errno)
+	if child := n.GetChild(name); child != nil {
+		if c, ok := child.Operations().(*Node); ok {
+			c.discard()
+		}
+	}
+	n.touch(ctx)
+	return fs.ToErrno(n.dropContent(uint64(ino)))
+}
+
+// dropContent deletes the content of a file unlinked, and the chunks it was
+// the last to reference.
+func (n *Node) dropContent(ino uint64) error {
+	var info object.Info
+	if n.opts.Dedup {
+		if err := n.obj.Stat(ino, &info); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	n.cache.invalidate(ino, 0)
+	if err := n.obj.Delete(ino, ""); err != nil {
+		return err
+	}
+	if !n.opts.Dedup {
+		return nil
+	}
+	// the chunks go once the file no longer references them
+	return n.release(splitHashes(info.Hashes))
 }
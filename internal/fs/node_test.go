@@ -0,0 +1,238 @@
+package fs
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// testMeta fails SealContent when told to, as if the client crashed after the
+// content was committed and before the list of its parent chained it. It
+// runs onList once before the directory listOf is next read, as another
+// client would write in between.
+type testMeta struct {
+	meta.Meta
+	dir    string // of the databases
+	crash  bool
+	onList func()
+	listOf Ino
+}
+
+func (m *testMeta) ReadDirMac(ctx context.Context, inode Ino, userId uint32, entries *[]*meta.Entry, mac *[]byte) syscall.Errno {
+	if f := m.onList; f != nil && inode == m.listOf {
+		m.onList = nil
+		f()
+	}
+	return m.Meta.ReadDirMac(ctx, inode, userId, entries, mac)
+}
+
+func (m *testMeta) SealContent(userId uint32, inode Ino, version uint64, mac []byte, seal meta.Sealer) error {
+	if m.crash {
+		return syscall.EIO
+	}
+	return m.Meta.SealContent(userId, inode, version, mac, seal)
+}
+
+// newTestRoot returns the root of a new user of a new volume, in a tree that
+// is not mounted.
+func newTestRoot(t *testing.T, opts Options) (*Node, *testMeta) {
+	t.Helper()
+	root, m, _ := newTestTree(t, opts)
+	return root, m
+}
+
+// newTestTree is newTestRoot along the file system the kernel would talk to.
+func newTestTree(t *testing.T, opts Options) (*Node, *testMeta, fuse.RawFileSystem) {
+	t.Helper()
+	dir := t.TempDir()
+	m := &testMeta{Meta: meta.RegisterMeta(filepath.Join(dir, "meta.db")), dir: dir}
+	if err := m.Init(&meta.Format{Name: "test"}); err != nil {
+		t.Fatalf("Init: %s", err)
+	}
+	obj, err := object.CreateStorage(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatalf("CreateStorage: %s", err)
+	}
+	privKey, err := crypto.GenerateKey(crypto.DefaultKeyType)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	rootKey := make([]byte, 32)
+	if _, err = rand.Read(rootKey); err != nil {
+		t.Fatal(err)
+	}
+	seal := func(inode Ino, list []byte) ([]byte, error) {
+		if inode != meta.RootInode {
+			return nil, nil
+		}
+		return crypto.MAC(rootKey, list), nil
+	}
+	// the keys of the user are not opened by the tree
+	err = m.CreateUser("alice", []byte("hash"), []byte("salt"), []byte("root key"), []byte("private key"),
+		privKey.Public().Bytes(), uint8(privKey.Type()), meta.Kdf{}, seal)
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+	keys := crypto.NewKeyring()
+	t.Cleanup(keys.Wipe)
+	key, err := keys.Key(rootKey)
+	if err != nil {
+		t.Fatalf("Key: %s", err)
+	}
+	opts.Sealed = true
+	root := NewRootNode(m, obj, &crypto.CryptoHelper{}, privKey, nil, keys, key, "alice", opts)
+	if root == nil {
+		t.Fatal("NewRootNode failed")
+	}
+	// lets the tree grow without a mount
+	raw := fs.NewNodeFS(root, &fs.Options{RootStableAttr: &fs.StableAttr{Ino: uint64(meta.RootInode)}})
+	return root, m, raw
+}
+
+// create creates a file in dir, as the kernel does.
+func create(t *testing.T, dir *Node, name string) (*Node, *File) {
+	t.Helper()
+	var out fuse.EntryOut
+	inode, fh, _, errno := dir.Create(context.Background(), name, 0, 0644, &out)
+	if errno != 0 {
+		t.Fatalf("Create(%s): %s", name, errno)
+	}
+	dir.AddChild(name, inode, true)
+	return inode.Operations().(*Node), fh.(*File)
+}
+
+func TestForgetWipesKeys(t *testing.T) {
+	root, _, raw := newTestTree(t, Options{})
+	var out fuse.CreateOut
+	in := &fuse.CreateIn{InHeader: fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}, Mode: 0644}
+	if status := raw.Create(nil, in, "file", &out); !status.Ok() {
+		t.Fatalf("Create: %s", status)
+	}
+	n := root.GetChild("file").Operations().(*Node)
+	if n.key.Bytes() == nil {
+		t.Fatal("the key of a new node is wiped")
+	}
+	raw.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: out.NodeId}, Fh: out.Fh})
+	raw.Forget(out.NodeId, 1)
+	if n.key.Bytes() != nil {
+		t.Fatal("the key of a node forgotten is kept")
+	}
+	// the root is forgotten on unmount, its key is the one of the user
+	root.OnForget()
+	if root.key.Bytes() == nil {
+		t.Fatal("the root key was wiped along the root node")
+	}
+}
+
+// exec runs statements on a database of the volume, as someone without the
+// keys could.
+func exec(t *testing.T, m *testMeta, db string, stmts ...string) {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", filepath.Join(m.dir, db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, stmt := range stmts {
+		if _, err = conn.Exec(stmt); err != nil {
+			t.Fatalf("%s: %s", stmt, err)
+		}
+	}
+}
+
+func TestListTampered(t *testing.T) {
+	root, m := newTestRoot(t, Options{})
+	create(t, root, "file")
+	if _, errno := root.list(context.Background(), meta.RootInode); errno != 0 {
+		t.Fatalf("list: %s", errno)
+	}
+	exec(t, m, "meta.db", "UPDATE nsfs_edge SET name = X'00' || name WHERE parent = 1 AND inode != 2")
+	if _, errno := root.list(context.Background(), meta.RootInode); errno != syscall.EIO {
+		t.Fatalf("list = %v with an entry renamed, want %v", errno, syscall.EIO)
+	}
+}
+
+func TestContentRollback(t *testing.T) {
+	root, m := newTestRoot(t, Options{})
+	n, f := create(t, root, "file")
+	if err := write(t, f, []byte("old"), 0); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	exec(t, m, "data.db", "CREATE TABLE old AS SELECT * FROM nsfs_blob")
+	if err := write(t, f, []byte("new"), 0); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	// the version before, authenticated by its MAC, is not the one chained
+	exec(t, m, "data.db", "DELETE FROM nsfs_blob", "INSERT INTO nsfs_blob SELECT * FROM old")
+	if _, err := n.openContent(false); err != errTampered {
+		t.Fatalf("openContent = %v once rolled back, want %v", err, errTampered)
+	}
+}
+
+func TestChainConcurrentWrite(t *testing.T) {
+	root, m := newTestRoot(t, Options{})
+	n, f := create(t, root, "file")
+	if err := write(t, f, []byte("first"), 0); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	n.listed = nil // the entry is read again
+	// another client writes the file after its content is read, and before
+	// the list of its parent is
+	m.listOf = meta.RootInode
+	m.onList = func() {
+		c, err := n.openContentOf(n.StableAttr().Ino, false)
+		if err != nil {
+			t.Errorf("openContentOf: %s", err)
+			return
+		}
+		defer c.close()
+		if err = c.write(map[uint32][]byte{0: []byte("second")}, 6); err != nil {
+			t.Errorf("write: %s", err)
+		}
+	}
+	c, err := n.openContent(false)
+	if err != nil {
+		t.Fatalf("openContent: %s", err)
+	}
+	defer c.close()
+	if data, err := c.read(0, 100); err != nil || string(data) != "second" {
+		t.Fatalf("read %q, %v, want the version written meanwhile", data, err)
+	}
+}
+
+func TestChainConcurrentMkdir(t *testing.T) {
+	root, m := newTestRoot(t, Options{})
+	ctx := context.Background()
+	var out fuse.EntryOut
+	inode, errno := root.Mkdir(ctx, "dir", 0755, &out)
+	if errno != 0 {
+		t.Fatalf("Mkdir: %s", errno)
+	}
+	root.AddChild("dir", inode, true)
+	dir := inode.Operations().(*Node)
+	dir.listed = nil
+	// another client creates a file in the directory after its list is read,
+	// and before the list of its parent is
+	m.listOf = meta.RootInode
+	m.onList = func() {
+		if _, _, _, errno := dir.Create(ctx, "file", 0, 0644, &out); errno != 0 {
+			t.Errorf("Create: %s", errno)
+		}
+	}
+	entries, errno := dir.list(ctx, Ino(dir.StableAttr().Ino))
+	if errno != 0 {
+		t.Fatalf("list: %s", errno)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%d entries listed, want the file created meanwhile", len(entries))
+	}
+}
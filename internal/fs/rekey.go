@@ -0,0 +1,84 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"slices"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+// RekeyContent encrypts the content of a file again under a fresh content
+// key, wrapped by newKey, the new key of the file, as the next version of the
+// content. oldKey is the key of the file the content key was wrapped by until
+// then. Deduplicated chunks are shared with other files and keep their keys,
+// whose list is encrypted again. Content rekeyed already, by a rekey
+// interrupted before the list of its parent chained it, is chained as it is.
+// The lists above the file are sealed by seal.
+func (n *Node) RekeyContent(ino Ino, oldKey, newKey []byte, seal meta.Sealer) error {
+	to, errno := n.child(bytes.Clone(newKey), n.perm)
+	if errno != 0 {
+		return errno
+	}
+	defer to.key.Wipe()
+	to.ancestors = seal
+	c, err := to.openContentOf(uint64(ino), false)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // nothing written yet
+	} else if err == nil {
+		defer c.close()
+		return n.meta.SealContent(n.userId, ino, c.info.Version, c.info.Mac, seal)
+	}
+	from, errno := n.child(bytes.Clone(oldKey), n.perm)
+	if errno != 0 {
+		return errno
+	}
+	defer from.key.Wipe()
+	if c, err = from.openContentOf(uint64(ino), false); err != nil {
+		return err
+	}
+	defer c.close()
+	return c.rekey(to)
+}
+
+// rekey writes the content again as its next version, under a fresh content
+// key wrapped by the key of to, and commits it.
+func (c *content) rekey(to *Node) error {
+	if err := c.prepare(); err != nil {
+		return err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	r := &content{n: to, ino: c.ino, info: c.info, stored: c.stored, chunkKeys: slices.Clone(c.chunkKeys)}
+	r.info.Hashes = slices.Clone(c.info.Hashes)
+	var err error
+	if r.info.Key, err = to.enc.Encrypt(to.key.Bytes(), key, crypto.ContentKeyAD(c.ino)); err != nil {
+		return err
+	}
+	if r.key, err = to.keys.Key(key); err != nil {
+		return err
+	}
+	defer r.close()
+	r.info.Version++
+	if !to.opts.Dedup {
+		count := uint32((c.info.Size + chunkSize - 1) / chunkSize)
+		for indx := uint32(0); indx < count; indx++ {
+			data, err := c.chunk(indx)
+			if err != nil {
+				return err
+			}
+			if data == nil {
+				continue // a hole
+			}
+			if err = r.putChunk(indx, data, r.info.Version); err != nil {
+				return err
+			}
+		}
+	}
+	return r.commit()
+}
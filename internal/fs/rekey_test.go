@@ -0,0 +1,72 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/object"
+)
+
+func TestRekeyContent(t *testing.T) {
+	for _, opts := range []Options{{}, {Dedup: true}, {EncryptAttrs: true, Compress: true}} {
+		root, _ := newTestRoot(t, opts)
+		n, f := create(t, root, "file")
+		ino := n.StableAttr().Ino
+		data := append(bytes.Repeat([]byte("r"), chunkSize), []byte("end")...)
+		if err := write(t, f, data, 0); err != nil {
+			t.Fatalf("Flush: %s", err)
+		}
+		var old object.Info
+		if err := root.obj.Stat(ino, &old); err != nil {
+			t.Fatalf("Stat: %s", err)
+		}
+		oldChunks, err := root.obj.Get(ino, old.Version, 0, int64(len(data)), nil)
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+
+		oldKey := bytes.Clone(n.key.Bytes())
+		newKey := make([]byte, 32)
+		if _, err = rand.Read(newKey); err != nil {
+			t.Fatal(err)
+		}
+		if err = root.RekeyContent(Ino(ino), oldKey, newKey, root.seal); err != nil {
+			t.Fatalf("%+v: RekeyContent: %s", opts, err)
+		}
+		var info object.Info
+		if err = root.obj.Stat(ino, &info); err != nil {
+			t.Fatalf("Stat: %s", err)
+		}
+		if info.Version != old.Version+1 {
+			t.Fatalf("%+v: version %d once rekeyed, want %d", opts, info.Version, old.Version+1)
+		}
+		if _, err = root.enc.Decrypt(oldKey, info.Key, crypto.ContentKeyAD(ino)); err == nil {
+			t.Fatalf("%+v: the content key is still wrapped by the old key", opts)
+		}
+		// the chunks of the previous version are gone, unless deduplicated
+		chunks, err := root.obj.Get(ino, info.Version, 0, int64(len(data)), nil)
+		if err != nil {
+			t.Fatalf("Get: %s", err)
+		}
+		for i, c := range chunks {
+			if same := bytes.Equal(c.Data, oldChunks[i].Data); same != opts.Dedup {
+				t.Fatalf("%+v: chunk %d encrypted again: %v", opts, c.Indx, !same)
+			}
+		}
+
+		// a rekey interrupted once the content is committed is only chained
+		if err = root.RekeyContent(Ino(ino), oldKey, newKey, root.seal); err != nil {
+			t.Fatalf("%+v: RekeyContent again: %s", opts, err)
+		}
+		var again object.Info
+		if err = root.obj.Stat(ino, &again); err != nil || again.Version != info.Version {
+			t.Fatalf("%+v: version %d once rekeyed again, want %d", opts, again.Version, info.Version)
+		}
+		root.UpdateKeys(map[Ino][]byte{Ino(ino): newKey})
+		if got := read(t, f, 0, len(data)+10); !bytes.Equal(got, data) {
+			t.Fatalf("%+v: read %d bytes once rekeyed, want the %d written", opts, len(got), len(data))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/bastienvty/netsecfs/internal/crypto"
+	"github.com/bastienvty/netsecfs/internal/db/meta"
+)
+
+// SealTree seals the directories and the content of the files of the tree of
+// the user written before MACs, from the leaves up, and chains their MACs into
+// the lists of their parents. The ones already sealed are checked instead, so
+// that tampering is not sealed along. It is run on an unmounted root once,
+// before the MACs of the tree are required.
+func (n *Node) SealTree(ctx context.Context) error {
+	return n.sealTree(ctx, meta.RootInode)
+}
+
+func (n *Node) sealTree(ctx context.Context, inode Ino) error {
+	entries, errno := n.list(ctx, inode)
+	if errno != 0 {
+		return errno
+	}
+	for _, e := range entries {
+		if e.Inode == meta.SharedInode {
+			continue
+		}
+		key, err := n.enc.Decrypt(n.key.Bytes(), e.Key, crypto.KeyAD(uint64(e.Inode)))
+		if err != nil {
+			return tampered(e.Inode, "key")
+		}
+		child, errno := n.child(key, n.perm)
+		if errno != 0 {
+			return errno
+		}
+		if e.Attr.Typ == meta.TypeDirectory {
+			err = child.sealTree(ctx, e.Inode)
+		} else {
+			err = child.sealContent(e.Inode)
+		}
+		child.key.Wipe()
+		if err != nil {
+			return err
+		}
+	}
+	// the children are sealed already, so the chain ends here
+	return n.meta.SealDir(n.userId, inode, func(ino Ino, list []byte) ([]byte, error) {
+		if ino != inode {
+			return nil, nil
+		}
+		return crypto.MAC(n.key.Bytes(), list), nil
+	})
+}
+
+// sealContent authenticates the content of a file written before MACs, as
+// it is, and records its version and its MAC for the list of its parent.
+// Content written as a whole is split into chunks on the way.
+func (n *Node) sealContent(ino Ino) error {
+	c, err := n.openContentOf(uint64(ino), false)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer c.close()
+	if !c.sealed() {
+		return c.truncate(c.info.Size)
+	}
+	return n.meta.SealContent(n.userId, ino, c.info.Version, c.info.Mac, nil)
+}